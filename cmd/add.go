@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"github.com/leighmacdonald/seedr/internal"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var addLabel string
+
+var addCmd = &cobra.Command{
+	Use:   "add <file.torrent>...",
+	Short: "Add torrents on the highest priority storage tier with room for them",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := internal.AddFiles(cmd.Context(), args, addLabel); err != nil {
+			log.Fatalf("Failed to add torrent: %v", err)
+		}
+	},
+}
+
+func init() {
+	addCmd.Flags().StringVarP(&addLabel, "label", "l", "", "Label to apply to the added torrents")
+	rootCmd.AddCommand(addCmd)
+}
@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"github.com/leighmacdonald/seedr/internal"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List torrents and the number of their files hardlinked elsewhere",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := internal.List(cmd.Context()); err != nil {
+			log.Fatalf("Failed to list torrents: %v", err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+}
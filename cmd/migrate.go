@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"github.com/leighmacdonald/seedr/internal"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"time"
+)
+
+var (
+	migrateFrom          string
+	migrateTo            string
+	migrateVerifyTimeout time.Duration
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Move all torrents from one client to another without moving any data",
+	Long: `Move all torrents from one client to another without moving any data.
+
+Clients are referenced by their name in the clients config section, or by the driver
+name of the main client. Progress is saved after every step, an interrupted migration
+continues where it stopped when run again.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := internal.Migrate(cmd.Context(), migrateFrom, migrateTo, migrateVerifyTimeout); err != nil {
+			log.Fatalf("Failed to migrate: %v", err)
+		}
+	},
+}
+
+func init() {
+	migrateCmd.Flags().StringVar(&migrateFrom, "from", "", "Client to migrate torrents from")
+	migrateCmd.Flags().StringVar(&migrateTo, "to", "", "Client to migrate torrents to")
+	migrateCmd.Flags().DurationVar(&migrateVerifyTimeout, "verify-timeout", time.Minute*30,
+		"How long to wait for each torrent to be verified")
+	_ = migrateCmd.MarkFlagRequired("from")
+	_ = migrateCmd.MarkFlagRequired("to")
+	rootCmd.AddCommand(migrateCmd)
+}
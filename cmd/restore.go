@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"github.com/leighmacdonald/seedr/internal"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore <hash>",
+	Short: "Restore a torrent and its data from the trash",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := internal.Restore(cmd.Context(), args[0]); err != nil {
+			log.Fatalf("Failed to restore torrent: %v", err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+}
@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"github.com/leighmacdonald/seedr/internal"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var restoreAllCmd = &cobra.Command{
+	Use:   "restore-all",
+	Short: "Add every torrent in the backup archive that is missing from the client",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := internal.RestoreAll(cmd.Context()); err != nil {
+			log.Fatalf("Failed to restore torrents: %v", err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(restoreAllCmd)
+}
@@ -1,10 +1,13 @@
 package cmd
 
 import (
+	"context"
 	"github.com/leighmacdonald/seedr/internal"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 var rootCmd = &cobra.Command{
@@ -14,16 +17,40 @@ var rootCmd = &cobra.Command{
                 love by spf13 and friends in Go.
                 Complete documentation is available at http://hugo.spf13.com`,
 	Run: func(cmd *cobra.Command, args []string) {
-		internal.Start()
+		internal.Start(cmd.Context())
 	},
 }
 
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM so commands can stop
+// cleanly. A second signal exits immediately.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Infof("Received %s, stopping", sig)
+			cancel()
+		case <-ctx.Done():
+			signal.Stop(sigs)
+			return
+		}
+		sig := <-sigs
+		log.Warnf("Received %s again, exiting", sig)
+		os.Exit(1)
+	}()
+	return ctx, cancel
+}
+
 func Execute() {
 	if err := internal.ReadConfig(""); err != nil {
 		log.Errorf("Failed to read config: %v", err)
 		os.Exit(1)
 	}
-	if err := rootCmd.Execute(); err != nil {
+	ctx, cancel := signalContext()
+	defer cancel()
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -6,7 +6,9 @@ require (
 	github.com/KnutZuidema/go-qbittorrent v0.0.0-20190814183140-292286ded47f
 	github.com/anacrolix/torrent v1.18.1
 	github.com/dustin/go-humanize v1.0.0
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/gdm85/go-libdeluge v0.5.4
+	github.com/gdm85/go-rencode v0.1.6
 	github.com/hekmon/transmissionrpc v1.1.0
 	github.com/leighmacdonald/golib v1.1.0
 	github.com/mitchellh/go-homedir v1.1.0
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"context"
+	"github.com/dustin/go-humanize"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrNoRoom = errors.New("No storage tier has room for torrent")
+
+// admissionConfig controls how new torrents are placed onto the storage tiers
+type admissionConfig struct {
+	// MakeRoom allows moving the oldest torrents down a tier to make room when no tier can fit
+	// a new torrent. When disabled, the default, the torrent is rejected instead.
+	MakeRoom bool `mapstructure:"make_room"`
+}
+
+func admissionMakeRoom() bool {
+	return config.Admission != nil && config.Admission.MakeRoom
+}
+
+// pendingBytes returns how much the torrents still downloading into the tier will consume
+func pendingBytes(downloading []*client.Torrent, cfg *checkConfig) int64 {
+	var pending int64
+	for _, t := range torrentsInTier(downloading, cfg) {
+		if remaining := t.Size - t.Downloaded; remaining > 0 {
+			pending += remaining
+		}
+	}
+	return pending
+}
+
+// projectedFree returns the free space of the tier once all current downloads, queued moves and a
+// new torrent of size bytes have completed
+func projectedFree(ctx context.Context, cfg *checkConfig, downloading []*client.Torrent, size int64) (int64, error) {
+	free, err := freeSpace(ctx, cfg.Path)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to get free space of %s", cfg.Path)
+	}
+	return free + scheduledBytesFrom(cfg.Path) - pendingBytes(downloading, cfg) - size, nil
+}
+
+// admit chooses the tier a new torrent of size bytes is downloaded to. The highest priority tier
+// which stays above min_free after the download is used. If none fit, the oldest torrents of
+// the highest priority tier able to make enough room are moved down to the next tier first.
+func admit(ctx context.Context, name string, size int64) (*checkConfig, error) {
+	downloading, err := driver.TorrentsWithState(ctx, client.Downloading)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get downloading torrents")
+	}
+	tiers := checksByPriority()
+	if len(tiers) == 0 {
+		return nil, errors.Wrapf(ErrNoRoom, "No storage tiers configured")
+	}
+	projected := make([]int64, len(tiers))
+	for i, cfg := range tiers {
+		p, err := projectedFree(ctx, cfg, downloading, size)
+		if err != nil {
+			log.Errorf("Cannot admit to tier: %v", err)
+			projected[i] = -1 << 62
+			continue
+		}
+		if p >= cfg.MinFree {
+			return cfg, nil
+		}
+		projected[i] = p
+	}
+	if admissionMakeRoom() {
+		seeding, err := driver.TorrentsWithState(ctx, client.Seeding, client.Paused)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to get seeding torrents")
+		}
+		for i, cfg := range tiers[:len(tiers)-1] {
+			if makeRoom(ctx, seeding, cfg, tiers[i+1].Path, projected[i]) {
+				return cfg, nil
+			}
+		}
+	}
+	notify("admission_rejected", "Rejected %s (%s), no storage tier has room for it", name,
+		humanize.Bytes(uint64(size)))
+	return nil, ErrNoRoom
+}
+
+// makeRoom moves the oldest torrents from the tier to dest until the projected free space is above
+// min_free. Nothing is moved and false is returned if the tier cannot free enough.
+func makeRoom(ctx context.Context, torrents []*client.Torrent, cfg *checkConfig, dest string, projected int64) bool {
+	candidates := groupUnits(unscheduled(torrentsInTier(torrents, cfg)))
+	sortAge(candidates)
+	sortReclaimable(candidates)
+	count := countUntilFree(candidates, projected, cfg.MinFree)
+	var freed int64
+	for _, t := range candidates[:count] {
+		freed += freedBy(t)
+	}
+	if projected+freed < cfg.MinFree {
+		return false
+	}
+	if err := checkTierLimit(cfg, count, len(candidates)); err != nil {
+		log.WithField("path", cfg.Path).Warnf("Cannot make room for new torrent: %v", err)
+		return false
+	}
+	for _, t := range candidates[:count] {
+		if dryRun() {
+			t.Log().Infof("[DRY] Moved torrent to next storage tier (admission)")
+		} else if moveQueueRunning() {
+			scheduleMove(t, dest, true)
+		} else {
+			if err := moveTorrent(ctx, t, dest); err != nil {
+				t.Log().Errorf("Failed to move torrent to next tier: %v", err)
+				return false
+			}
+			t.Log().Infof("Moved torrent to next storage tier (admission)")
+		}
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"context"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAdmit(t *testing.T) {
+	ctx := context.Background()
+	stateDir, err := ioutil.TempDir("", "seedr-admission")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(stateDir) }()
+	prevConfig, prevDriver := config, driver
+	defer func() { config, driver = prevConfig, prevDriver }()
+	fast := &checkConfig{Path: "/fast", Priority: 2, MinFree: 100}
+	slow := &checkConfig{Path: "/slow", Priority: 1, MinFree: 100}
+	config = &configuration{
+		General:   &generalConfig{StateDir: stateDir},
+		Admission: &admissionConfig{MakeRoom: false},
+	}
+	config.Checks = &struct {
+		Order []CheckOrder   `mapstructure:"order"`
+		Paths []*checkConfig `mapstructure:"paths"`
+	}{Paths: []*checkConfig{slow, fast}}
+	fd := newFakeDriver()
+	driver = fd
+	fd.free["/fast"] = 1000
+	fd.free["/slow"] = 2000
+	now := time.Now()
+	fd.add(&client.Torrent{Hash: "dl1", Name: "dl1", Path: "/fast", Size: 500, Downloaded: 200,
+		State: client.Downloading})
+	fd.add(&client.Torrent{Hash: "dl2", Name: "dl2", Path: "/slow", Size: 500, State: client.Downloading})
+	fd.add(&client.Torrent{Hash: "old", Name: "old", Path: "/fast", Size: 200, Progress: 1,
+		State: client.Seeding, AddedOn: now.Add(-2 * time.Hour)})
+	fd.add(&client.Torrent{Hash: "mid", Name: "mid", Path: "/fast", Size: 300, Progress: 1,
+		State: client.Seeding, AddedOn: now.Add(-time.Hour)})
+	fd.add(&client.Torrent{Hash: "new", Name: "new", Path: "/fast", Size: 300, Progress: 1,
+		State: client.Seeding, AddedOn: now})
+
+	downloading, err := fd.TorrentsWithState(ctx, client.Downloading)
+	require.NoError(t, err)
+	free, err := projectedFree(ctx, fast, downloading, 100)
+	require.NoError(t, err)
+	require.Equal(t, int64(1000-300-100), free, "Only the remaining bytes of downloads in the tier count")
+	free, err = projectedFree(ctx, slow, downloading, 100)
+	require.NoError(t, err)
+	require.Equal(t, int64(2000-500-100), free)
+
+	tier, err := admit(ctx, "small", 100)
+	require.NoError(t, err)
+	require.Equal(t, fast, tier)
+	tier, err = admit(ctx, "large", 950)
+	require.NoError(t, err)
+	require.Equal(t, slow, tier, "The next tier is used when the first cannot fit it")
+
+	fd.free["/slow"] = 500
+	_, err = admit(ctx, "large", 950)
+	require.Equal(t, ErrNoRoom, err)
+	require.Equal(t, "/fast", fd.torrents["old"].Path, "Nothing is moved with make_room disabled")
+	config.Admission = nil
+	_, err = admit(ctx, "large", 950)
+	require.Equal(t, ErrNoRoom, err)
+	require.Equal(t, "/fast", fd.torrents["old"].Path, "make_room is opt-in")
+
+	// The oldest torrents are moved down until the fast tier has room, -250 + 200 + 300 >= 100
+	config.Admission = &admissionConfig{MakeRoom: true}
+	tier, err = admit(ctx, "large", 950)
+	require.NoError(t, err)
+	require.Equal(t, fast, tier)
+	require.Equal(t, "/slow", fd.torrents["old"].Path)
+	require.Equal(t, "/slow", fd.torrents["mid"].Path)
+	require.Equal(t, "/fast", fd.torrents["new"].Path)
+
+	config.Checks.Paths = nil
+	_, err = admit(ctx, "small", 100)
+	require.True(t, errors.Is(err, ErrNoRoom), "No tiers to admit to")
+}
+
+func TestMakeRoom(t *testing.T) {
+	ctx := context.Background()
+	stateDir, err := ioutil.TempDir("", "seedr-makeroom")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(stateDir) }()
+	prevConfig, prevDriver := config, driver
+	defer func() { config, driver = prevConfig, prevDriver }()
+	config = &configuration{General: &generalConfig{StateDir: stateDir}}
+	fd := newFakeDriver()
+	driver = fd
+	old := &client.Torrent{Hash: "old", Name: "old", Path: "/fast", Size: 200, Progress: 1,
+		State: client.Seeding, AddedOn: time.Now().Add(-time.Hour)}
+	empty := &client.Torrent{Hash: "empty", Name: "empty", Path: "/fast", Progress: 1,
+		State: client.Seeding, AddedOn: time.Now().Add(-2 * time.Hour)}
+	other := &client.Torrent{Hash: "other", Name: "other", Path: "/other", Size: 1000, Progress: 1,
+		State: client.Seeding}
+	for _, tor := range []*client.Torrent{old, empty, other} {
+		fd.add(tor)
+	}
+	seeding := []*client.Torrent{old, empty, other}
+	tier := &checkConfig{Path: "/fast", MinFree: 100}
+
+	require.False(t, makeRoom(ctx, seeding, tier, "/slow", -500), "The tier cannot free enough")
+	require.Equal(t, "/fast", fd.torrents["old"].Path)
+
+	require.True(t, makeRoom(ctx, seeding, tier, "/slow", -50))
+	require.Equal(t, "/slow", fd.torrents["old"].Path)
+	require.Equal(t, "/fast", fd.torrents["empty"].Path, "Moving it would not free any space")
+	require.Equal(t, "/other", fd.torrents["other"].Path, "Only torrents in the tier are moved")
+}
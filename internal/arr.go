@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrImportPending = errors.New("Torrent has a pending import")
+	arrClient        = &http.Client{Timeout: time.Second * 15}
+	arrQueue         = &arrQueueCache{mu: &sync.Mutex{}}
+)
+
+// arrConfig defines the sonarr/radarr instances importing from the managed paths. Torrents in any
+// of their download queues are not moved or removed until the import has completed.
+type arrConfig struct {
+	CacheTTLStr string `mapstructure:"cache_ttl"`
+	CacheTTL    time.Duration
+	Instances   []*arrInstance `mapstructure:"instances"`
+}
+
+type arrInstance struct {
+	Name   string `mapstructure:"name"`
+	URL    string `mapstructure:"url"`
+	APIKey string `mapstructure:"api_key"`
+}
+
+// arrQueuePage is the subset of the v3 /api/v3/queue response we use, it is the same for sonarr
+// and radarr
+type arrQueuePage struct {
+	Page         int `json:"page"`
+	PageSize     int `json:"pageSize"`
+	TotalRecords int `json:"totalRecords"`
+	Records      []struct {
+		DownloadID           string `json:"downloadId"`
+		Title                string `json:"title"`
+		Status               string `json:"status"`
+		TrackedDownloadState string `json:"trackedDownloadState"`
+	} `json:"records"`
+}
+
+// arrQueueCache holds the pending hashes of all instances, keyed by upper case hash. A failed refresh
+// is cached as err for the same TTL so an unreachable instance is not queried for every torrent.
+type arrQueueCache struct {
+	pending map[string]string
+	err     error
+	updated time.Time
+	mu      *sync.Mutex
+}
+
+func arrEnabled() bool {
+	return config.Arr != nil && len(config.Arr.Instances) > 0
+}
+
+// fetchQueue returns the upper case hashes of all downloads in the instances queue
+func (a *arrInstance) fetchQueue(ctx context.Context) (map[string]string, error) {
+	pending := map[string]string{}
+	const pageSize = 250
+	for page := 1; ; page++ {
+		u := fmt.Sprintf("%s/api/v3/queue?page=%d&pageSize=%d&includeUnknownSeriesItems=true&includeUnknownMovieItems=true",
+			strings.TrimRight(a.URL, "/"), page, pageSize)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-Api-Key", a.APIKey)
+		resp, err := arrClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var body arrQueuePage
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		if errClose := resp.Body.Close(); errClose != nil {
+			log.Errorf("Failed to close response body: %v", errClose)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.Errorf("Invalid response status: %s", resp.Status)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to decode queue")
+		}
+		for _, r := range body.Records {
+			if r.DownloadID == "" || r.TrackedDownloadState == "imported" {
+				continue
+			}
+			pending[strings.ToUpper(r.DownloadID)] = r.Title
+		}
+		if len(body.Records) == 0 || page*pageSize >= body.TotalRecords {
+			return pending, nil
+		}
+	}
+}
+
+// refresh reloads the queues once the cache has expired. Any instance failing is cached as the
+// error until the cache expires, so every action stays blocked until it can be reached again.
+func (c *arrQueueCache) refresh(ctx context.Context) error {
+	if (c.pending != nil || c.err != nil) && time.Since(c.updated) < config.Arr.CacheTTL {
+		return c.err
+	}
+	c.updated = time.Now()
+	pending := map[string]string{}
+	for _, a := range config.Arr.Instances {
+		p, err := a.fetchQueue(ctx)
+		if err != nil {
+			c.pending = nil
+			c.err = errors.Wrapf(err, "Failed to query %s queue", a.Name)
+			return c.err
+		}
+		for k, v := range p {
+			pending[k] = a.Name + ": " + v
+		}
+	}
+	c.pending = pending
+	c.err = nil
+	return nil
+}
+
+// arrGuard returns an error when the torrent must not be moved or removed because an instance has not
+// finished importing it, or the instances cannot be reached to find out
+func arrGuard(ctx context.Context, t *client.Torrent) error {
+	if !arrEnabled() {
+		return nil
+	}
+	arrQueue.mu.Lock()
+	defer arrQueue.mu.Unlock()
+	if err := arrQueue.refresh(ctx); err != nil {
+		return errors.Wrapf(ErrImportPending, "Cannot confirm import state: %v", err)
+	}
+	if item, found := arrQueue.pending[strings.ToUpper(t.Hash)]; found {
+		return errors.Wrapf(ErrImportPending, "%s", item)
+	}
+	return nil
+}
+
+// arrGuardGroup checks every member of the group
+func arrGuardGroup(ctx context.Context, group torrentGroup) error {
+	for _, m := range group {
+		if err := arrGuard(ctx, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
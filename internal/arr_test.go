@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestArrGuard(t *testing.T) {
+	queue := arrQueuePage{Page: 1, PageSize: 250, TotalRecords: 2}
+	queue.Records = append(queue.Records, struct {
+		DownloadID           string `json:"downloadId"`
+		Title                string `json:"title"`
+		Status               string `json:"status"`
+		TrackedDownloadState string `json:"trackedDownloadState"`
+	}{DownloadID: "ABCDEF", Title: "Show.S01E01", Status: "completed", TrackedDownloadState: "importPending"})
+	queue.Records = append(queue.Records, queue.Records[0])
+	queue.Records[1].DownloadID = "123456"
+	queue.Records[1].TrackedDownloadState = "imported"
+	online := true
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if !online || r.Header.Get("X-Api-Key") != "secret" || r.URL.Path != "/api/v3/queue" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(queue)
+	}))
+	defer srv.Close()
+
+	prev := config
+	defer func() { config = prev }()
+	config = &configuration{Arr: &arrConfig{
+		CacheTTL:  time.Minute,
+		Instances: []*arrInstance{{Name: "sonarr", URL: srv.URL + "/", APIKey: "secret"}},
+	}}
+	arrQueue.pending, arrQueue.err = nil, nil
+	ctx := context.Background()
+
+	require.True(t, errors.Is(arrGuard(ctx, &client.Torrent{Hash: "abcdef"}), ErrImportPending))
+	require.NoError(t, arrGuard(ctx, &client.Torrent{Hash: "123456"}))
+	require.NoError(t, arrGuard(ctx, &client.Torrent{Hash: "fedcba"}))
+	require.Equal(t, 1, requests)
+
+	// Unreachable instances block everything, the failure is cached until the TTL expires
+	online = false
+	arrQueue.updated = time.Time{}
+	require.True(t, errors.Is(arrGuard(ctx, &client.Torrent{Hash: "fedcba"}), ErrImportPending))
+	require.True(t, errors.Is(arrGuard(ctx, &client.Torrent{Hash: "123456"}), ErrImportPending))
+	require.Equal(t, 2, requests)
+	online = true
+	arrQueue.updated = time.Time{}
+	require.NoError(t, arrGuard(ctx, &client.Torrent{Hash: "fedcba"}))
+	require.Equal(t, 3, requests)
+}
@@ -0,0 +1,251 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/leighmacdonald/golib"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// backupConfig controls periodically archiving the metainfo of every torrent so a client can be
+// rebuilt with `seedr restore-all` if its own state is lost
+type backupConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Path defaults to backup inside the state dir
+	Path        string `mapstructure:"path"`
+	IntervalStr string `mapstructure:"interval"`
+	Interval    time.Duration
+}
+
+// backupRecord is stored next to each archived .torrent
+type backupRecord struct {
+	Hash     string    `json:"hash"`
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Label    string    `json:"label"`
+	AddedOn  time.Time `json:"added_on"`
+	BackedUp time.Time `json:"backed_up"`
+}
+
+func backupEnabled() bool {
+	return config.Backup != nil && config.Backup.Enabled
+}
+
+func backupDir() string {
+	if config.Backup != nil && config.Backup.Path != "" {
+		return config.Backup.Path
+	}
+	return filepath.Join(config.General.StateDir, "backup")
+}
+
+// backupPaths returns the archive locations for a hash. Entries are addressed by their info hash and
+// spread over sub directories by its first byte.
+func backupPaths(hash string) (string, string) {
+	hash = strings.ToLower(hash)
+	dir := filepath.Join(backupDir(), hash[:2])
+	return filepath.Join(dir, hash+".torrent"), filepath.Join(dir, hash+".json")
+}
+
+func writeFileAtomic(p string, b []byte) error {
+	if err := ioutil.WriteFile(p+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+// backupTorrent archives the metainfo once and keeps the record up to date with its location
+func backupTorrent(ctx context.Context, t *client.Torrent) error {
+	if len(t.Hash) < 2 {
+		return errors.Errorf("Invalid hash: %s", t.Hash)
+	}
+	metaPath, recPath := backupPaths(t.Hash)
+	if err := os.MkdirAll(filepath.Dir(metaPath), 0755); err != nil {
+		return err
+	}
+	if !golib.Exists(metaPath) {
+		meta, err := driver.Export(ctx, t.Hash)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to export metainfo")
+		}
+		if err := writeFileAtomic(metaPath, meta); err != nil {
+			return errors.Wrapf(err, "Failed to write metainfo")
+		}
+	}
+	var rec backupRecord
+	if b, err := ioutil.ReadFile(recPath); err == nil {
+		if err := json.Unmarshal(b, &rec); err != nil {
+			log.Warnf("Replacing invalid backup record %s: %v", recPath, err)
+		}
+	}
+	if rec.Hash == t.Hash && rec.Path == t.Path && rec.Label == t.Label && rec.Name == t.Name {
+		return nil
+	}
+	rec = backupRecord{Hash: t.Hash, Name: t.Name, Path: t.Path, Label: t.Label, AddedOn: t.AddedOn,
+		BackedUp: time.Now()}
+	b, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(recPath, b)
+}
+
+// dropBackup deletes the archive entries of removed torrents so restore-all does not bring them back.
+// The archive is checked even when backups are disabled as it may remain from when they were not.
+func dropBackup(hashes []string) {
+	for _, hash := range hashes {
+		if len(hash) < 2 {
+			continue
+		}
+		// The record goes first, backupEntries only lists entries with one
+		metaPath, recPath := backupPaths(hash)
+		for _, p := range []string{recPath, metaPath} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				log.WithField("hash", hash).Errorf("Failed to remove backup entry: %v", err)
+			}
+		}
+	}
+}
+
+// backupAll archives every torrent of the client. ErrUnsupported is returned as soon as the client
+// turns out to be unable to export metainfo at all.
+func backupAll(ctx context.Context) error {
+	torrents, err := driver.Torrents(ctx)
+	if err != nil {
+		log.Errorf("Failed to get torrents for backup: %v", err)
+		return nil
+	}
+	failed := 0
+	for _, t := range torrents {
+		if err := backupTorrent(ctx, t); err != nil {
+			if errors.Is(err, client.ErrUnsupported) {
+				return err
+			}
+			t.Log().Errorf("Failed to backup torrent: %v", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		notify("backup_failed", "Failed to backup %d of %d torrents", failed, len(torrents))
+		return nil
+	}
+	log.Debugf("Backed up %d torrents", len(torrents))
+	return nil
+}
+
+// backupWorker runs the backups until ctx is done, backups are disabled with a warning when the
+// client cannot export metainfo, eg: deluge without a state_dir
+func backupWorker(ctx context.Context) {
+	t0 := time.NewTicker(config.Backup.Interval)
+	defer t0.Stop()
+	for {
+		if err := backupAll(ctx); err != nil {
+			log.Warnf("Backups disabled: %v", err)
+			return
+		}
+		select {
+		case <-t0.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func startBackup(ctx context.Context) {
+	if !backupEnabled() {
+		return
+	}
+	go backupWorker(ctx)
+}
+
+// backupEntries returns every record in the archive
+func backupEntries() ([]*backupRecord, error) {
+	var records []*backupRecord
+	err := filepath.Walk(backupDir(), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(p) != ".json" {
+			return nil
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		var rec backupRecord
+		if err := json.Unmarshal(b, &rec); err != nil {
+			log.Warnf("Skipping invalid backup record %s: %v", p, err)
+			return nil
+		}
+		records = append(records, &rec)
+		return nil
+	})
+	return records, err
+}
+
+// RestoreAll adds every archived torrent missing from the client back at its original location
+func RestoreAll(ctx context.Context) error {
+	cl, err := newDriver(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := cl.Close(); err != nil {
+			log.Errorf("Failed to close connection: %v", err)
+		}
+	}()
+	return restoreBackup(ctx, cl)
+}
+
+func restoreBackup(ctx context.Context, cl client.Driver) error {
+	records, err := backupEntries()
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read backup archive")
+	}
+	torrents, err := cl.Torrents(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to get torrents")
+	}
+	existing := map[string]bool{}
+	for _, t := range torrents {
+		existing[strings.ToLower(t.Hash)] = true
+	}
+	restored, present, failed := 0, 0, 0
+	for _, rec := range records {
+		l := log.WithFields(log.Fields{"name": rec.Name, "hash": rec.Hash, "path": rec.Path})
+		if existing[strings.ToLower(rec.Hash)] {
+			present++
+			continue
+		}
+		metaPath, _ := backupPaths(rec.Hash)
+		meta, err := ioutil.ReadFile(metaPath)
+		if err != nil {
+			l.Errorf("Failed to read archived metainfo: %v", err)
+			failed++
+			continue
+		}
+		if dryRun() {
+			l.Infof("[DRY] Restored torrent")
+			continue
+		}
+		if err := cl.Add(ctx, rec.Hash+".torrent", bytes.NewReader(meta), rec.Path, rec.Label, client.AddOptions{}); err != nil {
+			l.Errorf("Failed to restore torrent: %v", err)
+			failed++
+			continue
+		}
+		l.Infof("Restored torrent")
+		restored++
+	}
+	log.Infof("Restored %d torrents, %d already present", restored, present)
+	if failed > 0 {
+		return errors.Errorf("%d torrents failed to restore", failed)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	stateDir, err := ioutil.TempDir("", "seedr-backup")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(stateDir) }()
+	prevConfig, prevDriver := config, driver
+	defer func() { config, driver = prevConfig, prevDriver }()
+	config = &configuration{General: &generalConfig{StateDir: stateDir}}
+
+	src := newFakeDriver()
+	require.NoError(t, src.Add(ctx, "a.torrent", bytes.NewReader(testMetaInfo("a.bin", 100)), "/data/ssd", "tv", client.AddOptions{}))
+	require.NoError(t, src.Add(ctx, "b.torrent", bytes.NewReader(testMetaInfo("b.bin", 200)), "/data/hdd", "", client.AddOptions{}))
+	driver = src
+	require.NoError(t, backupAll(ctx))
+	records, err := backupEntries()
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+
+	dst := newFakeDriver()
+	require.NoError(t, dst.Add(ctx, "a.torrent", bytes.NewReader(testMetaInfo("a.bin", 100)), "/data/ssd", "tv", client.AddOptions{}))
+	require.NoError(t, restoreBackup(ctx, dst))
+	torrents, err := dst.Torrents(ctx)
+	require.NoError(t, err)
+	require.Len(t, torrents, 2)
+	for _, tor := range torrents {
+		var orig client.Torrent
+		require.NoError(t, src.Torrent(ctx, tor.Hash, &orig))
+		require.Equal(t, orig.Path, tor.Path)
+		require.Equal(t, orig.Label, tor.Label)
+	}
+
+	// A removed torrent is dropped from the archive and not restored
+	all, err := src.Torrents(ctx)
+	require.NoError(t, err)
+	b := newActionBatch()
+	for _, tor := range all {
+		if tor.Name == "b.bin" {
+			require.NoError(t, b.remove(ctx, torrentGroup{tor}, nil, "test"))
+		}
+	}
+	b.flush(ctx, false)
+	records, err = backupEntries()
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, "a.bin", records[0].Name)
+	empty := newFakeDriver()
+	require.NoError(t, restoreBackup(ctx, empty))
+	torrents, err = empty.Torrents(ctx)
+	require.NoError(t, err)
+	require.Len(t, torrents, 1)
+}
+
+// noExportDriver is a client without access to the metainfo, like deluge without a state_dir
+type noExportDriver struct {
+	*fakeDriver
+}
+
+func (noExportDriver) Export(context.Context, string) ([]byte, error) {
+	return nil, errors.Wrapf(client.ErrUnsupported, "No state_dir configured")
+}
+
+func TestBackupUnsupported(t *testing.T) {
+	ctx := context.Background()
+	stateDir, err := ioutil.TempDir("", "seedr-backup")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(stateDir) }()
+	prevConfig, prevDriver := config, driver
+	defer func() { config, driver = prevConfig, prevDriver }()
+	config = &configuration{
+		General: &generalConfig{StateDir: stateDir},
+		Backup:  &backupConfig{Enabled: true, Interval: time.Millisecond},
+	}
+	fd := newFakeDriver()
+	require.NoError(t, fd.Add(ctx, "a.torrent", bytes.NewReader(testMetaInfo("a.bin", 100)), "/data", "", client.AddOptions{}))
+	driver = noExportDriver{fd}
+	require.True(t, errors.Is(backupAll(ctx), client.ErrUnsupported))
+
+	// The worker gives up instead of failing every interval
+	done := make(chan struct{})
+	go func() {
+		backupWorker(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Backup worker kept running")
+	}
+}
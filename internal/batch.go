@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"context"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// actionBatch collects the moves and removals decided by the checks during a tick so they are sent
+// to the client in as few calls as possible. The full torrent list, used to find the torrents sharing
+// a payload, is fetched once and refreshed after the batch has been applied.
+type actionBatch struct {
+	all []*client.Torrent
+	// moves are torrents moved by the client on their own, keyed by the destination
+	moves map[string][]*batchedAction
+	// members are removed without their data before the roots are removed along with it
+	members []*batchedAction
+	roots   []*batchedAction
+}
+
+// batchedAction is a torrent waiting on the batch and the reason it is logged with once applied
+type batchedAction struct {
+	torrent *client.Torrent
+	reason  string
+	// size is the payload size of a removed root, reserved against the delete limits until the flush
+	size int64
+}
+
+func newActionBatch() *actionBatch {
+	return &actionBatch{moves: map[string][]*batchedAction{}}
+}
+
+// torrents returns every torrent of the client, they are only fetched once until the batch is flushed
+func (b *actionBatch) torrents(ctx context.Context) ([]*client.Torrent, error) {
+	if b.all == nil {
+		all, err := driver.Torrents(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to get torrents")
+		}
+		b.all = all
+	}
+	return b.all, nil
+}
+
+// pending returns the number of actions waiting to be applied
+func (b *actionBatch) pending() int {
+	n := len(b.members) + len(b.roots)
+	for _, actions := range b.moves {
+		n += len(actions)
+	}
+	return n
+}
+
+// move moves the torrent, along with its group, to dest. Groups and moves done by the local mover
+// have to be sequenced so they are done right away, everything else waits for the flush.
+func (b *actionBatch) move(ctx context.Context, t *client.Torrent, dest string, reason string) error {
+	all, err := b.torrents(ctx)
+	if err != nil {
+		return err
+	}
+	group := groupOf(t, all)
+	if err := arrGuardGroup(ctx, group); err != nil {
+		return err
+	}
+	if len(group) > 1 || moverEnabled() {
+		if err := moveGroup(ctx, group, dest); err != nil {
+			return err
+		}
+		t.Log().Infof("Moved torrent to next storage tier (%s)", reason)
+		return nil
+	}
+	if movedTo(t, dest) {
+		return nil
+	}
+	b.moves[dest] = append(b.moves[dest], &batchedAction{torrent: t, reason: reason})
+	return nil
+}
+
+// remove removes the torrent along with its group, see removeTorrent
+func (b *actionBatch) remove(ctx context.Context, group torrentGroup, cfg *checkConfig, reason string) error {
+	root := group.root()
+	if trashEnabled() {
+		// The payload is moved into the trash before the client lets go of it, so the whole group is
+		// removed right away
+		if err := trashTorrent(ctx, group, cfg); err != nil {
+			return err
+		}
+		safety.recordDelete(group.size())
+		root.Log().Infof("Removed torrent (%s)", reason)
+		return nil
+	}
+	for _, m := range group {
+		if m.Hash != root.Hash {
+			b.members = append(b.members, &batchedAction{torrent: m, reason: reason})
+		}
+	}
+	b.roots = append(b.roots, &batchedAction{torrent: root, reason: reason, size: group.size()})
+	safety.reserveDelete(group.size())
+	return nil
+}
+
+// flush applies the batched actions. With wait set it only returns once the client has finished
+// moving the data, so the free space of the tiers is up to date for the next check.
+func (b *actionBatch) flush(ctx context.Context, wait bool) {
+	if b.pending() == 0 {
+		return
+	}
+	var moving []string
+	for dest, actions := range b.moves {
+		if err := driver.MoveMany(ctx, actionHashes(actions), dest); err != nil {
+			log.WithField("dest", dest).Errorf("Failed to move %d torrents to next tier: %v", len(actions), err)
+			continue
+		}
+		for _, a := range actions {
+			a.torrent.Log().WithField("dest", dest).Infof("Moved torrent to next storage tier (%s)", a.reason)
+			moving = append(moving, a.torrent.Hash)
+		}
+	}
+	removed := false
+	if err := driver.RemoveMany(ctx, actionHashes(b.members), false); err != nil {
+		// The data of the roots is still in use by the members
+		log.Errorf("Failed to remove %d group members, keeping their roots: %v", len(b.members), err)
+	} else {
+		for _, a := range b.members {
+			a.torrent.Log().Infof("Removed group member without data")
+		}
+		dropBackup(actionHashes(b.members))
+		if err := driver.RemoveMany(ctx, actionHashes(b.roots), true); err != nil {
+			log.Errorf("Failed to remove %d torrents: %v", len(b.roots), err)
+		} else {
+			for _, a := range b.roots {
+				a.torrent.Log().Infof("Removed torrent (%s)", a.reason)
+			}
+			dropBackup(actionHashes(b.roots))
+			removed = true
+		}
+	}
+	for _, a := range b.roots {
+		safety.releaseDelete(a.size, removed)
+	}
+	b.all = nil
+	b.moves = map[string][]*batchedAction{}
+	b.members = nil
+	b.roots = nil
+	if wait && len(moving) > 0 {
+		if err := waitMovesComplete(ctx, moving); err != nil {
+			log.Errorf("Failed to wait for moves to complete: %v", err)
+		}
+	}
+}
+
+func actionHashes(actions []*batchedAction) []string {
+	hashes := make([]string, len(actions))
+	for i, a := range actions {
+		hashes[i] = a.torrent.Hash
+	}
+	return hashes
+}
+
+// waitMovesComplete blocks until the client is no longer moving any of the torrents
+func waitMovesComplete(ctx context.Context, hashes []string) error {
+	for len(hashes) > 0 {
+		select {
+		case <-time.After(statePollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		torrents, err := driver.TorrentsByHash(ctx, hashes)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to get moved torrent state")
+		}
+		var moving []string
+		for _, hash := range hashes {
+			if t, found := torrents[hash]; found && t.State == client.Moving {
+				moving = append(moving, hash)
+			}
+		}
+		if len(moving) > 0 {
+			log.Infof("Waiting for %d move operations", len(moving))
+		}
+		hashes = moving
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"context"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestActionBatch(t *testing.T) {
+	ctx := context.Background()
+	prevInterval := statePollInterval
+	defer func() { statePollInterval = prevInterval }()
+	statePollInterval = time.Millisecond
+	stateDir, err := ioutil.TempDir("", "seedr-batch")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(stateDir) }()
+	prevConfig, prevDriver := config, driver
+	defer func() { config, driver = prevConfig, prevDriver }()
+	config = &configuration{General: &generalConfig{StateDir: stateDir}}
+	fd := newFakeDriver()
+	driver = fd
+	pack := &client.Torrent{Hash: "pack", Name: "Show.S01", Path: "/data", Size: 1000, Progress: 1}
+	xseed := &client.Torrent{Hash: "xseed", Name: "Show.S01", Path: "/data", Size: 1000, Progress: 1}
+	a := &client.Torrent{Hash: "aaa", Name: "a", Path: "/data", Size: 100, Progress: 1}
+	b := &client.Torrent{Hash: "bbb", Name: "b", Path: "/data", Size: 200, Progress: 1}
+	c := &client.Torrent{Hash: "ccc", Name: "c", Path: "/data", Size: 300, Progress: 1}
+	d := &client.Torrent{Hash: "ddd", Name: "d", Path: "/data", Size: 400, Progress: 1}
+	for _, tor := range []*client.Torrent{pack, xseed, a, b, c, d} {
+		fd.add(tor)
+	}
+	tier := &checkConfig{Path: "/data"}
+	batch := newActionBatch()
+	require.NoError(t, removeTorrent(ctx, batch, pack, tier, false, "test"))
+	require.NoError(t, removeTorrent(ctx, batch, a, tier, false, "test"))
+	require.NoError(t, removeTorrent(ctx, batch, b, tier, false, "test"))
+	require.NoError(t, batch.move(ctx, c, "/archive", "test"))
+	require.NoError(t, batch.move(ctx, d, "/archive", "test"))
+	require.Equal(t, 6, batch.pending())
+	require.Empty(t, fd.removed, "Nothing is applied before the flush")
+
+	batch.flush(ctx, true)
+	require.Equal(t, 0, batch.pending())
+	require.Equal(t, 2, fd.calls["RemoveMany"], "Members and roots are removed in one call each")
+	require.Equal(t, 1, fd.calls["MoveMany"])
+	require.Contains(t, fd.removed, "xseed")
+	require.True(t, fd.removed["pack"], "Only the root deletes the data")
+	require.False(t, fd.removed["xseed"])
+	require.True(t, fd.removed["aaa"])
+	require.True(t, fd.removed["bbb"])
+	var moved client.Torrent
+	require.NoError(t, fd.Torrent(ctx, "ddd", &moved))
+	require.Equal(t, "/archive", moved.Path)
+}
+
+func TestActionBatchDeleteLimits(t *testing.T) {
+	ctx := context.Background()
+	stateDir, err := ioutil.TempDir("", "seedr-batch")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(stateDir) }()
+	prevConfig, prevDriver, prevSafety := config, driver, safety
+	defer func() { config, driver, safety = prevConfig, prevDriver, prevSafety }()
+	config = &configuration{
+		General: &generalConfig{StateDir: stateDir},
+		Limits:  &limitsConfig{MaxBytesPerDay: 1500},
+	}
+	safety = &safetyState{}
+	fd := newFakeDriver()
+	driver = fd
+	pack := &client.Torrent{Hash: "pack", Name: "Show.S01", Path: "/data", Size: 1000, Progress: 1}
+	xseed := &client.Torrent{Hash: "xseed", Name: "Show.S01", Path: "/data", Size: 1000, Progress: 1}
+	a := &client.Torrent{Hash: "aaa", Name: "a", Path: "/data", Size: 600, Progress: 1}
+	for _, tor := range []*client.Torrent{pack, xseed, a} {
+		fd.add(tor)
+	}
+	tier := &checkConfig{Path: "/data"}
+
+	// The group is counted once with the size of the shared payload
+	batch := newActionBatch()
+	require.NoError(t, removeTorrent(ctx, batch, pack, tier, true, "test"))
+	fd.removeErr = errors.New("failed")
+	batch.flush(ctx, false)
+	require.Equal(t, 0, safety.Deletions, "A failed flush does not use up the budget")
+	require.Equal(t, int64(0), safety.BytesDeleted)
+	require.False(t, dryRun())
+
+	fd.removeErr = nil
+	require.NoError(t, removeTorrent(ctx, batch, pack, tier, true, "test"))
+	require.Equal(t, 0, safety.Deletions, "Nothing is recorded before the flush")
+	require.True(t, errors.Is(removeTorrent(ctx, batch, a, tier, true, "test"), ErrLimitReached),
+		"The queued removals count against the limit")
+	batch.flush(ctx, false)
+	require.Equal(t, 1, safety.Deletions)
+	require.Equal(t, int64(1000), safety.BytesDeleted)
+	require.True(t, fd.removed["pack"])
+	require.Contains(t, fd.removed, "xseed")
+	require.NotContains(t, fd.removed, "aaa")
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"context"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	"github.com/shirou/gopsutil/v3/disk"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrMissingCapability is returned when the configuration or a command needs a feature the client
+// does not support
+var ErrMissingCapability = errors.New("Client does not support a required feature")
+
+// capabilityEffects describes how seedr adapts when the client is missing a capability
+var capabilityEffects = map[client.Capability]string{
+	client.CapQueue:          "upload slots are not reordered in the queue",
+	client.CapLabels:         "labels are not applied to added torrents",
+	client.CapVerify:         "cross seeds and migrations to this client cannot be verified",
+	client.CapMoveData:       "data is only moved between tiers by the local mover",
+	client.CapFreeSpace:      "free space is read from the local filesystem",
+	client.CapEvents:         "torrent state is polled every update_interval",
+	client.CapFilePriorities: "file priorities cannot be changed",
+	client.CapAnnounce:       "reannounces cannot be forced",
+	client.CapSetLocation:    "the local mover cannot be used",
+	client.CapSessionLimits:  "schedules can only set rate and per torrent connection limits",
+}
+
+// checkCapabilities logs the features the client is missing and how seedr adapts to each. An error
+// is returned for configurations which cannot work without one of them.
+func checkCapabilities(caps client.Capabilities) error {
+	log.Infof("Client supports: %s", caps)
+	for _, c := range caps.Missing() {
+		log.Warnf("Client does not support %s, %s", c, capabilityEffects[c])
+	}
+	if config.Checks != nil && len(config.Checks.Paths) > 1 && !caps.Has(client.CapMoveData) && !moverEnabled() {
+		return errors.Wrapf(ErrMissingCapability, "Moving between storage tiers requires the mover to be enabled")
+	}
+	if moverEnabled() && !caps.Has(client.CapSetLocation) {
+		return errors.Wrapf(ErrMissingCapability, "The mover requires the client to set a location without moving data")
+	}
+	if crossSeedEnabled() && !caps.Has(client.CapVerify) {
+		return errors.Wrapf(ErrMissingCapability, "cross_seed requires the client to verify torrents")
+	}
+	if slotsEnabled() && len(config.Slots.Labels) > 0 && !caps.Has(client.CapLabels) {
+		return errors.Wrapf(ErrMissingCapability, "slots.labels requires the client to support labels")
+	}
+	if config.Schedules != nil && !caps.Has(client.CapSessionLimits) {
+		for _, p := range append([]*scheduleProfile{config.Schedules.Default}, config.Schedules.Profiles...) {
+			if p != nil && (p.MaxActiveDownloads != nil || p.MaxActiveSeeding != nil || p.MaxConnections != nil) {
+				return errors.Wrapf(ErrMissingCapability,
+					"Schedule profile %s sets a queue or global connection limit the client does not support", p.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// freeSpace returns the free space of the path. Clients unable to report it for any path fall back to
+// the local filesystem, which requires the paths to be mounted at the same location as on the clients
+// host.
+func freeSpace(ctx context.Context, path string) (int64, error) {
+	if driver.Capabilities().Has(client.CapFreeSpace) {
+		return driver.FreeSpace(ctx, path)
+	}
+	use, err := disk.Usage(path)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to get local free space")
+	}
+	return int64(use.Free), nil
+}
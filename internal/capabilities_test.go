@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"context"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCheckCapabilities(t *testing.T) {
+	prevConfig := config
+	defer func() { config = prevConfig }()
+	config = &configuration{}
+	config.Checks = &struct {
+		Order []CheckOrder   `mapstructure:"order"`
+		Paths []*checkConfig `mapstructure:"paths"`
+	}{Paths: []*checkConfig{{Path: "/fast"}, {Path: "/slow"}}}
+	all := client.NewCapabilities(client.AllCapabilities...)
+	require.NoError(t, checkCapabilities(all))
+
+	noMove := client.NewCapabilities(client.CapQueue, client.CapVerify, client.CapSetLocation)
+	require.True(t, errors.Is(checkCapabilities(noMove), ErrMissingCapability))
+	config.Mover = &moverConfig{Enabled: true}
+	require.NoError(t, checkCapabilities(noMove), "The mover moves the data itself")
+	require.True(t, errors.Is(checkCapabilities(client.NewCapabilities(client.CapMoveData)), ErrMissingCapability),
+		"The mover cannot repoint clients which move data on a location change")
+
+	config.CrossSeed = &crossSeedConfig{Enabled: true}
+	require.True(t, errors.Is(checkCapabilities(client.NewCapabilities(client.CapMoveData, client.CapSetLocation)),
+		ErrMissingCapability))
+
+	config = &configuration{}
+	active := 1
+	config.Schedules = &schedulesConfig{Default: &scheduleProfile{Name: "default", UploadLimitStr: "1MB"}}
+	noLimits := client.NewCapabilities(client.CapFilePriorities, client.CapSetLocation)
+	require.NoError(t, checkCapabilities(noLimits), "Rate limits are supported by every client")
+	config.Schedules.Profiles = []*scheduleProfile{{Name: "work", MaxActiveDownloads: &active}}
+	require.True(t, errors.Is(checkCapabilities(noLimits), ErrMissingCapability))
+	require.NoError(t, checkCapabilities(all))
+}
+
+func TestFreeSpaceFallback(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "seedr-free")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	prevDriver := driver
+	defer func() { driver = prevDriver }()
+	fd := newFakeDriver()
+	driver = fd
+	fd.free[dir] = 100
+	free, err := freeSpace(ctx, dir)
+	require.NoError(t, err)
+	require.Equal(t, int64(100), free)
+
+	fd.caps = client.NewCapabilities()
+	free, err = freeSpace(ctx, dir)
+	require.NoError(t, err)
+	require.NotEqual(t, int64(100), free, "Free space should be read locally")
+	require.Greater(t, free, int64(0))
+}
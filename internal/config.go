@@ -8,7 +8,9 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"os"
+	"path/filepath"
 	"sort"
+	"time"
 )
 
 var (
@@ -21,23 +23,52 @@ type CheckOrder string
 const (
 	MinFree  CheckOrder = "min_free"
 	MaxRatio CheckOrder = "max_ratio"
+	Forecast CheckOrder = "forecast"
 )
 
 type configuration struct {
-	General *struct {
-		UpdateInterval string `mapstructure:"update_interval"`
-		StatInterval   string `mapstructure:"stat_interval"`
-		DryRunMode     bool   `mapstructure:"dry_run_mode"`
-	} `mapstructure:"general"`
-	Log *struct {
+	General *generalConfig `mapstructure:"general"`
+	Log     *struct {
 		Level     string `mapstructure:"level"`
 		LogColour bool   `mapstructure:"log_colour"`
 	} `mapstructure:"log"`
 	Client *client.Config `mapstructure:"client"`
-	Checks *struct {
+	// Clients are additional named clients, used as the source or destination of a migration
+	Clients map[string]*client.Config `mapstructure:"clients"`
+	Checks  *struct {
 		Order []CheckOrder   `mapstructure:"order"`
 		Paths []*checkConfig `mapstructure:"paths"`
 	} `mapstructure:"checks"`
+	Trash         *trashConfig      `mapstructure:"trash"`
+	Limits        *limitsConfig     `mapstructure:"limits"`
+	Mover         *moverConfig      `mapstructure:"mover"`
+	MoveQueue     *moveQueueConfig  `mapstructure:"move_queue"`
+	Forecast      *forecastConfig   `mapstructure:"forecast"`
+	RSS           *rssConfig        `mapstructure:"rss"`
+	Watch         *watchConfig      `mapstructure:"watch"`
+	Admission     *admissionConfig  `mapstructure:"admission"`
+	CrossSeed     *crossSeedConfig  `mapstructure:"cross_seed"`
+	Hardlinks     *hardlinksConfig  `mapstructure:"hardlinks"`
+	Arr           *arrConfig        `mapstructure:"arr"`
+	Backup        *backupConfig     `mapstructure:"backup"`
+	LastSeeder    *lastSeederConfig `mapstructure:"last_seeder"`
+	Schedules     *schedulesConfig  `mapstructure:"schedules"`
+	Slots         *slotsConfig      `mapstructure:"slots"`
+	Reconnect     *reconnectConfig  `mapstructure:"reconnect"`
+	Notifications *struct {
+		WebhookURL string `mapstructure:"webhook_url"`
+	} `mapstructure:"notifications"`
+	Metrics *struct {
+		ListenAddr string `mapstructure:"listen_addr"`
+	} `mapstructure:"metrics"`
+}
+
+type generalConfig struct {
+	UpdateInterval string `mapstructure:"update_interval"`
+	StatInterval   string `mapstructure:"stat_interval"`
+	DryRunMode     bool   `mapstructure:"dry_run_mode"`
+	// StateDir is where seedr persists its own state between runs
+	StateDir string `mapstructure:"state_dir"`
 }
 
 type checkConfig struct {
@@ -50,6 +81,59 @@ type checkConfig struct {
 	MaxRatioEnabled float64 `mapstructure:"max_ratio_enabled"`
 }
 
+type trashConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Path is resolved relative to the tier root when not absolute so that the payload
+	// can be renamed into it without copying
+	Path         string `mapstructure:"path"`
+	RetentionStr string `mapstructure:"retention"`
+	Retention    time.Duration
+}
+
+// limitsConfig defines the circuit breakers for destructive actions, zero values disable a limit
+type limitsConfig struct {
+	MaxDeletionsPerTick int    `mapstructure:"max_deletions_per_tick"`
+	MaxDeletionsPerDay  int    `mapstructure:"max_deletions_per_day"`
+	MaxBytesPerDayStr   string `mapstructure:"max_bytes_deleted_per_day"`
+	MaxBytesPerDay      int64
+	// MaxTierPct is the maximum percentage of a tiers torrents a single check may move or remove
+	MaxTierPct float64 `mapstructure:"max_tier_pct"`
+}
+
+// moverConfig enables seedr copying payloads between tiers itself instead of relying on the client
+type moverConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// RateLimitStr is the maximum copy rate per second, eg: 50MB
+	RateLimitStr  string `mapstructure:"rate_limit"`
+	RateLimit     int64
+	SkipHashCheck bool `mapstructure:"skip_hash_check"`
+}
+
+// moveQueueConfig controls how many moves may run at once per device, their combined copy rate
+// and when non urgent moves are allowed to run
+type moveQueueConfig struct {
+	Enabled           bool `mapstructure:"enabled"`
+	SourceConcurrency int  `mapstructure:"source_concurrency"`
+	DestConcurrency   int  `mapstructure:"dest_concurrency"`
+	// RateLimitStr is the combined rate for all seedr side moves, per second. Moves done by the
+	// client are not limited.
+	RateLimitStr string `mapstructure:"rate_limit"`
+	RateLimit    int64
+	Windows      []*moveWindow `mapstructure:"windows"`
+}
+
+// forecastConfig controls predicting when a tier will cross its min_free threshold so torrents
+// can be moved off it before it does
+type forecastConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// WindowStr is how far back free space samples are used to calculate the consumption rate
+	WindowStr string `mapstructure:"window"`
+	Window    time.Duration
+	// HorizonStr is how far ahead a predicted crossing will trigger tiering
+	HorizonStr string `mapstructure:"horizon"`
+	Horizon    time.Duration
+}
+
 // Read reads in config file and ENV variables if set.
 func ReadConfig(cfgFile string) error {
 	// Find home directory.
@@ -73,6 +157,11 @@ func ReadConfig(cfgFile string) error {
 		if err := viper.Unmarshal(newConfig); err != nil {
 			return errors.Wrapf(err, "Failed to parse config")
 		}
+		for _, name := range newConfig.Checks.Order {
+			if _, found := checkFuncs[name]; !found {
+				return errors.Wrapf(ErrInvalidConfig, "Unknown check in checks.order: %s", name)
+			}
+		}
 		for _, p := range newConfig.Checks.Paths {
 			s, err := humanize.ParseBytes(p.MinFreeStr)
 			if err != nil {
@@ -80,6 +169,201 @@ func ReadConfig(cfgFile string) error {
 			}
 			p.MinFree = int64(s)
 		}
+		if newConfig.Trash != nil && newConfig.Trash.Enabled {
+			if newConfig.Trash.Path == "" {
+				return errors.Wrapf(ErrInvalidConfig, "trash.path must be set")
+			}
+			retention, err := time.ParseDuration(newConfig.Trash.RetentionStr)
+			if err != nil {
+				return errors.Wrapf(ErrInvalidConfig, "Invalid trash.retention: %v", err)
+			}
+			newConfig.Trash.Retention = retention
+		}
+		if newConfig.Limits != nil && newConfig.Limits.MaxBytesPerDayStr != "" {
+			s, err := humanize.ParseBytes(newConfig.Limits.MaxBytesPerDayStr)
+			if err != nil {
+				return errors.Wrapf(ErrInvalidConfig, "Invalid limits.max_bytes_deleted_per_day: %v", err)
+			}
+			newConfig.Limits.MaxBytesPerDay = int64(s)
+		}
+		if newConfig.Mover != nil && newConfig.Mover.RateLimitStr != "" {
+			s, err := humanize.ParseBytes(newConfig.Mover.RateLimitStr)
+			if err != nil {
+				return errors.Wrapf(ErrInvalidConfig, "Invalid mover.rate_limit: %v", err)
+			}
+			newConfig.Mover.RateLimit = int64(s)
+		}
+		if newConfig.MoveQueue != nil {
+			if newConfig.MoveQueue.RateLimitStr != "" {
+				s, err := humanize.ParseBytes(newConfig.MoveQueue.RateLimitStr)
+				if err != nil {
+					return errors.Wrapf(ErrInvalidConfig, "Invalid move_queue.rate_limit: %v", err)
+				}
+				newConfig.MoveQueue.RateLimit = int64(s)
+			}
+			for _, w := range newConfig.MoveQueue.Windows {
+				if err := w.parse(); err != nil {
+					return errors.Wrapf(ErrInvalidConfig, "Invalid move_queue.windows: %v", err)
+				}
+			}
+		}
+		if newConfig.Forecast != nil && newConfig.Forecast.Enabled {
+			window, err := time.ParseDuration(newConfig.Forecast.WindowStr)
+			if err != nil {
+				return errors.Wrapf(ErrInvalidConfig, "Invalid forecast.window: %v", err)
+			}
+			horizon, err := time.ParseDuration(newConfig.Forecast.HorizonStr)
+			if err != nil {
+				return errors.Wrapf(ErrInvalidConfig, "Invalid forecast.horizon: %v", err)
+			}
+			newConfig.Forecast.Window = window
+			newConfig.Forecast.Horizon = horizon
+		}
+		if newConfig.RSS != nil && newConfig.RSS.Enabled {
+			interval, err := time.ParseDuration(newConfig.RSS.IntervalStr)
+			if err != nil {
+				return errors.Wrapf(ErrInvalidConfig, "Invalid rss.interval: %v", err)
+			}
+			newConfig.RSS.Interval = interval
+			for _, f := range newConfig.RSS.Feeds {
+				if err := f.parse(); err != nil {
+					return errors.Wrapf(ErrInvalidConfig, "Invalid rss feed %s: %v", f.Name, err)
+				}
+			}
+		}
+		if newConfig.Watch != nil && newConfig.Watch.Enabled {
+			if newConfig.Watch.PollIntervalStr == "" {
+				newConfig.Watch.PollIntervalStr = "1m"
+			}
+			interval, err := time.ParseDuration(newConfig.Watch.PollIntervalStr)
+			if err != nil {
+				return errors.Wrapf(ErrInvalidConfig, "Invalid watch.poll_interval: %v", err)
+			}
+			newConfig.Watch.PollInterval = interval
+			for i, dir := range newConfig.Watch.Dirs {
+				expanded, err := homedir.Expand(dir)
+				if err != nil {
+					return errors.Wrapf(ErrInvalidConfig, "Invalid watch dir %s: %v", dir, err)
+				}
+				newConfig.Watch.Dirs[i] = filepath.Clean(expanded)
+			}
+		}
+		if newConfig.CrossSeed != nil && newConfig.CrossSeed.Enabled {
+			if newConfig.CrossSeed.VerifyTimeoutStr == "" {
+				newConfig.CrossSeed.VerifyTimeoutStr = "30m"
+			}
+			timeout, err := time.ParseDuration(newConfig.CrossSeed.VerifyTimeoutStr)
+			if err != nil {
+				return errors.Wrapf(ErrInvalidConfig, "Invalid cross_seed.verify_timeout: %v", err)
+			}
+			newConfig.CrossSeed.VerifyTimeout = timeout
+		}
+		if newConfig.Hardlinks != nil && newConfig.Hardlinks.CacheTTLStr != "" {
+			ttl, err := time.ParseDuration(newConfig.Hardlinks.CacheTTLStr)
+			if err != nil {
+				return errors.Wrapf(ErrInvalidConfig, "Invalid hardlinks.cache_ttl: %v", err)
+			}
+			newConfig.Hardlinks.CacheTTL = ttl
+		}
+		if newConfig.Arr != nil {
+			if newConfig.Arr.CacheTTLStr == "" {
+				newConfig.Arr.CacheTTLStr = "1m"
+			}
+			ttl, err := time.ParseDuration(newConfig.Arr.CacheTTLStr)
+			if err != nil {
+				return errors.Wrapf(ErrInvalidConfig, "Invalid arr.cache_ttl: %v", err)
+			}
+			newConfig.Arr.CacheTTL = ttl
+		}
+		if newConfig.LastSeeder != nil && newConfig.LastSeeder.MinSeeders <= 0 {
+			newConfig.LastSeeder.MinSeeders = 1
+		}
+		if newConfig.Schedules != nil {
+			if err := newConfig.Schedules.parse(); err != nil {
+				return errors.Wrapf(ErrInvalidConfig, "Invalid schedules: %v", err)
+			}
+		}
+		if newConfig.Slots != nil && newConfig.Slots.Enabled {
+			if newConfig.Slots.MaxActive <= 0 {
+				return errors.Wrapf(ErrInvalidConfig, "slots.max_active must be set")
+			}
+			if newConfig.Slots.IdleTimeStr == "" {
+				newConfig.Slots.IdleTimeStr = "30m"
+			}
+			idle, err := time.ParseDuration(newConfig.Slots.IdleTimeStr)
+			if err != nil {
+				return errors.Wrapf(ErrInvalidConfig, "Invalid slots.idle_time: %v", err)
+			}
+			newConfig.Slots.IdleTime = idle
+			if newConfig.Slots.ScrapeTTLStr == "" {
+				newConfig.Slots.ScrapeTTLStr = "30m"
+			}
+			ttl, err := time.ParseDuration(newConfig.Slots.ScrapeTTLStr)
+			if err != nil {
+				return errors.Wrapf(ErrInvalidConfig, "Invalid slots.scrape_ttl: %v", err)
+			}
+			newConfig.Slots.ScrapeTTL = ttl
+		}
+		if newConfig.Reconnect == nil {
+			newConfig.Reconnect = &reconnectConfig{}
+		}
+		if newConfig.Reconnect.MaxRetries == nil {
+			retries := 3
+			newConfig.Reconnect.MaxRetries = &retries
+		} else if *newConfig.Reconnect.MaxRetries < 0 {
+			return errors.Wrapf(ErrInvalidConfig, "reconnect.max_retries cannot be negative")
+		}
+		if newConfig.Reconnect.MinBackoffStr == "" {
+			newConfig.Reconnect.MinBackoffStr = "1s"
+		}
+		minBackoff, err := time.ParseDuration(newConfig.Reconnect.MinBackoffStr)
+		if err != nil {
+			return errors.Wrapf(ErrInvalidConfig, "Invalid reconnect.min_backoff: %v", err)
+		}
+		newConfig.Reconnect.MinBackoff = minBackoff
+		if newConfig.Reconnect.MaxBackoffStr == "" {
+			newConfig.Reconnect.MaxBackoffStr = "1m"
+		}
+		maxBackoff, err := time.ParseDuration(newConfig.Reconnect.MaxBackoffStr)
+		if err != nil {
+			return errors.Wrapf(ErrInvalidConfig, "Invalid reconnect.max_backoff: %v", err)
+		}
+		newConfig.Reconnect.MaxBackoff = maxBackoff
+		if newConfig.Client != nil {
+			if err := parseClientConfig("client", newConfig.Client); err != nil {
+				return err
+			}
+		}
+		for name, cc := range newConfig.Clients {
+			if err := parseClientConfig("clients."+name, cc); err != nil {
+				return err
+			}
+		}
+		if newConfig.General.StateDir == "" {
+			newConfig.General.StateDir = "~/.seedr"
+		}
+		stateDir, err := homedir.Expand(newConfig.General.StateDir)
+		if err != nil {
+			return errors.Wrapf(ErrInvalidConfig, "Invalid general.state_dir: %v", err)
+		}
+		newConfig.General.StateDir = stateDir
+		if newConfig.Backup != nil && newConfig.Backup.Enabled {
+			if newConfig.Backup.IntervalStr == "" {
+				newConfig.Backup.IntervalStr = "1h"
+			}
+			interval, err := time.ParseDuration(newConfig.Backup.IntervalStr)
+			if err != nil {
+				return errors.Wrapf(ErrInvalidConfig, "Invalid backup.interval: %v", err)
+			}
+			newConfig.Backup.Interval = interval
+		}
+		if newConfig.Backup != nil && newConfig.Backup.Path != "" {
+			p, err := homedir.Expand(newConfig.Backup.Path)
+			if err != nil {
+				return errors.Wrapf(ErrInvalidConfig, "Invalid backup.path: %v", err)
+			}
+			newConfig.Backup.Path = p
+		}
 		config = newConfig
 
 		setupLogger(config.Log.Level, config.Log.LogColour)
@@ -116,3 +400,20 @@ func checksByPriority() []*checkConfig {
 	})
 	return paths
 }
+
+// parseClientConfig sets the per call timeout of a client and loads its credentials, key is used in the
+// error message
+func parseClientConfig(key string, cfg *client.Config) error {
+	if err := cfg.LoadCredentials(); err != nil {
+		return errors.Wrapf(ErrInvalidConfig, "Invalid %s: %v", key, err)
+	}
+	if cfg.TimeoutStr == "" {
+		cfg.TimeoutStr = "30s"
+	}
+	timeout, err := time.ParseDuration(cfg.TimeoutStr)
+	if err != nil {
+		return errors.Wrapf(ErrInvalidConfig, "Invalid %s.timeout: %v", key, err)
+	}
+	cfg.Timeout = timeout
+	return nil
+}
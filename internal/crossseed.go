@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// crossSeedConfig controls detecting new torrents whose data is already on disk from another torrent
+type crossSeedConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// VerifyTimeoutStr is how long to wait for the client to finish checking an injected torrent
+	VerifyTimeoutStr string `mapstructure:"verify_timeout"`
+	VerifyTimeout    time.Duration
+}
+
+func crossSeedEnabled() bool {
+	return config.CrossSeed != nil && config.CrossSeed.Enabled
+}
+
+// matchesOnDisk returns true when every file of the metainfo exists under root with the same size
+func matchesOnDisk(info *metainfo.Info, root string) bool {
+	for _, f := range info.UpvertedFiles() {
+		p := filepath.Join(append([]string{root, info.Name}, f.Path...)...)
+		if !info.IsDir() {
+			p = filepath.Join(root, info.Name)
+		}
+		st, err := os.Stat(p)
+		if err != nil || st.IsDir() || st.Size() != f.Length {
+			return false
+		}
+	}
+	return true
+}
+
+// findCrossSeed searches the torrents of the main client for one whose payload matches the metainfo by file
+// names and sizes
+func findCrossSeed(info *metainfo.Info, torrents []*client.Torrent) *client.Torrent {
+	checked := map[string]bool{}
+	for _, t := range torrents {
+		if t.Path == "" || (t.Name != info.Name && t.Size != info.TotalLength()) {
+			continue
+		}
+		if checked[t.Path] {
+			continue
+		}
+		checked[t.Path] = true
+		if matchesOnDisk(info, t.Path) {
+			return t
+		}
+	}
+	return nil
+}
+
+// crossSeedMatch returns the torrent already seeding the payload of the new torrent, if any
+func crossSeedMatch(ctx context.Context, data []byte) (*client.Torrent, error) {
+	mi, err := metainfo.Load(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to decode metainfo")
+	}
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to decode metainfo info")
+	}
+	torrents, err := driver.Torrents(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get torrents")
+	}
+	for _, t := range torrents {
+		if strings.EqualFold(t.Hash, mi.HashInfoBytes().HexString()) {
+			return nil, errors.Errorf("Torrent already added")
+		}
+	}
+	return findCrossSeed(&info, torrents), nil
+}
+
+// verifyFinished returns true once the client is done checking a torrent added paused. A torrent
+// queued for checking or in an unknown state is still waiting, a paused one only counts once it was
+// seen checking or has data since the check may not have started yet.
+func verifyFinished(t *client.Torrent, checked bool) bool {
+	switch t.State {
+	case client.Seeding, client.Error:
+		return true
+	case client.Paused:
+		return checked || t.Progress > 0
+	default:
+		return false
+	}
+}
+
+// injectCrossSeed adds the torrent using the payload of match. It is added paused and checked first, only
+// starting once the client confirms all the data is present so the existing payload can never be
+// overwritten by a download.
+func injectCrossSeed(ctx context.Context, filename string, hash string, data []byte, label string, match *client.Torrent) error {
+	l := log.WithFields(log.Fields{"hash": hash, "path": match.Path, "match": match.Hash})
+	if dryRun() {
+		l.Infof("[DRY] Injected cross seed %s", filename)
+		return nil
+	}
+	if err := driver.Add(ctx, filename, bytes.NewReader(data), match.Path, label, client.AddOptions{Paused: true}); err != nil {
+		return errors.Wrapf(err, "Failed to add cross seed")
+	}
+	if err := driver.Verify(ctx, hash); err != nil {
+		return errors.Wrapf(err, "Failed to verify cross seed")
+	}
+	deadline := time.Now().Add(config.CrossSeed.VerifyTimeout)
+	var t client.Torrent
+	checked := false
+	for {
+		select {
+		case <-time.After(statePollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err := driver.Torrent(ctx, hash, &t); err != nil {
+			return errors.Wrapf(err, "Failed to get cross seed state")
+		}
+		checked = checked || t.State == client.Checking
+		if verifyFinished(&t, checked) {
+			break
+		}
+		if time.Now().After(deadline) {
+			notify("cross_seed_timeout", "Cross seed %s was not verified in time, left paused", filename)
+			return nil
+		}
+	}
+	if t.Progress < 1 {
+		notify("cross_seed_incomplete", "Cross seed %s only matched %.1f%% of the existing data, left paused",
+			filename, t.Progress*100)
+		return nil
+	}
+	if err := driver.Start(ctx, hash); err != nil {
+		return errors.Wrapf(err, "Failed to start cross seed")
+	}
+	l.Infof("Injected cross seed %s", filename)
+	return nil
+}
@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindCrossSeed(t *testing.T) {
+	root, err := ioutil.TempDir("", "seedr-xseed")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(root) }()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "Release", "sub"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "Release", "a.mkv"), make([]byte, 100), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "Release", "sub", "b.nfo"), make([]byte, 10), 0644))
+
+	info := &metainfo.Info{
+		Name: "Release",
+		Files: []metainfo.FileInfo{
+			{Length: 100, Path: []string{"a.mkv"}},
+			{Length: 10, Path: []string{"sub", "b.nfo"}},
+		},
+	}
+	existing := &client.Torrent{Hash: "aaa", Name: "Release", Path: root, Size: 110}
+	other := &client.Torrent{Hash: "bbb", Name: "Other", Path: root, Size: 5}
+	require.Equal(t, existing, findCrossSeed(info, []*client.Torrent{other, existing}))
+
+	info.Files[1].Length = 11
+	require.Nil(t, findCrossSeed(info, []*client.Torrent{other, existing}))
+
+	single := &metainfo.Info{Name: "a.mkv", Length: 100}
+	require.True(t, matchesOnDisk(single, filepath.Join(root, "Release")))
+}
+
+func TestVerifyFinished(t *testing.T) {
+	require.False(t, verifyFinished(&client.Torrent{State: client.Queued}, false), "Queued for checking")
+	require.False(t, verifyFinished(&client.Torrent{State: client.Unknown}, true))
+	require.False(t, verifyFinished(&client.Torrent{State: client.Checking, Progress: 0.5}, true))
+	require.False(t, verifyFinished(&client.Torrent{State: client.Paused}, false), "The check has not started")
+	require.True(t, verifyFinished(&client.Torrent{State: client.Paused}, true))
+	require.True(t, verifyFinished(&client.Torrent{State: client.Paused, Progress: 1}, false))
+	require.True(t, verifyFinished(&client.Torrent{State: client.Seeding, Progress: 1}, false))
+	require.True(t, verifyFinished(&client.Torrent{State: client.Error}, false))
+}
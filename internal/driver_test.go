@@ -0,0 +1,335 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// fakeDriver is an in memory client.Driver used to test the higher level logic without a client
+type fakeDriver struct {
+	torrents map[string]*client.Torrent
+	meta     map[string][]byte
+	free     map[string]int64
+	removed  map[string]bool
+	trackers map[string][]client.Tracker
+	session  client.SessionSettings
+	caps     client.Capabilities
+	// addErr is returned by Add when set
+	addErr error
+	// removeErr is returned by RemoveMany when set
+	removeErr error
+	// calls counts the calls made per method, only the bulk methods and Queue are counted
+	calls map[string]int
+	mu    *sync.Mutex
+}
+
+func newFakeDriver() *fakeDriver {
+	return &fakeDriver{
+		torrents: map[string]*client.Torrent{},
+		meta:     map[string][]byte{},
+		free:     map[string]int64{},
+		removed:  map[string]bool{},
+		trackers: map[string][]client.Tracker{},
+		calls:    map[string]int{},
+		caps:     client.NewCapabilities(client.AllCapabilities...),
+		mu:       &sync.Mutex{},
+	}
+}
+
+func (f *fakeDriver) add(t *client.Torrent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.torrents[t.Hash] = t
+}
+
+func (f *fakeDriver) Add(ctx context.Context, filename string, torrent io.Reader, path string, label string, opts client.AddOptions) error {
+	b, err := ioutil.ReadAll(torrent)
+	if err != nil {
+		return err
+	}
+	mi, err := metainfo.Load(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		return err
+	}
+	hash := mi.HashInfoBytes().HexString()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.addErr != nil {
+		return f.addErr
+	}
+	f.meta[hash] = b
+	state := client.Active
+	if opts.Paused {
+		state = client.Paused
+	}
+	f.torrents[hash] = &client.Torrent{Hash: hash, Name: info.Name, Path: path, Label: label,
+		Size: info.TotalLength(), State: state}
+	return nil
+}
+
+func (f *fakeDriver) Announce(context.Context, string) error        { return nil }
+func (f *fakeDriver) Capabilities() client.Capabilities             { return f.caps }
+func (f *fakeDriver) ClientVersion(context.Context) (string, error) { return "fake", nil }
+func (f *fakeDriver) Close() error                                  { return nil }
+func (f *fakeDriver) Login(context.Context) error                   { return nil }
+func (f *fakeDriver) PauseAll(context.Context) error                { return nil }
+func (f *fakeDriver) StartAll(context.Context) error                { return nil }
+
+func (f *fakeDriver) Queue(context.Context, string, client.QueuePos) error {
+	f.count("Queue")
+	return nil
+}
+
+func (f *fakeDriver) Peers(context.Context, string) ([]client.Peer, error) { return nil, nil }
+
+func (f *fakeDriver) SessionSettings(ctx context.Context) (*client.SessionSettings, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := f.session
+	return &s, nil
+}
+
+func (f *fakeDriver) SetSessionSettings(ctx context.Context, settings *client.SessionSettings) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if settings.UploadLimit != nil {
+		f.session.UploadLimit = settings.UploadLimit
+	}
+	if settings.DownloadLimit != nil {
+		f.session.DownloadLimit = settings.DownloadLimit
+	}
+	if settings.MaxActiveDownloads != nil {
+		f.session.MaxActiveDownloads = settings.MaxActiveDownloads
+	}
+	if settings.MaxActiveSeeding != nil {
+		f.session.MaxActiveSeeding = settings.MaxActiveSeeding
+	}
+	if settings.MaxConnections != nil {
+		f.session.MaxConnections = settings.MaxConnections
+	}
+	if settings.MaxConnectionsPerTorrent != nil {
+		f.session.MaxConnectionsPerTorrent = settings.MaxConnectionsPerTorrent
+	}
+	return nil
+}
+
+func (f *fakeDriver) SetLimits(ctx context.Context, hash string, _ int64, _ int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, found := f.torrents[hash]; !found {
+		return client.ErrUnknownTorrent
+	}
+	return nil
+}
+
+func (f *fakeDriver) Trackers(ctx context.Context, hash string) ([]client.Tracker, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.trackers[hash], nil
+}
+
+func (f *fakeDriver) Export(ctx context.Context, hash string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, found := f.meta[hash]
+	if !found {
+		return nil, client.ErrUnknownTorrent
+	}
+	return b, nil
+}
+
+func (f *fakeDriver) Files(ctx context.Context, hash string) ([]client.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, found := f.torrents[hash]
+	if !found {
+		return nil, client.ErrUnknownTorrent
+	}
+	return []client.File{{Path: t.Name, Size: t.Size, Progress: t.Progress, Priority: client.PriorityNormal}}, nil
+}
+
+func (f *fakeDriver) SetFilePriority(ctx context.Context, hash string, _ int, _ client.FilePriority) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, found := f.torrents[hash]; !found {
+		return client.ErrUnknownTorrent
+	}
+	return nil
+}
+
+func (f *fakeDriver) FreeSpace(ctx context.Context, path string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.free[path], nil
+}
+
+func (f *fakeDriver) setState(hash string, state client.State) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, found := f.torrents[hash]
+	if !found {
+		return client.ErrUnknownTorrent
+	}
+	t.State = state
+	return nil
+}
+
+func (f *fakeDriver) Move(ctx context.Context, hash string, dest string) error {
+	return f.SetLocation(ctx, hash, dest)
+}
+
+func (f *fakeDriver) SetLocation(ctx context.Context, hash string, dest string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, found := f.torrents[hash]
+	if !found {
+		return client.ErrUnknownTorrent
+	}
+	t.Path = dest
+	return nil
+}
+
+func (f *fakeDriver) MoveMany(ctx context.Context, hashes []string, dest string) error {
+	f.count("MoveMany")
+	for _, hash := range hashes {
+		if err := f.SetLocation(ctx, hash, dest); err != nil && err != client.ErrUnknownTorrent {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeDriver) count(method string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[method]++
+}
+
+func (f *fakeDriver) Pause(_ context.Context, hash string) error {
+	return f.setState(hash, client.Paused)
+}
+
+func (f *fakeDriver) PauseMany(_ context.Context, hashes []string) error {
+	f.count("PauseMany")
+	for _, hash := range hashes {
+		if err := f.setState(hash, client.Paused); err != nil && err != client.ErrUnknownTorrent {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeDriver) Start(_ context.Context, hash string) error {
+	return f.setState(hash, client.Seeding)
+}
+
+func (f *fakeDriver) Stop(_ context.Context, hash string) error {
+	return f.setState(hash, client.Paused)
+}
+
+func (f *fakeDriver) Verify(ctx context.Context, hash string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, found := f.torrents[hash]
+	if !found {
+		return client.ErrUnknownTorrent
+	}
+	t.Progress = 1
+	return nil
+}
+
+func (f *fakeDriver) Remove(ctx context.Context, hash string, deleteData bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, found := f.torrents[hash]; !found {
+		return client.ErrUnknownTorrent
+	}
+	delete(f.torrents, hash)
+	f.removed[hash] = deleteData
+	return nil
+}
+
+func (f *fakeDriver) RemoveMany(ctx context.Context, hashes []string, deleteData bool) error {
+	f.count("RemoveMany")
+	if f.removeErr != nil {
+		return f.removeErr
+	}
+	for _, hash := range hashes {
+		if err := f.Remove(ctx, hash, deleteData); err != nil && err != client.ErrUnknownTorrent {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeDriver) Torrent(ctx context.Context, hash string, torrent *client.Torrent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, found := f.torrents[hash]
+	if !found {
+		return client.ErrUnknownTorrent
+	}
+	*torrent = *t
+	return nil
+}
+
+func (f *fakeDriver) Torrents(ctx context.Context) ([]*client.Torrent, error) {
+	return f.TorrentsWithState(ctx)
+}
+
+func (f *fakeDriver) TorrentsWithState(ctx context.Context, statuses ...client.State) ([]*client.Torrent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var torrents []*client.Torrent
+	for _, t := range f.torrents {
+		match := len(statuses) == 0
+		for _, s := range statuses {
+			if t.State == s {
+				match = true
+			}
+		}
+		if match {
+			c := *t
+			torrents = append(torrents, &c)
+		}
+	}
+	return torrents, nil
+}
+
+func (f *fakeDriver) TorrentsByHash(ctx context.Context, hashes []string) (map[string]*client.Torrent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	torrents := map[string]*client.Torrent{}
+	for _, hash := range hashes {
+		if t, found := f.torrents[hash]; found {
+			c := *t
+			torrents[hash] = &c
+		}
+	}
+	return torrents, nil
+}
+
+// testMetaInfo builds a single file .torrent
+func testMetaInfo(name string, size int64) []byte {
+	info := metainfo.Info{Name: name, Length: size, PieceLength: 16384, Pieces: make([]byte, 20)}
+	b, err := bencode.Marshal(info)
+	if err != nil {
+		panic(err)
+	}
+	mi := metainfo.MetaInfo{InfoBytes: b}
+	var buf bytes.Buffer
+	if err := mi.Write(&buf); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
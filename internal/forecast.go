@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"context"
+	"github.com/dustin/go-humanize"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+var (
+	forecasts   = map[string]*pathForecast{}
+	samples     = map[string][]freeSample{}
+	forecastMu  = &sync.RWMutex{}
+	forecastVar = map[string]*jsonVar{}
+	// forecastAlerted tracks the paths we have already sent a shortfall notification for
+	forecastAlerted = map[string]bool{}
+)
+
+type freeSample struct {
+	t    time.Time
+	free int64
+}
+
+// pathForecast is the predicted free space trend for a tier
+type pathForecast struct {
+	Path string `json:"path"`
+	Free int64  `json:"free"`
+	// Rate is the rate free space is being consumed in bytes/sec
+	Rate float64 `json:"rate"`
+	// Pending is the amount still to be downloaded by torrents in the tier
+	Pending int64 `json:"pending"`
+	// Until is how long until free space drops below min_free, -1 when it is not expected to
+	Until time.Duration `json:"until"`
+	// Shortfall is set when the pending downloads alone will take us below min_free
+	Shortfall bool `json:"shortfall"`
+}
+
+func forecastEnabled() bool {
+	return config.Forecast != nil && config.Forecast.Enabled
+}
+
+// consumptionRate returns the rate free space is dropping, in bytes/sec, using a least squares fit
+// over the samples. Growing free space results in a rate of 0.
+func consumptionRate(s []freeSample) float64 {
+	if len(s) < 2 {
+		return 0
+	}
+	var sumX, sumY, sumXY, sumXX float64
+	n := float64(len(s))
+	for _, p := range s {
+		x := p.t.Sub(s[0].t).Seconds()
+		y := float64(p.free)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	denom := n*sumXX - sumX*sumX
+	if denom == 0 {
+		return 0
+	}
+	slope := (n*sumXY - sumX*sumY) / denom
+	if slope >= 0 {
+		return 0
+	}
+	return -slope
+}
+
+// predict builds the forecast for a tier from its current free space, consumption rate and the
+// amount of data still to be downloaded into it
+func predict(cfg *checkConfig, free int64, rate float64, pending int64) *pathForecast {
+	f := &pathForecast{Path: cfg.Path, Free: free, Rate: rate, Pending: pending, Until: -1}
+	headroom := free - cfg.MinFree
+	if headroom <= 0 {
+		f.Until = 0
+		f.Shortfall = pending > 0
+		return f
+	}
+	f.Shortfall = pending >= headroom
+	if rate > 0 {
+		f.Until = time.Duration(float64(headroom) / rate * float64(time.Second))
+	}
+	return f
+}
+
+// sampleForecast records the current free space of each tier and updates its forecast
+func sampleForecast(ctx context.Context) {
+	if !forecastEnabled() {
+		return
+	}
+	downloading, err := driver.TorrentsWithState(ctx, client.Downloading)
+	if err != nil {
+		log.Errorf("Failed to get downloading torrents for forecast: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, cfg := range config.Checks.Paths {
+		free, err := freeSpace(ctx, cfg.Path)
+		if err != nil {
+			log.Errorf("Failed to get free space for forecast: %v", err)
+			continue
+		}
+		pending := pendingBytes(downloading, cfg)
+		var speed int64
+		for _, t := range torrentsInTier(downloading, cfg) {
+			speed += t.SpeedDN
+		}
+		forecastMu.Lock()
+		s := append(samples[cfg.Path], freeSample{t: now, free: free})
+		for len(s) > 0 && now.Sub(s[0].t) > config.Forecast.Window {
+			s = s[1:]
+		}
+		samples[cfg.Path] = s
+		rate := consumptionRate(s)
+		if float64(speed) > rate {
+			rate = float64(speed)
+		}
+		f := predict(cfg, free, rate, pending)
+		forecasts[cfg.Path] = f
+		forecastMu.Unlock()
+		publishForecast(f)
+	}
+}
+
+// upcoming returns true when the forecast predicts crossing min_free within the horizon
+func (f *pathForecast) upcoming() bool {
+	return f.Shortfall || (f.Until >= 0 && f.Until <= config.Forecast.Horizon)
+}
+
+func publishForecast(f *pathForecast) {
+	v, found := forecastVar[f.Path]
+	if !found {
+		v = newJSONVar(f)
+		forecastVar[f.Path] = v
+		metricsForecast.Set(f.Path, v)
+	}
+	v.Set(f)
+	l := log.WithFields(log.Fields{
+		"path":    f.Path,
+		"free":    humanize.Bytes(uint64(f.Free)),
+		"rate":    humanize.Bytes(uint64(f.Rate)) + "/s",
+		"pending": humanize.Bytes(uint64(f.Pending)),
+	})
+	if !f.upcoming() {
+		if forecastAlerted[f.Path] {
+			l.Infof("Forecast shortfall cleared")
+		}
+		forecastAlerted[f.Path] = false
+		l.Debugf("Forecast ok")
+		return
+	}
+	if !forecastAlerted[f.Path] {
+		forecastAlerted[f.Path] = true
+		l.Warnf("Forecast min_free shortfall in %s", formatUntil(f))
+		notify("forecast_shortfall", "%s is forecast to drop below min_free in %s (%s free, %s/s, %s pending)",
+			f.Path, formatUntil(f), humanize.Bytes(uint64(f.Free)), humanize.Bytes(uint64(f.Rate)),
+			humanize.Bytes(uint64(f.Pending)))
+		return
+	}
+	l.Debugf("Forecast min_free shortfall in %s", formatUntil(f))
+}
+
+func formatUntil(f *pathForecast) string {
+	if f.Until < 0 {
+		return "unknown time"
+	}
+	return f.Until.Round(time.Minute).String()
+}
+
+// checkForecast proactively moves torrents to the next tier when the forecast predicts the tier will
+// drop below min_free within the horizon. It never deletes, the min_free check is still responsible
+// for that once the threshold is actually crossed.
+func checkForecast(ctx context.Context, b *actionBatch, torrents []*client.Torrent, cfg *checkConfig, pathCurrent int, pathTotal int) error {
+	if !forecastEnabled() || pathCurrent == pathTotal-1 {
+		return nil
+	}
+	forecastMu.RLock()
+	f, found := forecasts[cfg.Path]
+	forecastMu.RUnlock()
+	if !found || !f.upcoming() {
+		return nil
+	}
+	expected := f.Pending
+	if byRate := int64(f.Rate * config.Forecast.Horizon.Seconds()); byRate > expected {
+		expected = byRate
+	}
+	target := cfg.MinFree + expected
+	projected := f.Free + scheduledBytesFrom(cfg.Path)
+	if projected >= target {
+		return nil
+	}
+	sortAge(torrents)
+	sortReclaimable(torrents)
+	if err := checkTierLimit(cfg, countUntilFree(torrents, projected, target), len(torrents)); err != nil {
+		tripSafety(err)
+		return err
+	}
+	dest := config.Checks.Paths[pathCurrent+1].Path
+	for _, t := range torrents {
+		if projected >= target {
+			break
+		}
+		if dryRun() {
+			t.Log().Infof("[DRY] Moved torrent to next storage tier (forecast)")
+		} else if moveQueueEnabled() {
+			scheduleMove(t, dest, false)
+		} else {
+			if err := b.move(ctx, t, dest, "forecast"); err != nil {
+				t.Log().Errorf("Failed to move torrent to next tier: %v", err)
+				continue
+			}
+		}
+		projected += freedBy(t)
+	}
+	if projected < target {
+		log.WithField("path", cfg.Path).Warnf("Not enough torrents to cover forecast shortfall")
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestForecast(t *testing.T) {
+	now := time.Now()
+	var s []freeSample
+	for i := 0; i < 5; i++ {
+		s = append(s, freeSample{t: now.Add(time.Duration(i) * time.Minute), free: 10000 - int64(i)*600})
+	}
+	require.InDelta(t, 10, consumptionRate(s), 0.001)
+	require.Equal(t, float64(0), consumptionRate(s[:1]))
+	require.Equal(t, float64(0), consumptionRate([]freeSample{{t: now, free: 10}, {t: now.Add(time.Minute), free: 20}}))
+
+	cfg := &checkConfig{Path: "/data", MinFree: 1000}
+	f := predict(cfg, 7600, 10, 0)
+	require.Equal(t, 660*time.Second, f.Until)
+	require.False(t, f.Shortfall)
+
+	f = predict(cfg, 7600, 0, 7000)
+	require.Equal(t, time.Duration(-1), f.Until)
+	require.True(t, f.Shortfall)
+
+	f = predict(cfg, 500, 0, 0)
+	require.Equal(t, time.Duration(0), f.Until)
+}
+
+func TestPublishForecast(t *testing.T) {
+	prev := config
+	defer func() { config = prev }()
+	config = &configuration{Forecast: &forecastConfig{Enabled: true, Horizon: time.Hour}}
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(log.LevelHooks{})
+	warnings := func() int {
+		n := 0
+		for _, e := range hook.AllEntries() {
+			if e.Level == log.WarnLevel {
+				n++
+			}
+		}
+		hook.Reset()
+		return n
+	}
+	short := &pathForecast{Path: "/forecast-test", Until: time.Minute}
+	publishForecast(short)
+	require.Equal(t, 2, warnings(), "The shortfall is logged and notified once")
+	publishForecast(short)
+	require.Equal(t, 0, warnings(), "An ongoing shortfall is not logged again")
+	publishForecast(&pathForecast{Path: "/forecast-test", Until: -1})
+	publishForecast(short)
+	require.Equal(t, 2, warnings())
+}
+
+func TestCheckOrder(t *testing.T) {
+	prev := config
+	defer func() { config = prev }()
+	config = &configuration{}
+	config.Checks = &struct {
+		Order []CheckOrder   `mapstructure:"order"`
+		Paths []*checkConfig `mapstructure:"paths"`
+	}{}
+	require.Equal(t, []CheckOrder{MinFree, MaxRatio}, checkOrder())
+	config.Checks.Order = []CheckOrder{Forecast, MinFree}
+	require.Equal(t, []CheckOrder{Forecast, MinFree}, checkOrder())
+}
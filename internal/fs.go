@@ -1,7 +1,9 @@
 package internal
 
 import (
+	"encoding/json"
 	"github.com/shirou/gopsutil/v3/disk"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -26,3 +28,32 @@ func isSubPath(parent string, path string) (bool, error) {
 	}
 	return false, nil
 }
+
+// readState loads a JSON state file from the state dir into v. A missing file is not an error
+// and leaves v untouched.
+func readState(name string, v interface{}) error {
+	b, err := ioutil.ReadFile(filepath.Join(config.General.StateDir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// writeState atomically writes v as JSON into the state dir
+func writeState(name string, v interface{}) error {
+	if err := os.MkdirAll(config.General.StateDir, 0755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	p := filepath.Join(config.General.StateDir, name)
+	if err := ioutil.WriteFile(p+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package internal
+
+import "os"
+
+// fileInode is not supported on windows, every file is treated as having a single link
+func fileInode(_ os.FileInfo) (uint64, uint64, uint64, bool) {
+	return 0, 0, 0, false
+}
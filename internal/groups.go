@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// torrentGroup is a set of torrents whose payloads overlap on disk, cross seeds for example. A group
+// is always moved and removed as a single unit.
+type torrentGroup []*client.Torrent
+
+// dataPath returns the on disk location of the torrents payload
+func dataPath(t *client.Torrent) string {
+	if t.Path == "" || t.Name == "" {
+		return ""
+	}
+	return filepath.Clean(filepath.Join(t.Path, t.Name))
+}
+
+// groupKey is used to sort data paths so that every path nested inside another directly follows it
+func groupKey(p string) string {
+	return strings.ReplaceAll(p, string(os.PathSeparator), "\x00")
+}
+
+// groupTorrents splits the torrents into groups of overlapping payloads. Torrents without a known
+// location are each their own group.
+func groupTorrents(torrents []*client.Torrent) []torrentGroup {
+	var groups []torrentGroup
+	var located []*client.Torrent
+	for _, t := range torrents {
+		if dataPath(t) == "" {
+			groups = append(groups, torrentGroup{t})
+			continue
+		}
+		located = append(located, t)
+	}
+	sort.SliceStable(located, func(i, j int) bool {
+		return groupKey(dataPath(located[i])) < groupKey(dataPath(located[j]))
+	})
+	var cur torrentGroup
+	root := ""
+	for _, t := range located {
+		p := dataPath(t)
+		if cur != nil && (p == root || strings.HasPrefix(p, root+string(os.PathSeparator))) {
+			cur = append(cur, t)
+			continue
+		}
+		if cur != nil {
+			groups = append(groups, cur)
+		}
+		cur = torrentGroup{t}
+		root = p
+	}
+	if cur != nil {
+		groups = append(groups, cur)
+	}
+	return groups
+}
+
+// groupOf returns the group t belongs to using the current state of all torrents
+func groupOf(t *client.Torrent, all []*client.Torrent) torrentGroup {
+	for _, g := range groupTorrents(all) {
+		for _, m := range g {
+			if m.Hash == t.Hash {
+				return g
+			}
+		}
+	}
+	return torrentGroup{t}
+}
+
+// root returns the member owning the outermost payload, its data contains every other members data.
+// Members with the same payload are told apart by hash so the same root is chosen whatever the order.
+func (g torrentGroup) root() *client.Torrent {
+	root := g[0]
+	for _, t := range g[1:] {
+		if len(dataPath(t)) < len(dataPath(root)) || (dataPath(t) == dataPath(root) &&
+			(t.Size > root.Size || (t.Size == root.Size && t.Hash < root.Hash))) {
+			root = t
+		}
+	}
+	return root
+}
+
+// size is the space freed by removing or moving the whole group. Members share data so this is
+// the size of the outermost payload, not the sum of every member.
+func (g torrentGroup) size() int64 {
+	return g.root().Size
+}
+
+// unit returns a single torrent standing in for the group in the triggers. It takes the identity of
+// the root, the size of the group, the most recent added time and the lowest ratio so that the
+// group is only acted on once every member qualifies.
+func (g torrentGroup) unit() *client.Torrent {
+	if len(g) == 1 {
+		return g[0]
+	}
+	u := *g.root()
+	u.Size = g.size()
+	for _, t := range g {
+		if t.AddedOn.After(u.AddedOn) {
+			u.AddedOn = t.AddedOn
+		}
+		if t.Ratio < u.Ratio {
+			u.Ratio = t.Ratio
+		}
+	}
+	return &u
+}
+
+// groupUnits collapses the torrents into one unit per group
+func groupUnits(torrents []*client.Torrent) []*client.Torrent {
+	var units []*client.Torrent
+	for _, g := range groupTorrents(torrents) {
+		units = append(units, g.unit())
+	}
+	return units
+}
+
+// relocate returns the location of a member after the root has been moved to dest
+func (g torrentGroup) relocate(t *client.Torrent, dest string) (string, error) {
+	rel, err := filepath.Rel(g.root().Path, t.Path)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to resolve group member location")
+	}
+	return filepath.Join(dest, rel), nil
+}
@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestGroupTorrents(t *testing.T) {
+	now := time.Now()
+	pack := &client.Torrent{Hash: "pack", Name: "Show.S01", Path: "/data", Size: 1000, Ratio: 3, AddedOn: now.Add(-time.Hour)}
+	xseed := &client.Torrent{Hash: "xseed", Name: "Show.S01", Path: "/data/", Size: 1000, Ratio: 1, AddedOn: now.Add(-time.Minute)}
+	episode := &client.Torrent{Hash: "ep", Name: "Show.S01E01.mkv", Path: "/data/Show.S01", Size: 100, Ratio: 2}
+	similar := &client.Torrent{Hash: "similar", Name: "Show.S01 Extras", Path: "/data", Size: 50}
+	unknown := &client.Torrent{Hash: "unknown", Name: "x", Size: 10}
+
+	groups := groupTorrents([]*client.Torrent{episode, similar, unknown, xseed, pack})
+	require.Len(t, groups, 3)
+	var grouped torrentGroup
+	for _, g := range groups {
+		if len(g) > 1 {
+			grouped = g
+		}
+	}
+	require.Len(t, grouped, 3)
+	require.Equal(t, int64(1000), grouped.size())
+	require.Equal(t, "pack", grouped.root().Hash)
+	require.Equal(t, "pack", torrentGroup{xseed, episode, pack}.root().Hash, "The root does not depend on the order")
+
+	u := grouped.unit()
+	require.Equal(t, float64(1), u.Ratio)
+	require.Equal(t, now.Add(-time.Minute), u.AddedOn)
+	require.Equal(t, int64(1000), u.Size)
+
+	loc, err := grouped.relocate(episode, "/archive")
+	require.NoError(t, err)
+	require.Equal(t, "/archive/Show.S01", loc)
+
+	require.Len(t, groupUnits([]*client.Torrent{episode, similar, unknown, xseed, pack}), 3)
+	require.Equal(t, torrentGroup{unknown}, groupOf(unknown, []*client.Torrent{pack, unknown}))
+}
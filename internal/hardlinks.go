@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	reclaimCache   = map[string]*reclaimInfo{}
+	reclaimCacheMu = &sync.Mutex{}
+)
+
+// hardlinksConfig enables checking payloads for hardlinks, eg: into a media library, so that free
+// space estimates only count data that is actually released when a torrent is moved or removed
+type hardlinksConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// CacheTTLStr is how long a payload scan is reused before the files are checked again
+	CacheTTLStr string `mapstructure:"cache_ttl"`
+	CacheTTL    time.Duration
+}
+
+// reclaimInfo describes how much of a payload is released when it is deleted
+type reclaimInfo struct {
+	// Reclaimable is the size of the files with no links outside of the payload
+	Reclaimable int64
+	// Hardlinked is the count of files that also have links outside of the payload
+	Hardlinked int
+	scanned    time.Time
+}
+
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+func hardlinksEnabled() bool {
+	return config.Hardlinks != nil && config.Hardlinks.Enabled
+}
+
+// scanReclaimable walks the payload counting the links found to each inode. An inode only frees
+// space when every one of its links is inside the payload.
+func scanReclaimable(root string) (*reclaimInfo, error) {
+	type inode struct {
+		size  int64
+		nlink uint64
+		seen  uint64
+	}
+	inodes := map[inodeKey]*inode{}
+	info := &reclaimInfo{scanned: time.Now()}
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		dev, ino, nlink, ok := fileInode(fi)
+		if !ok {
+			info.Reclaimable += fi.Size()
+			return nil
+		}
+		key := inodeKey{dev: dev, ino: ino}
+		if n, found := inodes[key]; found {
+			n.seen++
+			return nil
+		}
+		inodes[key] = &inode{size: fi.Size(), nlink: nlink, seen: 1}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range inodes {
+		if n.seen >= n.nlink {
+			info.Reclaimable += n.size
+		} else {
+			info.Hardlinked++
+		}
+	}
+	return info, nil
+}
+
+// torrentReclaim returns the cached reclaim info for the torrents payload
+func torrentReclaim(t *client.Torrent) (*reclaimInfo, error) {
+	p := dataPath(t)
+	reclaimCacheMu.Lock()
+	cached, found := reclaimCache[p]
+	reclaimCacheMu.Unlock()
+	ttl := time.Minute * 10
+	if config.Hardlinks != nil && config.Hardlinks.CacheTTL > 0 {
+		ttl = config.Hardlinks.CacheTTL
+	}
+	if found && time.Since(cached.scanned) < ttl {
+		return cached, nil
+	}
+	info, err := scanReclaimable(p)
+	if err != nil {
+		return nil, err
+	}
+	reclaimCacheMu.Lock()
+	reclaimCache[p] = info
+	reclaimCacheMu.Unlock()
+	return info, nil
+}
+
+// freedBy returns the space expected to be released on the tier when the torrent is moved off it
+// or removed
+func freedBy(t *client.Torrent) int64 {
+	if !hardlinksEnabled() || dataPath(t) == "" {
+		return t.Size
+	}
+	info, err := torrentReclaim(t)
+	if err != nil {
+		t.Log().Debugf("Could not scan payload for hardlinks: %v", err)
+		return t.Size
+	}
+	return info.Reclaimable
+}
+
+// sortReclaimable moves the torrents that free no space behind those that do, keeping the
+// existing order otherwise
+func sortReclaimable(torrents []*client.Torrent) {
+	freed := make(map[string]bool, len(torrents))
+	for _, t := range torrents {
+		freed[t.Hash] = freedBy(t) > 0
+	}
+	sort.SliceStable(torrents, func(i, j int) bool {
+		return freed[torrents[i].Hash] && !freed[torrents[j].Hash]
+	})
+}
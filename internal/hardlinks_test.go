@@ -0,0 +1,34 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestScanReclaimable(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Hardlinks are not detected on windows")
+	}
+	root, err := ioutil.TempDir("", "seedr-links")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(root) }()
+	payload := filepath.Join(root, "payload")
+	library := filepath.Join(root, "library")
+	require.NoError(t, os.MkdirAll(payload, 0755))
+	require.NoError(t, os.MkdirAll(library, 0755))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(payload, "linked.mkv"), make([]byte, 100), 0644))
+	require.NoError(t, os.Link(filepath.Join(payload, "linked.mkv"), filepath.Join(library, "linked.mkv")))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(payload, "plain.nfo"), make([]byte, 10), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(payload, "a.bin"), make([]byte, 20), 0644))
+	require.NoError(t, os.Link(filepath.Join(payload, "a.bin"), filepath.Join(payload, "b.bin")))
+
+	info, err := scanReclaimable(payload)
+	require.NoError(t, err)
+	require.Equal(t, int64(30), info.Reclaimable)
+	require.Equal(t, 1, info.Hardlinked)
+}
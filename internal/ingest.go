@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/dustin/go-humanize"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// parseMetaInfo decodes a .torrent and returns its info hash and total payload size
+func parseMetaInfo(data []byte) (string, int64, error) {
+	mi, err := metainfo.Load(bytes.NewReader(data))
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "Failed to decode metainfo")
+	}
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "Failed to decode metainfo info")
+	}
+	return mi.HashInfoBytes().HexString(), info.TotalLength(), nil
+}
+
+// addTorrent adds a .torrent to the client on the tier chosen by admission control. All
+// ingestion paths must add torrents through here.
+func addTorrent(ctx context.Context, filename string, data []byte, label string) error {
+	hash, size, err := parseMetaInfo(data)
+	if err != nil {
+		return err
+	}
+	if crossSeedEnabled() {
+		match, err := crossSeedMatch(ctx, data)
+		if err != nil {
+			return err
+		}
+		if match != nil {
+			return injectCrossSeed(ctx, filename, hash, data, label, match)
+		}
+	}
+	cfg, err := admit(ctx, filename, size)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot add %s (%s)", filename, humanize.Bytes(uint64(size)))
+	}
+	l := log.WithFields(log.Fields{"hash": hash, "path": cfg.Path, "label": label})
+	if dryRun() {
+		l.Infof("[DRY] Added torrent %s", filename)
+		return nil
+	}
+	if err := driver.Add(ctx, filename, bytes.NewReader(data), cfg.Path, label, client.AddOptions{}); err != nil {
+		return errors.Wrapf(err, "Failed to add torrent %s", filename)
+	}
+	l.Infof("Added torrent %s (%s)", filename, humanize.Bytes(uint64(size)))
+	return nil
+}
+
+// AddFiles adds the .torrent files to the client through admission control
+func AddFiles(ctx context.Context, files []string, label string) error {
+	cl, err := newDriver(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := cl.Close(); err != nil {
+			log.Errorf("Failed to close connection: %v", err)
+		}
+	}()
+	driver = cl
+	if label != "" && !driver.Capabilities().Has(client.CapLabels) {
+		return errors.Wrapf(ErrMissingCapability, "Client does not support labels")
+	}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to read torrent file")
+		}
+		if err := addTorrent(ctx, filepath.Base(f), data, label); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	"github.com/shirou/gopsutil/v3/disk"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const limitsStateFile = "limits.json"
+
+var (
+	ErrLimitReached       = errors.New("Safety limit reached")
+	ErrImplausibleReading = errors.New("Implausible disk reading")
+	safety                = &safetyState{}
+)
+
+// safetyState tracks the destructive actions taken so the configured circuit breakers can be enforced.
+// The daily counters are persisted so restarting seedr does not reset them.
+type safetyState struct {
+	Day           string `json:"day"`
+	Deletions     int    `json:"deletions"`
+	BytesDeleted  int64  `json:"bytes_deleted"`
+	tickDeletions int
+	// pendingDeletions and pendingBytes are removals waiting on the batch, they count against the
+	// limits until the batch is flushed
+	pendingDeletions int
+	pendingBytes     int64
+	// tripped is read by every worker through dryRun
+	trippedMu sync.RWMutex
+	tripped   bool
+}
+
+// dryRun returns true when actions are only logged, because dry_run_mode is set or the safety tripped
+func dryRun() bool {
+	return config.General.DryRunMode || safety.isTripped()
+}
+
+func (s *safetyState) isTripped() bool {
+	s.trippedMu.RLock()
+	defer s.trippedMu.RUnlock()
+	return s.tripped
+}
+
+// trip marks the safety as tripped, returning false if it already was
+func (s *safetyState) trip() bool {
+	s.trippedMu.Lock()
+	defer s.trippedMu.Unlock()
+	if s.tripped {
+		return false
+	}
+	s.tripped = true
+	return true
+}
+
+func loadSafetyState() {
+	if err := readState(limitsStateFile, safety); err != nil {
+		log.Warnf("Failed to read limits state: %v", err)
+	}
+}
+
+func (s *safetyState) rollover() {
+	today := time.Now().Format("2006-01-02")
+	if s.Day != today {
+		s.Day = today
+		s.Deletions = 0
+		s.BytesDeleted = 0
+	}
+}
+
+// beginTick resets the per tick counters, it should be called before each check run
+func (s *safetyState) beginTick() {
+	s.tickDeletions = 0
+}
+
+// allowDelete returns an error if removing a torrent of the given size would exceed any of the limits
+func (s *safetyState) allowDelete(size int64) error {
+	if config.Limits == nil {
+		return nil
+	}
+	s.rollover()
+	l := config.Limits
+	if l.MaxDeletionsPerTick > 0 && s.tickDeletions+s.pendingDeletions+1 > l.MaxDeletionsPerTick {
+		return errors.Wrapf(ErrLimitReached, "max_deletions_per_tick (%d)", l.MaxDeletionsPerTick)
+	}
+	if l.MaxDeletionsPerDay > 0 && s.Deletions+s.pendingDeletions+1 > l.MaxDeletionsPerDay {
+		return errors.Wrapf(ErrLimitReached, "max_deletions_per_day (%d)", l.MaxDeletionsPerDay)
+	}
+	if l.MaxBytesPerDay > 0 && s.BytesDeleted+s.pendingBytes+size > l.MaxBytesPerDay {
+		return errors.Wrapf(ErrLimitReached, "max_bytes_deleted_per_day (%s)", humanize.Bytes(uint64(l.MaxBytesPerDay)))
+	}
+	return nil
+}
+
+// reserveDelete counts a removal waiting on the batch against the limits until it is released
+func (s *safetyState) reserveDelete(size int64) {
+	s.pendingDeletions++
+	s.pendingBytes += size
+}
+
+// releaseDelete drops a reserved removal once the batch is flushed, recording it when it was applied
+func (s *safetyState) releaseDelete(size int64, applied bool) {
+	s.pendingDeletions--
+	s.pendingBytes -= size
+	if applied {
+		s.recordDelete(size)
+	}
+}
+
+func (s *safetyState) recordDelete(size int64) {
+	s.rollover()
+	s.tickDeletions++
+	s.Deletions++
+	s.BytesDeleted += size
+	if err := writeState(limitsStateFile, s); err != nil {
+		log.Errorf("Failed to write limits state: %v", err)
+	}
+}
+
+// checkTierLimit makes sure a single check does not act on more than the allowed share of a tier
+func checkTierLimit(cfg *checkConfig, affected int, total int) error {
+	if config.Limits == nil || config.Limits.MaxTierPct <= 0 || total == 0 {
+		return nil
+	}
+	pct := float64(affected) / float64(total) * 100
+	if pct > config.Limits.MaxTierPct {
+		return errors.Wrapf(ErrLimitReached, "%d/%d (%.1f%%) torrents of %s affected, max_tier_pct is %.1f%%",
+			affected, total, pct, cfg.Path, config.Limits.MaxTierPct)
+	}
+	return nil
+}
+
+// checkFreePlausible rejects free space readings that cannot be right, such as a zero value from
+// a misconfigured path or more free space than the disk can hold.
+func checkFreePlausible(path string, bytesFree int64) error {
+	if bytesFree <= 0 {
+		return errors.Wrapf(ErrImplausibleReading, "%s reported %d bytes free", path, bytesFree)
+	}
+	use, err := disk.Usage(path)
+	if err == nil && use.Total > 0 && uint64(bytesFree) > use.Total {
+		return errors.Wrapf(ErrImplausibleReading, "%s reported %s free on a %s disk", path,
+			humanize.Bytes(uint64(bytesFree)), humanize.Bytes(use.Total))
+	}
+	return nil
+}
+
+// tripSafety switches seedr into dry run mode and sends an alert. Dry run stays enabled until seedr is
+// restarted so the cause can be investigated.
+func tripSafety(reason error) {
+	if !safety.trip() {
+		return
+	}
+	notify("safety_tripped", "Safety limit tripped, switching to dry run mode: %v", reason)
+}
+
+// guardRemove is called before any deletion, tripping the safety if removing the group is not allowed
+func guardRemove(group torrentGroup) error {
+	if err := safety.allowDelete(group.size()); err != nil {
+		tripSafety(err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"context"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSafetyLimits(t *testing.T) {
+	prev := config
+	defer func() { config = prev }()
+	config = &configuration{}
+	config.Limits = &limitsConfig{MaxDeletionsPerTick: 2, MaxDeletionsPerDay: 3, MaxBytesPerDay: 1000, MaxTierPct: 50}
+	s := &safetyState{}
+	s.rollover()
+	s.beginTick()
+	require.NoError(t, s.allowDelete(100))
+	s.tickDeletions, s.Deletions, s.BytesDeleted = 1, 1, 100
+	require.NoError(t, s.allowDelete(100))
+	require.Error(t, s.allowDelete(901), "byte limit")
+	s.tickDeletions = 2
+	require.Error(t, s.allowDelete(1), "tick limit")
+	s.beginTick()
+	s.Deletions = 3
+	require.Error(t, s.allowDelete(1), "day limit")
+
+	cfg := &checkConfig{Path: "/tier"}
+	require.NoError(t, checkTierLimit(cfg, 5, 10))
+	require.Error(t, checkTierLimit(cfg, 6, 10))
+	require.Error(t, checkFreePlausible("/", 0))
+	require.Error(t, checkFreePlausible("/", 1<<62))
+	require.NoError(t, checkFreePlausible("/", 1))
+
+	torrents := []*client.Torrent{{Size: 10}, {Size: 10}, {Size: 10}}
+	require.Equal(t, 2, countUntilFree(torrents, 5, 20))
+	require.Equal(t, 0, countUntilFree(torrents, 25, 20))
+	require.Equal(t, 1, countUntilFree([]*client.Torrent{{Size: 10}, {Size: 0}}, 5, 20))
+}
+
+func TestTripSafety(t *testing.T) {
+	prevConfig, prevSafety := config, safety
+	defer func() { config, safety = prevConfig, prevSafety }()
+	config = &configuration{General: &generalConfig{}}
+	safety = &safetyState{}
+	require.False(t, dryRun())
+	done := make(chan bool)
+	go func() { done <- dryRun() }()
+	tripSafety(ErrLimitReached)
+	<-done
+	require.True(t, dryRun())
+	require.False(t, config.General.DryRunMode, "The configuration is left untouched")
+}
+
+func TestCheckMinFreeReclaimable(t *testing.T) {
+	ctx := context.Background()
+	stateDir, err := ioutil.TempDir("", "seedr-minfree")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(stateDir) }()
+	prevConfig, prevDriver := config, driver
+	defer func() { config, driver = prevConfig, prevDriver }()
+	config = &configuration{General: &generalConfig{StateDir: stateDir}}
+	fd := newFakeDriver()
+	driver = fd
+	a := &client.Torrent{Hash: "aaa", Name: "a", Path: "/data", Size: 100, Progress: 1}
+	empty := &client.Torrent{Hash: "bbb", Name: "b", Path: "/data", Progress: 1}
+	c := &client.Torrent{Hash: "ccc", Name: "c", Path: "/data", Size: 100, Progress: 1}
+	for _, tor := range []*client.Torrent{a, empty, c} {
+		fd.add(tor)
+	}
+	tier := &checkConfig{Path: "/data", MinFree: 1000}
+	fd.free["/data"] = 1
+	require.NoError(t, checkMinFree(ctx, newActionBatch(), []*client.Torrent{a, empty, c}, tier, 0, 1))
+	require.Contains(t, fd.removed, "aaa")
+	require.Contains(t, fd.removed, "ccc")
+	require.NotContains(t, fd.removed, "bbb", "Removing it would not free any space")
+}
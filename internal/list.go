@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// List prints all torrents in the client along with how many of their files are hardlinked
+// outside of the payload
+func List(ctx context.Context) error {
+	cl, err := newDriver(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := cl.Close(); err != nil {
+			log.Errorf("Failed to close connection: %v", err)
+		}
+	}()
+	torrents, err := cl.Torrents(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Slice(torrents, func(i, j int) bool {
+		return strings.ToLower(torrents[i].Name) < strings.ToLower(torrents[j].Name)
+	})
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HASH\tNAME\tSTATE\tRATIO\tSIZE\tHARDLINKED\tPATH")
+	for _, t := range torrents {
+		linked := "-"
+		if dataPath(t) != "" {
+			if info, err := torrentReclaim(t); err == nil {
+				linked = fmt.Sprintf("%d", info.Hardlinked)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%.2f\t%s\t%s\t%s\n", t.Hash, t.Name, t.State, t.Ratio,
+			humanize.Bytes(uint64(t.Size)), linked, t.Path)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"encoding/json"
+	"expvar"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+)
+
+var (
+	// metricsForecast holds the latest forecast for each tier path
+	metricsForecast = expvar.NewMap("forecast")
+)
+
+func init() {
+	// The connection health of the main client
+	expvar.Publish("client", expvar.Func(clientHealth))
+}
+
+// jsonVar exposes an arbitrary value as an expvar.Var
+type jsonVar struct {
+	mu *sync.RWMutex
+	v  interface{}
+}
+
+func newJSONVar(v interface{}) *jsonVar {
+	return &jsonVar{mu: &sync.RWMutex{}, v: v}
+}
+
+func (j *jsonVar) Set(v interface{}) {
+	j.mu.Lock()
+	j.v = v
+	j.mu.Unlock()
+}
+
+func (j *jsonVar) String() string {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	b, err := json.Marshal(j.v)
+	if err != nil {
+		return "null"
+	}
+	return string(b)
+}
+
+// startMetrics serves the expvar metrics on /metrics when a listen address is configured
+func startMetrics() {
+	if config.Metrics == nil || config.Metrics.ListenAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", expvar.Handler())
+	go func() {
+		log.Infof("Serving metrics on http://%s/metrics", config.Metrics.ListenAddr)
+		if err := http.ListenAndServe(config.Metrics.ListenAddr, mux); err != nil {
+			log.Errorf("Metrics server failed: %v", err)
+		}
+	}()
+}
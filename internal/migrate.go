@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"github.com/dustin/go-humanize"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const migrateStateFile = "migrate.json"
+
+type migrateStage string
+
+const (
+	migrateAdded    migrateStage = "added"
+	migrateVerified migrateStage = "verified"
+	migrateDone     migrateStage = "done"
+)
+
+// migrateEntry is the progress of a single torrent
+type migrateEntry struct {
+	Stage migrateStage `json:"stage"`
+	// WasPaused is the state of the torrent in the source before the migration paused it
+	WasPaused bool `json:"was_paused"`
+}
+
+// migrateState is persisted after every step so an interrupted migration continues where it
+// stopped. It is keyed by "<from>:<to>" and then by hash.
+type migrateState map[string]map[string]*migrateEntry
+
+// clientConfig returns the named client from the clients section, the main client config is also
+// available under its driver name
+func clientConfig(name string) (*client.Config, error) {
+	if cfg, found := config.Clients[name]; found {
+		return cfg, nil
+	}
+	if config.Client != nil && config.Client.Driver == name {
+		return config.Client, nil
+	}
+	return nil, errors.Wrapf(ErrInvalidConfig, "Unknown client: %s", name)
+}
+
+// Migrate moves every torrent from one client to another. Each torrent is exported from the source,
+// added paused to the destination at the same location with the same label and verified before it
+// is removed from the source without its data.
+func Migrate(ctx context.Context, from string, to string, verifyTimeout time.Duration) error {
+	fromCfg, err := clientConfig(from)
+	if err != nil {
+		return err
+	}
+	toCfg, err := clientConfig(to)
+	if err != nil {
+		return err
+	}
+	src, err := newDriverFor(ctx, fromCfg)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to connect to source")
+	}
+	defer func() {
+		if err := src.Close(); err != nil {
+			log.Errorf("Failed to close source connection: %v", err)
+		}
+	}()
+	dst, err := newDriverFor(ctx, toCfg)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to connect to destination")
+	}
+	defer func() {
+		if err := dst.Close(); err != nil {
+			log.Errorf("Failed to close destination connection: %v", err)
+		}
+	}()
+	// The source is only removed once the destination has verified the data
+	if !dst.Capabilities().Has(client.CapVerify) {
+		return errors.Wrapf(ErrMissingCapability, "%s cannot verify migrated torrents", to)
+	}
+	if !dst.Capabilities().Has(client.CapLabels) {
+		log.Warnf("%s does not support labels, migrated torrents lose their label", to)
+	}
+	state := migrateState{}
+	if err := readState(migrateStateFile, &state); err != nil {
+		return errors.Wrapf(err, "Failed to read migration state")
+	}
+	key := from + ":" + to
+	if state[key] == nil {
+		state[key] = map[string]*migrateEntry{}
+	}
+	progress := state[key]
+	save := func() {
+		if err := writeState(migrateStateFile, state); err != nil {
+			log.Errorf("Failed to save migration state: %v", err)
+		}
+	}
+	torrents, err := src.Torrents(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to get source torrents")
+	}
+	var failed int
+	for i, t := range torrents {
+		l := t.Log().WithField("progress", formatProgress(i+1, len(torrents)))
+		if e, found := progress[t.Hash]; found && e.Stage == migrateDone {
+			l.Debugf("Already migrated")
+			continue
+		}
+		if dryRun() {
+			l.Infof("[DRY] Migrated torrent to %s (%s)", to, humanize.Bytes(uint64(t.Size)))
+			continue
+		}
+		if err := migrateTorrent(ctx, src, dst, t, progress, save, verifyTimeout); err != nil {
+			l.Errorf("Failed to migrate torrent: %v", err)
+			failed++
+			continue
+		}
+		l.Infof("Migrated torrent to %s", to)
+	}
+	if failed > 0 {
+		return errors.Errorf("%d torrents failed to migrate, run again to retry", failed)
+	}
+	log.Infof("Migrated %d torrents from %s to %s", len(torrents), from, to)
+	return nil
+}
+
+func formatProgress(cur int, total int) string {
+	return humanize.Comma(int64(cur)) + "/" + humanize.Comma(int64(total))
+}
+
+func migrateTorrent(ctx context.Context, src client.Driver, dst client.Driver, t *client.Torrent, progress map[string]*migrateEntry,
+	save func(), verifyTimeout time.Duration) error {
+	entry, found := progress[t.Hash]
+	if !found {
+		entry = &migrateEntry{WasPaused: t.State == client.Paused}
+		progress[t.Hash] = entry
+	}
+	if t.State != client.Paused {
+		// Never have both clients writing to the same data
+		if err := src.Pause(ctx, t.Hash); err != nil {
+			return errors.Wrapf(err, "Failed to pause source torrent")
+		}
+	}
+	defer func() {
+		// Keep seeding from the source until the destination has been verified
+		if entry.Stage != migrateVerified && entry.Stage != migrateDone && !entry.WasPaused {
+			if err := src.Start(ctx, t.Hash); err != nil {
+				t.Log().Errorf("Failed to resume source torrent: %v", err)
+			}
+		}
+	}()
+	if entry.Stage == "" {
+		var existing client.Torrent
+		if err := dst.Torrent(ctx, t.Hash, &existing); err != nil {
+			meta, err := src.Export(ctx, t.Hash)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to export metainfo")
+			}
+			// Added paused so the destination cannot start writing to the payload before it is verified
+			if err := dst.Add(ctx, t.Hash+".torrent", bytes.NewReader(meta), t.Path, t.Label, client.AddOptions{Paused: true}); err != nil {
+				return errors.Wrapf(err, "Failed to add to destination")
+			}
+		} else if err := dst.Pause(ctx, t.Hash); err != nil {
+			return errors.Wrapf(err, "Failed to pause destination torrent")
+		}
+		entry.Stage = migrateAdded
+		save()
+	}
+	if entry.Stage == migrateAdded {
+		if err := dst.Verify(ctx, t.Hash); err != nil {
+			return errors.Wrapf(err, "Failed to verify destination torrent")
+		}
+		var current client.Torrent
+		checked := false
+		deadline := time.Now().Add(verifyTimeout)
+		for {
+			select {
+			case <-time.After(statePollInterval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if err := dst.Torrent(ctx, t.Hash, &current); err != nil {
+				return errors.Wrapf(err, "Failed to get destination torrent state")
+			}
+			checked = checked || current.State == client.Checking
+			if verifyFinished(&current, checked) {
+				break
+			}
+			if time.Now().After(deadline) {
+				return errors.Errorf("Timed out waiting for verification")
+			}
+		}
+		if current.Progress < 1 {
+			return errors.Wrapf(ErrVerifyFailed, "Destination has %.1f%% of the data", current.Progress*100)
+		}
+		entry.Stage = migrateVerified
+		save()
+	}
+	if err := src.Remove(ctx, t.Hash, false); err != nil {
+		return errors.Wrapf(err, "Failed to remove source torrent")
+	}
+	if !entry.WasPaused {
+		if err := dst.Start(ctx, t.Hash); err != nil {
+			return errors.Wrapf(err, "Failed to start destination torrent")
+		}
+	}
+	entry.Stage = migrateDone
+	save()
+	return nil
+}
@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestMigrateTorrent(t *testing.T) {
+	ctx := context.Background()
+	prevInterval := statePollInterval
+	defer func() { statePollInterval = prevInterval }()
+	statePollInterval = time.Millisecond
+	src := newFakeDriver()
+	dst := newFakeDriver()
+	meta := testMetaInfo("file.bin", 1000)
+	require.NoError(t, src.Add(ctx, "file.torrent", bytes.NewReader(meta), "/data", "tv", client.AddOptions{}))
+	torrents, err := src.Torrents(ctx)
+	require.NoError(t, err)
+	require.Len(t, torrents, 1)
+	hash := torrents[0].Hash
+
+	progress := map[string]*migrateEntry{}
+	saves := 0
+	require.NoError(t, migrateTorrent(ctx, src, dst, torrents[0], progress, func() { saves++ }, time.Minute))
+	require.Equal(t, migrateDone, progress[hash].Stage)
+	require.Equal(t, 3, saves)
+
+	var migrated client.Torrent
+	require.NoError(t, dst.Torrent(ctx, hash, &migrated))
+	require.Equal(t, "/data", migrated.Path)
+	require.Equal(t, "tv", migrated.Label)
+	require.Equal(t, client.Seeding, migrated.State)
+	require.False(t, src.removed[hash], "source data must be kept")
+	require.Error(t, src.Torrent(ctx, hash, &migrated))
+}
@@ -0,0 +1,289 @@
+package internal
+
+import (
+	"context"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	"github.com/shirou/gopsutil/v3/disk"
+	log "github.com/sirupsen/logrus"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	moves = &moveQueue{
+		active: map[string]*queuedMove{},
+		usage:  map[string]int{},
+		mu:     &sync.Mutex{},
+	}
+	// moveBudget is the shared byte rate budget for all seedr side moves, nil when unlimited
+	moveBudget *rateLimiter
+	// moveQueueStarted is only set when running as the daemon, one off commands move directly
+	moveQueueStarted bool
+)
+
+// queuedMove is a pending tier move waiting on a free device slot or a move window
+type queuedMove struct {
+	torrent   *client.Torrent
+	dest      string
+	srcDev    string
+	destDev   string
+	emergency bool
+	queued    time.Time
+}
+
+// moveQueue schedules tier moves so that only a limited number of moves read from or write to the
+// same device at once, and non urgent moves only happen inside the configured windows.
+type moveQueue struct {
+	pending []*queuedMove
+	active  map[string]*queuedMove
+	usage   map[string]int
+	mu      *sync.Mutex
+	// ctx outlives the check that queued a move, it is cancelled on shutdown
+	ctx context.Context
+}
+
+// moveWindow is a time of day range in local time, end may be before start to wrap past midnight
+type moveWindow struct {
+	Start string `mapstructure:"start"`
+	End   string `mapstructure:"end"`
+	start time.Duration
+	end   time.Duration
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w *moveWindow) parse() error {
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid window start")
+	}
+	end, err := parseClock(w.End)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid window end")
+	}
+	w.start, w.end = start, end
+	return nil
+}
+
+func (w *moveWindow) contains(t time.Time) bool {
+	tod := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.start <= w.end {
+		return tod >= w.start && tod < w.end
+	}
+	return tod >= w.start || tod < w.end
+}
+
+func moveQueueEnabled() bool {
+	return config.MoveQueue != nil && config.MoveQueue.Enabled
+}
+
+// moveQueueRunning returns true when moves can be handed off to the queue worker
+func moveQueueRunning() bool {
+	return moveQueueEnabled() && moveQueueStarted
+}
+
+// inMoveWindow returns true when non urgent moves are currently allowed
+func inMoveWindow(now time.Time) bool {
+	if len(config.MoveQueue.Windows) == 0 {
+		return true
+	}
+	for _, w := range config.MoveQueue.Windows {
+		if w.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceOf returns the mount point that holds path, this is used as the device key for
+// concurrency limits
+func deviceOf(path string) string {
+	partitions, err := disk.Partitions(true)
+	if err != nil {
+		return path
+	}
+	best := ""
+	for _, p := range partitions {
+		if ok, err := isSubPath(p.Mountpoint, path); err == nil && ok && len(p.Mountpoint) > len(best) {
+			best = p.Mountpoint
+		}
+	}
+	if best == "" {
+		return filepath.Clean(path)
+	}
+	return best
+}
+
+// scheduleMove queues a tier move. Emergency moves, made to relieve a min_free condition, ignore the
+// move windows and go to the front of the queue.
+func scheduleMove(t *client.Torrent, dest string, emergency bool) {
+	moves.mu.Lock()
+	defer moves.mu.Unlock()
+	if _, found := moves.active[t.Hash]; found {
+		return
+	}
+	for _, m := range moves.pending {
+		if m.torrent.Hash == t.Hash {
+			m.emergency = m.emergency || emergency
+			return
+		}
+	}
+	moves.pending = append(moves.pending, &queuedMove{
+		torrent:   t,
+		dest:      dest,
+		srcDev:    deviceOf(t.Path),
+		destDev:   deviceOf(dest),
+		emergency: emergency,
+		queued:    time.Now(),
+	})
+	t.Log().WithField("dest", dest).Infof("Queued move to next storage tier")
+	moves.dispatch()
+}
+
+// isMoveScheduled returns true if the torrent is queued or currently moving
+func isMoveScheduled(hash string) bool {
+	moves.mu.Lock()
+	defer moves.mu.Unlock()
+	if _, found := moves.active[hash]; found {
+		return true
+	}
+	for _, m := range moves.pending {
+		if m.torrent.Hash == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduledBytesFrom returns the total size of queued and active moves out of the path
+func scheduledBytesFrom(path string) int64 {
+	moves.mu.Lock()
+	defer moves.mu.Unlock()
+	var total int64
+	count := func(m *queuedMove) {
+		if ok, err := isSubPath(path, m.torrent.Path); err == nil && ok {
+			total += m.torrent.Size
+		}
+	}
+	for _, m := range moves.active {
+		count(m)
+	}
+	for _, m := range moves.pending {
+		count(m)
+	}
+	return total
+}
+
+func (q *moveQueue) slotsFree(m *queuedMove) bool {
+	cfg := config.MoveQueue
+	if cfg.SourceConcurrency > 0 && q.usage["src:"+m.srcDev] >= cfg.SourceConcurrency {
+		return false
+	}
+	if cfg.DestConcurrency > 0 && q.usage["dest:"+m.destDev] >= cfg.DestConcurrency {
+		return false
+	}
+	return true
+}
+
+// dispatch starts every pending move that currently fits, the caller must hold the lock
+func (q *moveQueue) dispatch() {
+	sort.SliceStable(q.pending, func(i, j int) bool {
+		return q.pending[i].emergency && !q.pending[j].emergency
+	})
+	windowOpen := inMoveWindow(time.Now())
+	var remaining []*queuedMove
+	for _, m := range q.pending {
+		if (!m.emergency && !windowOpen) || !q.slotsFree(m) {
+			remaining = append(remaining, m)
+			continue
+		}
+		q.active[m.torrent.Hash] = m
+		q.usage["src:"+m.srcDev]++
+		q.usage["dest:"+m.destDev]++
+		go q.run(q.ctx, m)
+	}
+	q.pending = remaining
+}
+
+func (q *moveQueue) run(ctx context.Context, m *queuedMove) {
+	l := m.torrent.Log().WithField("dest", m.dest)
+	if err := performMove(ctx, m); err != nil {
+		l.Errorf("Failed to move torrent to next tier: %v", err)
+	} else {
+		l.Infof("Moved torrent to next storage tier (queued %s)", time.Since(m.queued).Round(time.Second))
+	}
+	q.mu.Lock()
+	delete(q.active, m.torrent.Hash)
+	q.usage["src:"+m.srcDev]--
+	q.usage["dest:"+m.destDev]--
+	q.dispatch()
+	q.mu.Unlock()
+}
+
+// performMove executes the move and only returns once the client has finished moving the data so
+// the device slot is held for the duration of the IO.
+func performMove(ctx context.Context, m *queuedMove) error {
+	var current client.Torrent
+	if err := driver.Torrent(ctx, m.torrent.Hash, &current); err != nil {
+		return errors.Wrapf(err, "Torrent no longer available")
+	}
+	if current.Path != "" && !strings.EqualFold(filepath.Clean(current.Path), filepath.Clean(m.torrent.Path)) {
+		return errors.Errorf("Torrent location changed since it was queued")
+	}
+	if current.Path != "" {
+		m.torrent.Path = current.Path
+	}
+	m.torrent.State = current.State
+	if err := moveTorrent(ctx, m.torrent, m.dest); err != nil {
+		return err
+	}
+	if moverEnabled() {
+		return nil
+	}
+	return waitMoveComplete(ctx, m.torrent.Hash)
+}
+
+// moveQueueWorker periodically re-dispatches the queue so moves held back by a window start once
+// it opens.
+func moveQueueWorker(ctx context.Context) {
+	t0 := time.NewTicker(time.Minute)
+	defer t0.Stop()
+	for {
+		select {
+		case <-t0.C:
+			moves.mu.Lock()
+			if len(moves.pending) > 0 {
+				moves.dispatch()
+			}
+			moves.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func startMoveQueue(ctx context.Context) {
+	if !moveQueueEnabled() {
+		return
+	}
+	moveBudget = newRateLimiter(config.MoveQueue.RateLimit)
+	if config.MoveQueue.RateLimit > 0 && !moverEnabled() {
+		log.Warnf("move_queue.rate_limit only applies to the seedr mover, moves done by the client are not limited")
+	}
+	moves.mu.Lock()
+	moves.ctx = ctx
+	moves.mu.Unlock()
+	moveQueueStarted = true
+	log.Debugf("Move queue enabled")
+	go moveQueueWorker(ctx)
+}
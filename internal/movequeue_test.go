@@ -0,0 +1,29 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestMoveWindow(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse("15:04", s)
+		require.NoError(t, err)
+		return v
+	}
+	w := &moveWindow{Start: "02:00", End: "08:00"}
+	require.NoError(t, w.parse())
+	require.True(t, w.contains(at("02:00")))
+	require.True(t, w.contains(at("07:59")))
+	require.False(t, w.contains(at("08:00")))
+	require.False(t, w.contains(at("23:00")))
+
+	wrap := &moveWindow{Start: "22:00", End: "06:00"}
+	require.NoError(t, wrap.parse())
+	require.True(t, wrap.contains(at("23:30")))
+	require.True(t, wrap.contains(at("01:00")))
+	require.False(t, wrap.contains(at("12:00")))
+
+	require.Error(t, (&moveWindow{Start: "25:00", End: "06:00"}).parse())
+}
@@ -0,0 +1,466 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/leighmacdonald/golib"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const moverStateFile = "mover.json"
+
+type moveStage int
+
+const (
+	// stageCopy copies and verifies the payload at the destination, the torrent is paused
+	stageCopy moveStage = iota
+	// stageSwitch hides the source, points the client at the destination and resumes the torrent
+	stageSwitch
+	// stageCleanup removes the hidden source payload
+	stageCleanup
+)
+
+var (
+	ErrVerifyFailed = errors.New("Payload verification failed")
+	ErrDestExists   = errors.New("Destination payload already exists")
+	moveJobs        = map[string]*moveJob{}
+	moveJobsMu      = &sync.Mutex{}
+)
+
+// moveJob is the journal entry for a single seedr side move, it is persisted after each stage so an
+// interrupted move can be resumed on the next start.
+type moveJob struct {
+	Hash      string    `json:"hash"`
+	Name      string    `json:"name"`
+	Src       string    `json:"src"`
+	Dest      string    `json:"dest"`
+	WasPaused bool      `json:"was_paused"`
+	Stage     moveStage `json:"stage"`
+	Started   time.Time `json:"started"`
+}
+
+func (j *moveJob) srcPayload() string {
+	return filepath.Join(j.Src, j.Name)
+}
+
+func (j *moveJob) destPayload() string {
+	return filepath.Join(j.Dest, j.Name)
+}
+
+// hiddenPayload is where the source is renamed to before the client is repointed so that clients
+// which move existing data on a location change have nothing to move.
+func (j *moveJob) hiddenPayload() string {
+	return filepath.Join(j.Src, ".seedr-moving."+strings.ToLower(j.Hash))
+}
+
+func (j *moveJob) log() *log.Entry {
+	return log.WithFields(log.Fields{"name": j.Name, "hash": j.Hash, "dest": j.Dest})
+}
+
+func moverEnabled() bool {
+	return config.Mover != nil && config.Mover.Enabled
+}
+
+func saveMoveJobs() {
+	moveJobsMu.Lock()
+	defer moveJobsMu.Unlock()
+	if err := writeState(moverStateFile, moveJobs); err != nil {
+		log.Errorf("Failed to write mover journal: %v", err)
+	}
+}
+
+func setMoveJob(job *moveJob) {
+	moveJobsMu.Lock()
+	moveJobs[job.Hash] = job
+	moveJobsMu.Unlock()
+	saveMoveJobs()
+}
+
+func deleteMoveJob(job *moveJob) {
+	moveJobsMu.Lock()
+	delete(moveJobs, job.Hash)
+	moveJobsMu.Unlock()
+	saveMoveJobs()
+}
+
+// hasMoveJob returns true while the mover has a journal entry for the torrent
+func hasMoveJob(hash string) bool {
+	moveJobsMu.Lock()
+	defer moveJobsMu.Unlock()
+	_, found := moveJobs[hash]
+	return found
+}
+
+// resumeMoves completes any moves left in the journal by a previous run
+func resumeMoves(ctx context.Context) {
+	moveJobsMu.Lock()
+	if err := readState(moverStateFile, &moveJobs); err != nil {
+		log.Errorf("Failed to read mover journal: %v", err)
+	}
+	var jobs []*moveJob
+	for _, job := range moveJobs {
+		jobs = append(jobs, job)
+	}
+	moveJobsMu.Unlock()
+	for _, job := range jobs {
+		job.log().Infof("Resuming interrupted move")
+		if err := runMoveJob(ctx, job); err != nil {
+			job.log().Errorf("Failed to resume move: %v", err)
+		}
+	}
+}
+
+// localMove moves the torrent payload to dest with seedr doing the copying rather than the client
+func localMove(ctx context.Context, t *client.Torrent, dest string) error {
+	if t.Path == "" || t.Name == "" {
+		return errors.Errorf("Cannot move torrent without a known path")
+	}
+	if !driver.Capabilities().Has(client.CapSetLocation) {
+		return errors.Wrapf(ErrMissingCapability, "The client cannot set a location without moving data")
+	}
+	moveJobsMu.Lock()
+	existing, found := moveJobs[t.Hash]
+	moveJobsMu.Unlock()
+	if found {
+		if existing.Dest != dest {
+			return errors.Errorf("Torrent is already being moved to %s", existing.Dest)
+		}
+		existing.log().Infof("Resuming interrupted move")
+		return runMoveJob(ctx, existing)
+	}
+	job := &moveJob{
+		Hash:      t.Hash,
+		Name:      t.Name,
+		Src:       t.Path,
+		Dest:      dest,
+		WasPaused: t.State == client.Paused,
+		Stage:     stageCopy,
+		Started:   time.Now(),
+	}
+	// Without a journal entry anything at the destination is not ours, resuming the copy into it
+	// could merge two different payloads
+	if golib.Exists(job.destPayload()) {
+		return errors.Wrapf(ErrDestExists, "%s", job.destPayload())
+	}
+	setMoveJob(job)
+	return runMoveJob(ctx, job)
+}
+
+func runMoveJob(ctx context.Context, job *moveJob) error {
+	if job.Stage == stageCopy {
+		if err := driver.Pause(ctx, job.Hash); err != nil {
+			return errors.Wrapf(err, "Failed to pause torrent")
+		}
+		if err := copyPayload(ctx, job.srcPayload(), job.destPayload(), moveLimiters()...); err != nil {
+			if ctx.Err() != nil {
+				// Shutting down, the journal and partial copy are kept so the move resumes on the next start
+				return errors.Wrapf(err, "Move interrupted")
+			}
+			return abortMoveJob(ctx, job, errors.Wrapf(err, "Failed to copy payload"))
+		}
+		if err := verifyPayload(ctx, job); err != nil {
+			if ctx.Err() != nil {
+				return errors.Wrapf(err, "Move interrupted")
+			}
+			if errRm := os.RemoveAll(job.destPayload()); errRm != nil {
+				job.log().Errorf("Failed to remove unverified copy: %v", errRm)
+			}
+			return abortMoveJob(ctx, job, err)
+		}
+		job.Stage = stageSwitch
+		setMoveJob(job)
+	}
+	if job.Stage == stageSwitch {
+		if golib.Exists(job.srcPayload()) {
+			if err := os.Rename(job.srcPayload(), job.hiddenPayload()); err != nil {
+				return errors.Wrapf(err, "Failed to hide source payload")
+			}
+		}
+		if err := driver.SetLocation(ctx, job.Hash, job.Dest); err != nil {
+			if ctx.Err() != nil {
+				return errors.Wrapf(err, "Move interrupted")
+			}
+			// The client still points at the source, put the payload back so it keeps seeding from there
+			if golib.Exists(job.hiddenPayload()) && !golib.Exists(job.srcPayload()) {
+				if errMv := os.Rename(job.hiddenPayload(), job.srcPayload()); errMv != nil {
+					job.log().Errorf("Failed to restore hidden source payload: %v", errMv)
+					return errors.Wrapf(err, "Failed to set new torrent location")
+				}
+			}
+			if errRm := os.RemoveAll(job.destPayload()); errRm != nil {
+				job.log().Errorf("Failed to remove copied payload: %v", errRm)
+			}
+			return abortMoveJob(ctx, job, errors.Wrapf(err, "Failed to set new torrent location"))
+		}
+		if !job.WasPaused {
+			if err := driver.Start(ctx, job.Hash); err != nil {
+				job.log().Errorf("Failed to resume torrent after move: %v", err)
+			}
+		}
+		job.Stage = stageCleanup
+		setMoveJob(job)
+	}
+	if err := os.RemoveAll(job.hiddenPayload()); err != nil {
+		return errors.Wrapf(err, "Failed to remove source payload")
+	}
+	deleteMoveJob(job)
+	job.log().Infof("Moved torrent payload (%s)", time.Since(job.Started).Round(time.Second))
+	return nil
+}
+
+// abortMoveJob drops a move that did not get past the switch stage, leaving the torrent at the source
+func abortMoveJob(ctx context.Context, job *moveJob, reason error) error {
+	if !job.WasPaused {
+		if err := driver.Start(ctx, job.Hash); err != nil {
+			job.log().Errorf("Failed to resume torrent: %v", err)
+		}
+	}
+	deleteMoveJob(job)
+	return reason
+}
+
+// copyPayload copies a file or directory tree. Files already present at the destination are resumed
+// from their current size so an interrupted copy does not start over, verification catches any
+// resulting corruption. The copy stops part way through the current file once ctx is cancelled.
+func copyPayload(ctx context.Context, src string, dest string, limiters ...*rateLimiter) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return copyFile(ctx, path, target, info, limiters...)
+	})
+}
+
+func copyFile(ctx context.Context, src string, dest string, info os.FileInfo, limiters ...*rateLimiter) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	var offset int64
+	if st, err := os.Stat(dest); err == nil && st.Size() <= info.Size() {
+		offset = st.Size()
+	}
+	if offset == info.Size() {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := in.Close(); err != nil {
+			log.Errorf("Failed to close source file: %v", err)
+		}
+	}()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := out.Truncate(offset); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if _, err := in.Seek(offset, io.SeekStart); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if _, err := io.Copy(out, newRateLimitedReader(ctx, in, limiters...)); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dest, info.ModTime(), info.ModTime())
+}
+
+func moverRateLimit() int64 {
+	if config.Mover == nil {
+		return 0
+	}
+	return config.Mover.RateLimit
+}
+
+// moveLimiters returns the per move limiter along with the shared move queue budget
+func moveLimiters() []*rateLimiter {
+	return []*rateLimiter{newRateLimiter(moverRateLimit()), moveBudget}
+}
+
+// verifyPayload checks the destination against the source sizes, then against the piece hashes
+// from the torrents metainfo.
+func verifyPayload(ctx context.Context, job *moveJob) error {
+	err := filepath.Walk(job.srcPayload(), func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(job.srcPayload(), path)
+		if err != nil {
+			return err
+		}
+		st, err := os.Stat(filepath.Join(job.destPayload(), rel))
+		if err != nil {
+			return errors.Wrapf(ErrVerifyFailed, "Missing file %s: %v", rel, err)
+		}
+		if st.Size() != info.Size() {
+			return errors.Wrapf(ErrVerifyFailed, "Size mismatch for %s", rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if config.Mover.SkipHashCheck {
+		return nil
+	}
+	meta, err := driver.Export(ctx, job.Hash)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to export metainfo for hash check")
+	}
+	mi, err := metainfo.Load(bytes.NewReader(meta))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to parse metainfo")
+	}
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		return errors.Wrapf(err, "Failed to parse info dict")
+	}
+	return verifyPieces(&info, job.destPayload())
+}
+
+// verifyPieces hashes the payload at root piece by piece and compares against info
+func verifyPieces(info *metainfo.Info, root string) error {
+	var readers []io.Reader
+	for _, fi := range info.UpvertedFiles() {
+		p := root
+		if info.IsDir() {
+			p = filepath.Join(append([]string{root}, fi.Path...)...)
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return errors.Wrapf(ErrVerifyFailed, "Failed to open %s: %v", p, err)
+		}
+		defer func(f *os.File) {
+			if err := f.Close(); err != nil {
+				log.Errorf("Failed to close file: %v", err)
+			}
+		}(f)
+		readers = append(readers, io.LimitReader(f, fi.Length))
+	}
+	r := io.MultiReader(readers...)
+	h := sha1.New()
+	for i := 0; i < info.NumPieces(); i++ {
+		piece := info.Piece(i)
+		h.Reset()
+		n, err := io.CopyN(h, r, piece.Length())
+		if err != nil || n != piece.Length() {
+			return errors.Wrapf(ErrVerifyFailed, "Short read on piece %d: %v", i, err)
+		}
+		expected := piece.Hash()
+		if !bytes.Equal(h.Sum(nil), expected[:]) {
+			return errors.Wrapf(ErrVerifyFailed, "Hash mismatch on piece %d", i)
+		}
+	}
+	return nil
+}
+
+// rateLimiter hands out a byte budget per second, it may be shared between several readers to
+// limit their combined throughput
+type rateLimiter struct {
+	rate int64
+	next time.Time
+	mu   *sync.Mutex
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate, mu: &sync.Mutex{}}
+}
+
+// wait blocks until n bytes may be transferred, returning early with the error of ctx when it is done
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	l.mu.Unlock()
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimitedReader limits the throughput of the wrapped reader to that of all of its limiters. Reads
+// fail once ctx is done so a copy stops promptly on shutdown, with or without limiters.
+type rateLimitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*rateLimiter
+}
+
+func newRateLimitedReader(ctx context.Context, r io.Reader, limiters ...*rateLimiter) io.Reader {
+	var active []*rateLimiter
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+	return &rateLimitedReader{ctx: ctx, r: r, limiters: active}
+}
+
+func (l *rateLimitedReader) Read(p []byte) (int, error) {
+	if err := l.ctx.Err(); err != nil {
+		return 0, err
+	}
+	// Keep reads small so the limit is applied smoothly
+	if len(p) > 64*1024 {
+		p = p[:64*1024]
+	}
+	n, err := l.r.Read(p)
+	for _, limiter := range l.limiters {
+		if errWait := limiter.wait(l.ctx, n); errWait != nil {
+			// The bytes already read are still returned so they are written before the copy stops
+			return n, errWait
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCopyAndVerifyPayload(t *testing.T) {
+	root, err := ioutil.TempDir("", "seedr-mover")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(root) }()
+	src := filepath.Join(root, "src", "payload")
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "sub"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "a.bin"), bytes.Repeat([]byte("a"), 40000), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "sub", "b.bin"), bytes.Repeat([]byte("b"), 30000), 0644))
+	info := metainfo.Info{PieceLength: 16 * 1024}
+	require.NoError(t, info.BuildFromFilePath(src))
+
+	dest := filepath.Join(root, "dest", "payload")
+	// Simulate an interrupted copy
+	require.NoError(t, os.MkdirAll(dest, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dest, "a.bin"), bytes.Repeat([]byte("a"), 1000), 0644))
+	require.NoError(t, copyPayload(context.Background(), src, dest))
+	require.NoError(t, verifyPieces(&info, dest))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dest, "sub", "b.bin"), bytes.Repeat([]byte("c"), 30000), 0644))
+	require.Error(t, verifyPieces(&info, dest))
+}
+
+func TestCopyPayloadCancel(t *testing.T) {
+	root, err := ioutil.TempDir("", "seedr-mover-cancel")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(root) }()
+	src, dest := filepath.Join(root, "src"), filepath.Join(root, "dest")
+	require.NoError(t, os.MkdirAll(src, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "a.bin"), make([]byte, 1024*1024), 0644))
+
+	// The copy would take 16 seconds at the limit
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*200, cancel)
+	start := time.Now()
+	err = copyPayload(ctx, src, dest, newRateLimiter(64*1024))
+	require.True(t, errors.Is(err, context.Canceled), "Unexpected error: %v", err)
+	require.Less(t, int64(time.Since(start)), int64(time.Second*2), "The copy should stop part way through the file")
+	st, err := os.Stat(filepath.Join(dest, "a.bin"))
+	require.NoError(t, err)
+	require.Less(t, st.Size(), int64(1024*1024))
+
+	// The partial copy is resumed
+	require.NoError(t, copyPayload(context.Background(), src, dest))
+	st, err = os.Stat(filepath.Join(dest, "a.bin"))
+	require.NoError(t, err)
+	require.Equal(t, int64(1024*1024), st.Size())
+}
+
+func TestLocalMove(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "seedr-localmove")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(root) }()
+	prevConfig, prevDriver := config, driver
+	defer func() { config, driver = prevConfig, prevDriver }()
+	config = &configuration{
+		General: &generalConfig{StateDir: filepath.Join(root, "state")},
+		Mover:   &moverConfig{Enabled: true, SkipHashCheck: true},
+	}
+	fd := newFakeDriver()
+	driver = fd
+	src, dest := filepath.Join(root, "ssd"), filepath.Join(root, "hdd")
+	for _, name := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(src, name), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(src, name, "f.bin"), make([]byte, 100), 0644))
+		fd.add(&client.Torrent{Hash: name, Name: name, Path: src, Size: 100, State: client.Seeding})
+	}
+
+	var a client.Torrent
+	require.NoError(t, fd.Torrent(ctx, "a", &a))
+	require.NoError(t, localMove(ctx, &a, dest))
+	require.FileExists(t, filepath.Join(dest, "a", "f.bin"))
+	require.NoDirExists(t, filepath.Join(src, "a"))
+	require.NoError(t, fd.Torrent(ctx, "a", &a))
+	require.Equal(t, dest, a.Path)
+	require.Equal(t, client.Seeding, a.State)
+
+	// A payload already at the destination without a journal entry is never copied into
+	require.NoError(t, os.MkdirAll(filepath.Join(dest, "b"), 0755))
+	var b client.Torrent
+	require.NoError(t, fd.Torrent(ctx, "b", &b))
+	require.True(t, errors.Is(localMove(ctx, &b, dest), ErrDestExists))
+	require.FileExists(t, filepath.Join(src, "b", "f.bin"))
+	require.NoError(t, fd.Torrent(ctx, "b", &b))
+	require.Equal(t, src, b.Path)
+
+	// The payload is put back at the source when the client cannot be repointed
+	driver = noLocationDriver{fd}
+	var c client.Torrent
+	require.NoError(t, fd.Torrent(ctx, "c", &c))
+	require.Error(t, localMove(ctx, &c, dest))
+	require.FileExists(t, filepath.Join(src, "c", "f.bin"))
+	require.NoDirExists(t, filepath.Join(dest, "c"))
+	require.NoError(t, fd.Torrent(ctx, "c", &c))
+	require.Equal(t, src, c.Path)
+	require.Equal(t, client.Seeding, c.State)
+	require.Empty(t, moveJobs)
+
+	// An interrupted move keeps its journal entry and resumes where it stopped
+	driver = fd
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	var d client.Torrent
+	require.NoError(t, fd.Torrent(ctx, "d", &d))
+	require.True(t, errors.Is(localMove(cancelled, &d, dest), context.Canceled))
+	require.Contains(t, moveJobs, "d")
+	require.NoError(t, localMove(ctx, &d, dest))
+	require.FileExists(t, filepath.Join(dest, "d", "f.bin"))
+	require.NoError(t, fd.Torrent(ctx, "d", &d))
+	require.Equal(t, dest, d.Path)
+	require.Empty(t, moveJobs)
+}
+
+// noLocationDriver fails every SetLocation call
+type noLocationDriver struct {
+	*fakeDriver
+}
+
+func (noLocationDriver) SetLocation(context.Context, string, string) error {
+	return client.ErrDriverError
+}
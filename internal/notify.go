@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+var notifyClient = &http.Client{Timeout: time.Second * 10}
+
+type notification struct {
+	Event   string    `json:"event"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// notify logs the event and sends it to the configured webhook, if any
+func notify(event string, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.WithField("event", event).Warn(msg)
+	if config.Notifications == nil || config.Notifications.WebhookURL == "" {
+		return
+	}
+	b, err := json.Marshal(notification{Event: event, Message: msg, Time: time.Now()})
+	if err != nil {
+		log.Errorf("Failed to encode notification: %v", err)
+		return
+	}
+	resp, err := notifyClient.Post(config.Notifications.WebhookURL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		log.Errorf("Failed to send notification: %v", err)
+		return
+	}
+	if err := resp.Body.Close(); err != nil {
+		log.Errorf("Failed to close notification response: %v", err)
+	}
+	if resp.StatusCode >= 300 {
+		log.Errorf("Notification webhook returned: %s", resp.Status)
+	}
+}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"time"
+)
+
+// resilient is the main client driver, kept to report its connection health
+var resilient *client.ResilientDriver
+
+// reconnectConfig controls reconnecting to the client after the connection is lost. Calls that
+// are safe to repeat are retried up to max_retries times, waiting min_backoff before the first
+// retry and doubling up to max_backoff. max_retries defaults to 3, 0 disables retries.
+type reconnectConfig struct {
+	MaxRetries    *int   `mapstructure:"max_retries"`
+	MinBackoffStr string `mapstructure:"min_backoff"`
+	MinBackoff    time.Duration
+	MaxBackoffStr string `mapstructure:"max_backoff"`
+	MaxBackoff    time.Duration
+}
+
+// newResilientDriver wraps the client driver so lost connections are restored
+func newResilientDriver(cl client.Driver) *client.ResilientDriver {
+	opts := client.RetryOpts{OnChange: onClientHealth}
+	if config.Reconnect != nil {
+		if config.Reconnect.MaxRetries != nil {
+			opts.MaxRetries = *config.Reconnect.MaxRetries
+		}
+		opts.MinBackoff = config.Reconnect.MinBackoff
+		opts.MaxBackoff = config.Reconnect.MaxBackoff
+	}
+	return client.NewResilientDriver(cl, opts)
+}
+
+// onClientHealth notifies when the connection to the client is lost or restored
+func onClientHealth(health client.Health) {
+	if health.Connected {
+		notify("client_reconnected", "Connection to the client was restored")
+		return
+	}
+	notify("client_disconnected", "Lost connection to the client: %s", health.LastError)
+}
+
+// clientHealth returns the connection health of the main client for the metrics
+func clientHealth() interface{} {
+	if resilient == nil {
+		return nil
+	}
+	return resilient.Health()
+}
@@ -0,0 +1,344 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	rssStateFile = "rss.json"
+	// rssSeenRetention is how long an item is remembered after it was last present in a feed
+	rssSeenRetention = time.Hour * 24 * 90
+	// maxTorrentFileSize guards against feeds linking to something that is not a .torrent
+	maxTorrentFileSize = 10 << 20
+	maxFeedSize        = 50 << 20
+)
+
+var rssClient = &http.Client{Timeout: time.Second * 30}
+
+// rssConfig defines the feeds polled for new torrents
+type rssConfig struct {
+	Enabled     bool   `mapstructure:"enabled"`
+	IntervalStr string `mapstructure:"interval"`
+	Interval    time.Duration
+	Feeds       []*rssFeed `mapstructure:"feeds"`
+}
+
+// rssFeed is a single feed and the filters applied to its items. Items must match at least one
+// include pattern, when any are set, and none of the exclude patterns.
+type rssFeed struct {
+	Name       string   `mapstructure:"name"`
+	URL        string   `mapstructure:"url"`
+	Label      string   `mapstructure:"label"`
+	Include    []string `mapstructure:"include"`
+	Exclude    []string `mapstructure:"exclude"`
+	MinSizeStr string   `mapstructure:"min_size"`
+	MaxSizeStr string   `mapstructure:"max_size"`
+	MinSize    int64
+	MaxSize    int64
+	include    []*regexp.Regexp
+	exclude    []*regexp.Regexp
+}
+
+func (f *rssFeed) parse() error {
+	for _, s := range f.Include {
+		rx, err := regexp.Compile(s)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid include pattern")
+		}
+		f.include = append(f.include, rx)
+	}
+	for _, s := range f.Exclude {
+		rx, err := regexp.Compile(s)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid exclude pattern")
+		}
+		f.exclude = append(f.exclude, rx)
+	}
+	if f.MinSizeStr != "" {
+		s, err := humanize.ParseBytes(f.MinSizeStr)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid min_size")
+		}
+		f.MinSize = int64(s)
+	}
+	if f.MaxSizeStr != "" {
+		s, err := humanize.ParseBytes(f.MaxSizeStr)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid max_size")
+		}
+		f.MaxSize = int64(s)
+	}
+	return nil
+}
+
+// matchTitle applies the include and exclude patterns
+func (f *rssFeed) matchTitle(title string) bool {
+	for _, rx := range f.exclude {
+		if rx.MatchString(title) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, rx := range f.include {
+		if rx.MatchString(title) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSize applies the size bounds, an unknown size (0) always matches
+func (f *rssFeed) matchSize(size int64) bool {
+	if size <= 0 {
+		return true
+	}
+	if f.MinSize > 0 && size < f.MinSize {
+		return false
+	}
+	if f.MaxSize > 0 && size > f.MaxSize {
+		return false
+	}
+	return true
+}
+
+type rssItem struct {
+	Title     string `xml:"title"`
+	Link      string `xml:"link"`
+	GUID      string `xml:"guid"`
+	Enclosure struct {
+		URL    string `xml:"url,attr"`
+		Length int64  `xml:"length,attr"`
+		Type   string `xml:"type,attr"`
+	} `xml:"enclosure"`
+	// Attrs holds the torznab/newznab extended attributes, eg: size
+	Attrs []struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:"value,attr"`
+	} `xml:"attr"`
+}
+
+type rssDocument struct {
+	Items []*rssItem `xml:"channel>item"`
+}
+
+// id returns the key used to dedupe the item
+func (i *rssItem) id() string {
+	if i.GUID != "" {
+		return i.GUID
+	}
+	return i.downloadURL()
+}
+
+func (i *rssItem) downloadURL() string {
+	if i.Enclosure.URL != "" {
+		return i.Enclosure.URL
+	}
+	return i.Link
+}
+
+// size returns the payload size advertised by the feed, 0 when unknown
+func (i *rssItem) size() int64 {
+	for _, a := range i.Attrs {
+		if a.Name == "size" {
+			if v, err := strconv.ParseInt(a.Value, 10, 64); err == nil {
+				return v
+			}
+		}
+	}
+	if i.Enclosure.Type == "application/x-bittorrent" {
+		return i.Enclosure.Length
+	}
+	return 0
+}
+
+func parseFeed(r io.Reader) ([]*rssItem, error) {
+	var doc rssDocument
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, errors.Wrapf(err, "Failed to decode feed")
+	}
+	return doc.Items, nil
+}
+
+func fetch(ctx context.Context, url string, limit int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := rssClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Errorf("Failed to close response body: %v", err)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Invalid response status: %s", resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, limit))
+}
+
+// rssSeen is the persisted set of item ids already handled, mapped to the time last seen
+type rssSeen map[string]time.Time
+
+func rssEnabled() bool {
+	return config.RSS != nil && config.RSS.Enabled
+}
+
+// pollFeed fetches a feed and adds any new matching items, returning true when seen was changed
+func pollFeed(ctx context.Context, feed *rssFeed, seen rssSeen) bool {
+	l := log.WithField("feed", feed.Name)
+	body, err := fetch(ctx, feed.URL, maxFeedSize)
+	if err != nil {
+		l.Errorf("Failed to fetch feed: %v", err)
+		return false
+	}
+	items, err := parseFeed(bytes.NewReader(body))
+	if err != nil {
+		l.Errorf("Failed to parse feed: %v", err)
+		return false
+	}
+	changed := false
+	now := time.Now()
+	for _, item := range items {
+		id := item.id()
+		if id == "" {
+			continue
+		}
+		if last, found := seen[id]; found {
+			// Only persist the refreshed time occasionally, it only matters for pruning
+			if now.Sub(last) > time.Hour*24 {
+				seen[id] = now
+				changed = true
+			}
+			continue
+		}
+		if !feed.matchTitle(item.Title) || !feed.matchSize(item.size()) {
+			continue
+		}
+		il := l.WithField("title", item.Title)
+		if strings.HasPrefix(item.downloadURL(), "magnet:") {
+			il.Warnf("Magnet links are not supported")
+			continue
+		}
+		data, err := fetch(ctx, item.downloadURL(), maxTorrentFileSize)
+		if err != nil {
+			il.Errorf("Failed to download torrent: %v", err)
+			continue
+		}
+		_, size, err := parseMetaInfo(data)
+		if err != nil {
+			il.Errorf("Invalid torrent: %v", err)
+			seen[id] = now
+			changed = true
+			continue
+		}
+		if !feed.matchSize(size) {
+			il.Debugf("Skipped torrent outside of size bounds (%s)", humanize.Bytes(uint64(size)))
+			seen[id] = now
+			changed = true
+			continue
+		}
+		if err := addTorrent(ctx, torrentFilename(item.Title), data, feed.Label); err != nil {
+			il.Errorf("Failed to add torrent: %v", err)
+			if transientAddError(ctx, err) {
+				continue
+			}
+			// Adding it again, eg: a duplicate the client rejects, would fail the same way every poll
+			seen[id] = now
+			changed = true
+			continue
+		}
+		if dryRun() {
+			// Nothing was added, the item must still be added once dry run is disabled
+			continue
+		}
+		seen[id] = now
+		changed = true
+	}
+	return changed
+}
+
+// transientAddError returns true for failures which may not happen on the next poll, such as a lost
+// connection or no storage tier having room yet
+func transientAddError(ctx context.Context, err error) bool {
+	return ctx.Err() != nil || errors.Is(err, ErrNoRoom) || errors.Is(err, client.ErrAuthFailed) ||
+		client.IsConnectionError(err)
+}
+
+// torrentFilename builds a safe .torrent filename from an item title
+func torrentFilename(title string) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(title))
+	if name == "" {
+		name = fmt.Sprintf("%d", time.Now().Unix())
+	}
+	return name + ".torrent"
+}
+
+func pollFeeds(ctx context.Context, seen rssSeen) {
+	changed := false
+	for _, feed := range config.RSS.Feeds {
+		if pollFeed(ctx, feed, seen) {
+			changed = true
+		}
+	}
+	for id, t := range seen {
+		if time.Since(t) > rssSeenRetention {
+			delete(seen, id)
+			changed = true
+		}
+	}
+	if changed {
+		if err := writeState(rssStateFile, seen); err != nil {
+			log.Errorf("Failed to save rss state: %v", err)
+		}
+	}
+}
+
+func rssWorker(ctx context.Context) {
+	seen := rssSeen{}
+	if err := readState(rssStateFile, &seen); err != nil {
+		log.Errorf("Failed to load rss state: %v", err)
+	}
+	pollFeeds(ctx, seen)
+	t0 := time.NewTicker(config.RSS.Interval)
+	defer t0.Stop()
+	for {
+		select {
+		case <-t0.C:
+			pollFeeds(ctx, seen)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func startRSS(ctx context.Context) {
+	if !rssEnabled() {
+		return
+	}
+	log.Debugf("Polling %d rss feeds every %s", len(config.RSS.Feeds), config.RSS.Interval)
+	go rssWorker(ctx)
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:torznab="http://torznab.com/schemas/2015/feed">
+<channel>
+<title>test</title>
+<item>
+	<title>Some.Show.S01E01.1080p</title>
+	<guid>abc-1</guid>
+	<link>https://example.com/dl/1</link>
+	<enclosure url="https://example.com/dl/1.torrent" length="1234" type="application/x-bittorrent"/>
+	<torznab:attr name="size" value="2000000000"/>
+</item>
+<item>
+	<title>Some.Show.S01E01.720p</title>
+	<link>https://example.com/dl/2</link>
+</item>
+</channel>
+</rss>`
+
+func TestRSSFeed(t *testing.T) {
+	items, err := parseFeed(strings.NewReader(testFeed))
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	require.Equal(t, "abc-1", items[0].id())
+	require.Equal(t, "https://example.com/dl/1.torrent", items[0].downloadURL())
+	require.Equal(t, int64(2000000000), items[0].size())
+	require.Equal(t, "https://example.com/dl/2", items[1].id())
+	require.Equal(t, int64(0), items[1].size())
+
+	feed := &rssFeed{
+		Include:    []string{`(?i)some\.show`},
+		Exclude:    []string{`720p`},
+		MinSizeStr: "1GB",
+		MaxSizeStr: "10GB",
+	}
+	require.NoError(t, feed.parse())
+	require.True(t, feed.matchTitle(items[0].Title))
+	require.False(t, feed.matchTitle(items[1].Title))
+	require.False(t, feed.matchTitle("Other.Show.S01E01"))
+	require.True(t, feed.matchSize(items[0].size()))
+	require.True(t, feed.matchSize(0))
+	require.False(t, feed.matchSize(500000000))
+	require.False(t, feed.matchSize(20000000000))
+
+	require.Error(t, (&rssFeed{Include: []string{"("}}).parse())
+	require.Equal(t, "a_b.torrent", torrentFilename("a/b"))
+}
+
+func TestPollFeed(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	mux.HandleFunc("/feed", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `<rss><channel><item><title>Some.Show.S01E01</title><guid>abc-1</guid>
+<enclosure url="%s/dl/1.torrent" length="1000" type="application/x-bittorrent"/></item></channel></rss>`, srv.URL)
+	})
+	mux.HandleFunc("/dl/1.torrent", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(testMetaInfo("Some.Show.S01E01", 1000))
+	})
+	prevConfig, prevDriver := config, driver
+	defer func() { config, driver = prevConfig, prevDriver }()
+	config = &configuration{General: &generalConfig{DryRunMode: true}}
+	config.Checks = &struct {
+		Order []CheckOrder   `mapstructure:"order"`
+		Paths []*checkConfig `mapstructure:"paths"`
+	}{Paths: []*checkConfig{{Path: "/data", MinFree: 100}}}
+	fd := newFakeDriver()
+	fd.free["/data"] = 10000
+	driver = fd
+	feed := &rssFeed{Name: "test", URL: srv.URL + "/feed"}
+	require.NoError(t, feed.parse())
+	ctx := context.Background()
+
+	// Nothing is added in dry run so the item is left for when it is disabled
+	seen := rssSeen{}
+	require.False(t, pollFeed(ctx, feed, seen))
+	require.Empty(t, seen)
+	require.Empty(t, fd.torrents)
+
+	// The item is retried once a tier has room
+	config.General.DryRunMode = false
+	fd.free["/data"] = 0
+	require.False(t, pollFeed(ctx, feed, seen))
+	require.Empty(t, seen)
+	fd.free["/data"] = 10000
+
+	// A torrent the client rejects is not downloaded again
+	fd.addErr = errors.New("Torrent already in session")
+	require.True(t, pollFeed(ctx, feed, seen))
+	require.Contains(t, seen, "abc-1")
+	require.Empty(t, fd.torrents)
+
+	delete(seen, "abc-1")
+	fd.addErr = nil
+	require.True(t, pollFeed(ctx, feed, seen))
+	require.Contains(t, seen, "abc-1")
+	require.Len(t, fd.torrents, 1)
+	require.False(t, pollFeed(ctx, feed, seen))
+	require.Len(t, fd.torrents, 1)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err := fetch(cancelled, feed.URL, maxFeedSize)
+	require.True(t, errors.Is(err, context.Canceled))
+}
@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"context"
+	"github.com/dustin/go-humanize"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// appliedProfile is the name of the schedule profile last applied to the client
+var appliedProfile string
+
+// dryRunProfile is the name of the profile last logged in dry run, which is not applied to the client
+var dryRunProfile string
+
+// schedulesConfig switches the clients session settings between profiles by time of day. The default
+// profile is applied outside of every profile window.
+type schedulesConfig struct {
+	Default  *scheduleProfile   `mapstructure:"default"`
+	Profiles []*scheduleProfile `mapstructure:"profiles"`
+}
+
+// scheduleProfile is a set of session settings, rates are in bytes/sec and zero is unlimited. Settings
+// that are not set are left unchanged.
+type scheduleProfile struct {
+	Name                     string   `mapstructure:"name"`
+	Start                    string   `mapstructure:"start"`
+	End                      string   `mapstructure:"end"`
+	Days                     []string `mapstructure:"days"`
+	UploadLimitStr           string   `mapstructure:"upload_limit"`
+	DownloadLimitStr         string   `mapstructure:"download_limit"`
+	MaxActiveDownloads       *int     `mapstructure:"max_active_downloads"`
+	MaxActiveSeeding         *int     `mapstructure:"max_active_seeding"`
+	MaxConnections           *int     `mapstructure:"max_connections"`
+	MaxConnectionsPerTorrent *int     `mapstructure:"max_connections_per_torrent"`
+	window                   *moveWindow
+	days                     map[time.Weekday]bool
+	settings                 *client.SessionSettings
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseRate(s string) (*int64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	v, err := humanize.ParseBytes(s)
+	if err != nil {
+		return nil, err
+	}
+	r := int64(v)
+	return &r, nil
+}
+
+// parse validates the profile, a window is required unless it is the default profile
+func (p *scheduleProfile) parse(isDefault bool) error {
+	if !isDefault {
+		if p.Name == "" {
+			return errors.New("Profile name must be set")
+		}
+		p.window = &moveWindow{Start: p.Start, End: p.End}
+		if err := p.window.parse(); err != nil {
+			return errors.Wrapf(err, "Invalid %s window", p.Name)
+		}
+	} else if p.Name == "" {
+		p.Name = "default"
+	}
+	if len(p.Days) > 0 {
+		p.days = map[time.Weekday]bool{}
+		for _, d := range p.Days {
+			wd, found := weekdays[strings.ToLower(d)]
+			if !found {
+				return errors.Errorf("Invalid %s day: %s", p.Name, d)
+			}
+			p.days[wd] = true
+		}
+	}
+	up, err := parseRate(p.UploadLimitStr)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid %s upload_limit", p.Name)
+	}
+	down, err := parseRate(p.DownloadLimitStr)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid %s download_limit", p.Name)
+	}
+	p.settings = &client.SessionSettings{
+		UploadLimit:              up,
+		DownloadLimit:            down,
+		MaxActiveDownloads:       p.MaxActiveDownloads,
+		MaxActiveSeeding:         p.MaxActiveSeeding,
+		MaxConnections:           p.MaxConnections,
+		MaxConnectionsPerTorrent: p.MaxConnectionsPerTorrent,
+	}
+	return nil
+}
+
+// active returns true when the profile window covers t, days are matched against the day of t
+func (p *scheduleProfile) active(t time.Time) bool {
+	if p.days != nil && !p.days[t.Weekday()] {
+		return false
+	}
+	return p.window.contains(t)
+}
+
+// restores returns true when s sets every setting other sets, so applying s undoes other
+func restores(s *client.SessionSettings, other *client.SessionSettings) bool {
+	return (other.UploadLimit == nil || s.UploadLimit != nil) &&
+		(other.DownloadLimit == nil || s.DownloadLimit != nil) &&
+		(other.MaxActiveDownloads == nil || s.MaxActiveDownloads != nil) &&
+		(other.MaxActiveSeeding == nil || s.MaxActiveSeeding != nil) &&
+		(other.MaxConnections == nil || s.MaxConnections != nil) &&
+		(other.MaxConnectionsPerTorrent == nil || s.MaxConnectionsPerTorrent != nil)
+}
+
+// parse validates the profiles. The default profile is applied once no profile window covers the
+// current time, so it must set everything the profiles set or their settings would be kept forever.
+func (s *schedulesConfig) parse() error {
+	if s.Default != nil {
+		if err := s.Default.parse(true); err != nil {
+			return err
+		}
+	}
+	if len(s.Profiles) > 0 && s.Default == nil {
+		return errors.New("A default profile is required to restore the settings once a profile ends")
+	}
+	for _, p := range s.Profiles {
+		if err := p.parse(false); err != nil {
+			return err
+		}
+		if !restores(s.Default.settings, p.settings) {
+			return errors.Errorf("The default profile must set every setting set by %s", p.Name)
+		}
+	}
+	return nil
+}
+
+// activeProfile returns the first profile covering t, falling back to the default profile
+func activeProfile(t time.Time) *scheduleProfile {
+	for _, p := range config.Schedules.Profiles {
+		if p.active(t) {
+			return p
+		}
+	}
+	return config.Schedules.Default
+}
+
+// applySchedule updates the session settings when the active profile changes. A failed update is
+// retried on the next call.
+func applySchedule(ctx context.Context, now time.Time) {
+	if config.Schedules == nil {
+		return
+	}
+	p := activeProfile(now)
+	if p == nil || p.Name == appliedProfile {
+		return
+	}
+	// Nothing is recorded as applied in dry run so the profile is applied once it is turned off
+	if dryRun() {
+		if p.Name != dryRunProfile {
+			log.Infof("[DRY] Applied schedule profile: %s", p.Name)
+			dryRunProfile = p.Name
+		}
+		return
+	}
+	if err := driver.SetSessionSettings(ctx, p.settings); err != nil {
+		log.Errorf("Failed to apply schedule profile %s: %v", p.Name, err)
+		return
+	}
+	log.Infof("Applied schedule profile: %s", p.Name)
+	appliedProfile = p.Name
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestApplySchedule(t *testing.T) {
+	ctx := context.Background()
+	prevConfig, prevDriver := config, driver
+	defer func() { config, driver = prevConfig, prevDriver }()
+	active, unlimited := 1, 0
+	schedules := &schedulesConfig{
+		Default: &scheduleProfile{UploadLimitStr: "0", DownloadLimitStr: "0", MaxActiveDownloads: &unlimited},
+		Profiles: []*scheduleProfile{{
+			Name:               "work",
+			Start:              "09:00",
+			End:                "17:00",
+			Days:               []string{"mon", "Fri"},
+			UploadLimitStr:     "5MB",
+			DownloadLimitStr:   "1MB",
+			MaxActiveDownloads: &active,
+		}},
+	}
+	require.NoError(t, schedules.parse())
+	require.Error(t, (&schedulesConfig{Profiles: []*scheduleProfile{{Name: "x", Start: "09:00", End: "17:00"}}}).parse(),
+		"Nothing would restore the settings of the profile")
+	require.Error(t, (&schedulesConfig{Default: &scheduleProfile{}, Profiles: []*scheduleProfile{{Name: "x",
+		Start: "09:00", End: "17:00", MaxActiveDownloads: &active}}}).parse())
+	require.Error(t, (&schedulesConfig{Profiles: []*scheduleProfile{{Name: "x", Start: "9", End: "17:00"}}}).parse())
+	require.Error(t, (&schedulesConfig{Profiles: []*scheduleProfile{{Name: "x", Start: "09:00", End: "17:00",
+		Days: []string{"someday"}}}}).parse())
+
+	fd := newFakeDriver()
+	driver = fd
+	config = &configuration{General: &generalConfig{}, Schedules: schedules}
+	appliedProfile = ""
+
+	monday := time.Date(2021, 3, 1, 10, 0, 0, 0, time.Local)
+	require.Equal(t, "work", activeProfile(monday).Name)
+	require.Equal(t, "default", activeProfile(monday.Add(time.Hour*8)).Name)
+	require.Equal(t, "default", activeProfile(monday.AddDate(0, 0, 1)).Name)
+
+	applySchedule(ctx, monday)
+	s, err := fd.SessionSettings(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(5000000), *s.UploadLimit)
+	require.Equal(t, int64(1000000), *s.DownloadLimit)
+	require.Equal(t, 1, *s.MaxActiveDownloads)
+
+	applySchedule(ctx, monday.Add(time.Hour*8))
+	s, err = fd.SessionSettings(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), *s.UploadLimit)
+	require.Equal(t, int64(0), *s.DownloadLimit)
+	require.Equal(t, 0, *s.MaxActiveDownloads)
+
+	// A profile is applied once dry run is turned off
+	config.General.DryRunMode = true
+	applySchedule(ctx, monday)
+	s, err = fd.SessionSettings(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), *s.UploadLimit)
+	config.General.DryRunMode = false
+	applySchedule(ctx, monday)
+	s, err = fd.SessionSettings(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(5000000), *s.UploadLimit)
+}
@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"context"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+)
+
+var ErrLastSeeder = errors.New("Too few other seeders")
+
+// lastSeederConfig protects torrents we are one of the last seeders of from being removed
+type lastSeederConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// MinSeeders is the number of seeders, not counting us, a torrent needs before it may be removed
+	MinSeeders int `mapstructure:"min_seeders"`
+	// Emergency allows min_free on the last tier to remove protected torrents when nothing else can
+	// free enough space
+	Emergency bool `mapstructure:"emergency"`
+}
+
+func lastSeederEnabled() bool {
+	return config.LastSeeder != nil && config.LastSeeder.Enabled
+}
+
+func lastSeederEmergency() bool {
+	return lastSeederEnabled() && config.LastSeeder.Emergency
+}
+
+// otherSeeders returns the number of seeders other than us. The tracker scrape is preferred as it
+// covers the whole swarm, the connected seeds are used when no tracker reports a count.
+func otherSeeders(ctx context.Context, t *client.Torrent) int {
+	trackers, err := driver.Trackers(ctx, t.Hash)
+	if err != nil {
+		t.Log().Debugf("Could not get trackers, using connected seeds: %v", err)
+		return t.Seeds
+	}
+	scrape := -1
+	for _, tr := range trackers {
+		if tr.Seeders > scrape {
+			scrape = tr.Seeders
+		}
+	}
+	if scrape < 0 {
+		return t.Seeds
+	}
+	// The scrape includes us once we have the complete data
+	if t.Progress >= 1 && scrape > 0 {
+		scrape--
+	}
+	return scrape
+}
+
+// seederGuard returns an error when removing the torrent would leave the swarm with too few seeders
+func seederGuard(ctx context.Context, t *client.Torrent) error {
+	if !lastSeederEnabled() {
+		return nil
+	}
+	if n := otherSeeders(ctx, t); n < config.LastSeeder.MinSeeders {
+		return errors.Wrapf(ErrLastSeeder, "%d other seeders, min_seeders is %d", n, config.LastSeeder.MinSeeders)
+	}
+	return nil
+}
+
+// seederGuardGroup checks every member of the group as they are all removed together
+func seederGuardGroup(ctx context.Context, group torrentGroup) error {
+	for _, m := range group {
+		if err := seederGuard(ctx, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"context"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSeederGuard(t *testing.T) {
+	ctx := context.Background()
+	stateDir, err := ioutil.TempDir("", "seedr-seeders")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(stateDir) }()
+	prevConfig, prevDriver := config, driver
+	defer func() { config, driver = prevConfig, prevDriver }()
+	config = &configuration{
+		General:    &generalConfig{StateDir: stateDir},
+		LastSeeder: &lastSeederConfig{Enabled: true, MinSeeders: 2},
+	}
+	fd := newFakeDriver()
+	driver = fd
+	popular := &client.Torrent{Hash: "aaa", Name: "popular", Path: "/data", Size: 100, Progress: 1}
+	rare := &client.Torrent{Hash: "bbb", Name: "rare", Path: "/data", Size: 200, Progress: 1}
+	unscraped := &client.Torrent{Hash: "ccc", Name: "unscraped", Path: "/data", Size: 300, Progress: 1, Seeds: 1}
+	for _, tor := range []*client.Torrent{popular, rare, unscraped} {
+		fd.add(tor)
+	}
+	fd.trackers["aaa"] = []client.Tracker{{Seeders: 2}, {Seeders: 10}}
+	// The scrape counts us as one of the seeders
+	fd.trackers["bbb"] = []client.Tracker{{Seeders: 2}}
+	fd.trackers["ccc"] = []client.Tracker{{Seeders: -1}}
+
+	require.Equal(t, 9, otherSeeders(ctx, popular))
+	require.Equal(t, 1, otherSeeders(ctx, rare))
+	require.Equal(t, 1, otherSeeders(ctx, unscraped))
+	require.NoError(t, seederGuard(ctx, popular))
+	require.True(t, errors.Is(seederGuard(ctx, rare), ErrLastSeeder))
+
+	tier := &checkConfig{Path: "/data", MinFree: 1000}
+	fd.free["/data"] = 550
+	require.NoError(t, checkMinFree(ctx, newActionBatch(), []*client.Torrent{popular, rare, unscraped}, tier, 0, 1))
+	require.Contains(t, fd.removed, "aaa")
+	require.NotContains(t, fd.removed, "bbb")
+	require.NotContains(t, fd.removed, "ccc")
+
+	// Emergency removal takes protected torrents once nothing else is left
+	config.LastSeeder.Emergency = true
+	fd.free["/data"] = 650
+	require.NoError(t, checkMinFree(ctx, newActionBatch(), []*client.Torrent{rare, unscraped}, tier, 0, 1))
+	require.Contains(t, fd.removed, "bbb")
+	require.Contains(t, fd.removed, "ccc")
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/dustin/go-humanize"
 	delugeclient "github.com/gdm85/go-libdeluge"
 	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"strings"
 	"sync"
@@ -25,22 +26,49 @@ func torrentsToSlice(torrents map[string]client.Torrent) []client.Torrent {
 	return torrentSlice
 }
 
-//  Start is the main entry point of the application
+// newDriver creates and logs into the configured client driver
+func newDriver(ctx context.Context) (client.Driver, error) {
+	return newDriverFor(ctx, config.Client)
+}
+
+// newDriverFor creates and logs into a client driver. Calls are serialised and bounded by the
+// clients timeout.
+func newDriverFor(ctx context.Context, cfg *client.Config) (client.Driver, error) {
+	raw, err := client.New(cfg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create client driver")
+	}
+	cl := client.NewLockedDriver(raw, cfg.Timeout)
+	if err := cl.Login(ctx); err != nil {
+		return nil, errors.Wrapf(err, "Could not login to client")
+	}
+	return cl, nil
+}
+
+//  Start is the main entry point of the application, it runs until ctx is cancelled
 // Deluge cannot multiplex socket calls, must be serial
-func Start() {
-	cl, err := client.New(config.Client)
+func Start(ctx context.Context) {
+	cl, err := newDriver(ctx)
 	if err != nil {
-		log.Fatalf("Failed to create client driver: %v", err)
+		log.Fatalf("Failed to start: %v", err)
 	}
 	defer func() {
 		if err := cl.Close(); err != nil {
 			log.Errorf("Failed to close connection: %v", err)
 		}
 	}()
-	if err := cl.Login(); err != nil {
-		log.Fatalf("Could not login to client: %v", err)
+	resilient = newResilientDriver(cl)
+	driver = resilient
+	if err := checkCapabilities(driver.Capabilities()); err != nil {
+		log.Fatalf("Invalid configuration for client: %v", err)
 	}
-	driver = cl
+	loadSafetyState()
+	resumeMoves(ctx)
+	startMoveQueue(ctx)
+	startMetrics()
+	startRSS(ctx)
+	startWatch(ctx)
+	startBackup(ctx)
 
 	//statInterval, err2 := time.ParseDuration(config.General.StatInterval)
 	//if err2 != nil {
@@ -50,10 +78,17 @@ func Start() {
 	if err3 != nil {
 		log.Fatalf("Invalid general.update_interval: %v", err)
 	}
-	ctx := context.Background()
-	go updateWorker(ctx, updateInterval)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		updateWorker(ctx, updateInterval)
+	}()
 	//go statWorker(ctx, statInterval)
 	<-ctx.Done()
+	log.Infof("Shutting down")
+	// Let the current update give up on its cancelled calls before the connection is closed
+	wg.Wait()
 }
 
 func updateWorker(ctx context.Context, interval time.Duration) {
@@ -64,12 +99,19 @@ func updateWorker(ctx context.Context, interval time.Duration) {
 			// Use a timer so that we can ensure we dont overlap any potentially long running
 			// operation.
 			log.Debugf("Updating...")
-			torrents, err := driver.TorrentsWithState(client.Seeding, client.Active, client.Paused)
+			torrents, err := driver.TorrentsWithState(ctx, client.Seeding, client.Active, client.Paused)
 			if err != nil {
 				log.Errorf("Could not update: %v", err)
+				t0 = time.NewTimer(interval)
 				continue
 			}
-			checkStatus(torrents)
+			applySchedule(ctx, time.Now())
+			sampleForecast(ctx)
+			checkStatus(ctx, torrents)
+			if err := allocateSlots(ctx, time.Now()); err != nil {
+				log.Errorf("Failed to allocate upload slots: %v", err)
+			}
+			purgeTrash()
 			t0 = time.NewTimer(interval)
 		case <-ctx.Done():
 			return
@@ -92,7 +134,7 @@ func statWorker(ctx context.Context, interval time.Duration) {
 		select {
 		case <-t0.C:
 			clientMu.Lock()
-			torrents, err := driver.TorrentsWithState(client.Any)
+			torrents, err := driver.TorrentsWithState(ctx, client.Any)
 			if err != nil {
 				log.Errorf("ERROR: could not list all torrents: %v\n", err)
 				clientMu.Unlock()
@@ -0,0 +1,271 @@
+package internal
+
+import (
+	"context"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"time"
+)
+
+const slotsStateFile = "slots.json"
+
+var (
+	// slots holds the allocation state of each managed torrent, it is only used from the update worker
+	slots = map[string]*slotInfo{}
+	// slotsPaused is the persisted set of torrents paused by the slot manager. Torrents paused by
+	// anything else are left alone. It is loaded on first use.
+	slotsPaused map[string]bool
+	// slotsQueued is the ranking the active torrents were last queued in, they are only queued again
+	// once it changes
+	slotsQueued []string
+)
+
+// slotsConfig enables managing which complete torrents are seeding. The active slots go to the
+// torrents with the most demand, leechers per seeder, and torrents that stop uploading are rotated out
+// to give others a turn.
+type slotsConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// MaxActive is the number of torrents seeding at once, the clients own seeding queue limit
+	// must be at least as high
+	MaxActive int `mapstructure:"max_active"`
+	// IdleTimeStr is how long an active torrent may go without uploading before it is rotated out, it
+	// is then not given a slot again for the same amount of time
+	IdleTimeStr string `mapstructure:"idle_time"`
+	IdleTime    time.Duration
+	// ScrapeTTLStr is how long the tracker seeder and leecher counts are reused
+	ScrapeTTLStr string `mapstructure:"scrape_ttl"`
+	ScrapeTTL    time.Duration
+	// Labels limits the managed torrents to those with one of the labels, all complete torrents are
+	// managed when empty
+	Labels []string `mapstructure:"labels"`
+}
+
+type slotInfo struct {
+	// started is when the torrent was last seen starting to seed, zero while it is not
+	started    time.Time
+	lastUpload time.Time
+	rotated    time.Time
+	seeders    int
+	leechers   int
+	scraped    time.Time
+}
+
+func slotsEnabled() bool {
+	return config.Slots != nil && config.Slots.Enabled
+}
+
+// demand is the number of leechers each seeder, including us, would have to serve
+func (s *slotInfo) demand() float64 {
+	return float64(s.leechers) / float64(s.seeders+1)
+}
+
+// scrape refreshes the swarm counts from the trackers, falling back to the connected peers
+func (s *slotInfo) scrape(ctx context.Context, t *client.Torrent, now time.Time) {
+	if !s.scraped.IsZero() && now.Sub(s.scraped) < config.Slots.ScrapeTTL {
+		return
+	}
+	s.seeders, s.leechers = t.Seeds, t.Peers
+	trackers, err := driver.Trackers(ctx, t.Hash)
+	if err != nil {
+		t.Log().Debugf("Could not get trackers, using connected peers: %v", err)
+	}
+	for _, tr := range trackers {
+		if tr.Seeders >= 0 && tr.Leechers >= 0 {
+			s.seeders, s.leechers = tr.Seeders, tr.Leechers
+			break
+		}
+	}
+	s.scraped = now
+}
+
+func saveSlotsPaused() {
+	if err := writeState(slotsStateFile, slotsPaused); err != nil {
+		log.Errorf("Failed to write upload slot state: %v", err)
+	}
+}
+
+// managedBySlots returns true for complete torrents the slot manager may start and pause. Paused
+// torrents are only managed when the slot manager paused them and torrents being moved are skipped.
+func managedBySlots(t *client.Torrent) bool {
+	if t.Progress < 1 {
+		return false
+	}
+	switch t.State {
+	case client.Seeding, client.Queued:
+	case client.Paused:
+		if !slotsPaused[t.Hash] {
+			return false
+		}
+	default:
+		return false
+	}
+	if hasMoveJob(t.Hash) {
+		return false
+	}
+	if len(config.Slots.Labels) == 0 {
+		return true
+	}
+	for _, l := range config.Slots.Labels {
+		if l == t.Label {
+			return true
+		}
+	}
+	return false
+}
+
+// allocateSlots starts the torrents with the most demand up to max_active and pauses the rest. The
+// winners are also moved to the top of the clients queue, highest demand first.
+func allocateSlots(ctx context.Context, now time.Time) error {
+	if !slotsEnabled() {
+		return nil
+	}
+	all, err := driver.Torrents(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to get torrents")
+	}
+	if slotsPaused == nil {
+		slotsPaused = map[string]bool{}
+		if err := readState(slotsStateFile, &slotsPaused); err != nil {
+			log.Errorf("Failed to read upload slot state: %v", err)
+		}
+	}
+	// Forget the torrents which were removed or resumed by something else
+	paused := map[string]bool{}
+	for _, t := range all {
+		if t.State == client.Paused && slotsPaused[t.Hash] {
+			paused[t.Hash] = true
+		}
+	}
+	if len(paused) != len(slotsPaused) {
+		slotsPaused = paused
+		saveSlotsPaused()
+	}
+	var candidates []*client.Torrent
+	seen := map[string]bool{}
+	for _, t := range unscheduled(all) {
+		if !managedBySlots(t) {
+			continue
+		}
+		seen[t.Hash] = true
+		info, found := slots[t.Hash]
+		if !found {
+			info = &slotInfo{}
+			slots[t.Hash] = info
+		}
+		if t.State == client.Seeding {
+			if info.started.IsZero() {
+				info.started, info.lastUpload = now, now
+			}
+			if t.SpeedUP > 0 {
+				info.lastUpload = now
+			}
+			if now.Sub(info.lastUpload) > config.Slots.IdleTime {
+				t.Log().Debugf("Rotating out idle torrent")
+				info.rotated = now
+			}
+		} else {
+			info.started = time.Time{}
+		}
+		if !info.rotated.IsZero() && now.Sub(info.rotated) > config.Slots.IdleTime {
+			info.rotated = time.Time{}
+		}
+		if info.rotated.IsZero() {
+			info.scrape(ctx, t, now)
+		}
+		candidates = append(candidates, t)
+	}
+	for hash := range slots {
+		if !seen[hash] {
+			delete(slots, hash)
+		}
+	}
+	eligible := func(t *client.Torrent) bool {
+		return slots[t.Hash].rotated.IsZero()
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if eligible(a) != eligible(b) {
+			return eligible(a)
+		}
+		da, db := slots[a.Hash].demand(), slots[b.Hash].demand()
+		if da != db {
+			return da > db
+		}
+		return a.SpeedUP > b.SpeedUP
+	})
+	var active []*client.Torrent
+	for i, t := range candidates {
+		want := i < config.Slots.MaxActive && eligible(t)
+		if want {
+			active = append(active, t)
+		}
+		// A queued torrent is already started, the client is waiting on its own queue limit
+		if want == (t.State == client.Seeding || t.State == client.Queued) {
+			continue
+		}
+		l := t.Log().WithField("demand", slots[t.Hash].demand())
+		if dryRun() {
+			if want {
+				l.Infof("[DRY] Started torrent (upload slot)")
+			} else {
+				l.Infof("[DRY] Paused torrent (upload slot)")
+			}
+			continue
+		}
+		if want {
+			err = driver.Start(ctx, t.Hash)
+		} else {
+			err = driver.Pause(ctx, t.Hash)
+		}
+		if err != nil {
+			l.Errorf("Failed to update upload slot: %v", err)
+			continue
+		}
+		if want {
+			slots[t.Hash].started, slots[t.Hash].lastUpload = now, now
+			delete(slotsPaused, t.Hash)
+			l.Debugf("Started torrent (upload slot)")
+		} else {
+			slotsPaused[t.Hash] = true
+			l.Debugf("Paused torrent (upload slot)")
+		}
+		saveSlotsPaused()
+	}
+	if dryRun() {
+		return nil
+	}
+	if !driver.Capabilities().Has(client.CapQueue) {
+		return nil
+	}
+	ranking := make([]string, len(active))
+	for i, t := range active {
+		ranking[i] = t.Hash
+	}
+	if sameRanking(ranking, slotsQueued) {
+		return nil
+	}
+	slotsQueued = ranking
+	// Moving each to the top in reverse leaves the highest demand first
+	for i := len(active) - 1; i >= 0; i-- {
+		if err := driver.Queue(ctx, active[i].Hash, client.Top); err != nil {
+			active[i].Log().Errorf("Failed to queue torrent: %v", err)
+			// Retried on the next run
+			slotsQueued = nil
+		}
+	}
+	return nil
+}
+
+func sameRanking(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"context"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAllocateSlots(t *testing.T) {
+	ctx := context.Background()
+	stateDir, err := ioutil.TempDir("", "seedr-slots")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(stateDir) }()
+	prevConfig, prevDriver := config, driver
+	defer func() { config, driver = prevConfig, prevDriver }()
+	config = &configuration{
+		General: &generalConfig{StateDir: stateDir},
+		Slots:   &slotsConfig{Enabled: true, MaxActive: 1, IdleTime: time.Minute * 30, ScrapeTTL: time.Hour},
+	}
+	slots = map[string]*slotInfo{}
+	slotsPaused = nil
+	slotsQueued = nil
+	fd := newFakeDriver()
+	driver = fd
+	fd.add(&client.Torrent{Hash: "aaa", Name: "busy", State: client.Seeding, Progress: 1})
+	fd.add(&client.Torrent{Hash: "bbb", Name: "wanted", State: client.Queued, Progress: 1})
+	fd.add(&client.Torrent{Hash: "ccc", Name: "incomplete", State: client.Paused, Progress: 0.5})
+	fd.trackers["aaa"] = []client.Tracker{{Seeders: 50, Leechers: 10}}
+	fd.trackers["bbb"] = []client.Tracker{{Seeders: 1, Leechers: 20}}
+	fd.trackers["ccc"] = []client.Tracker{{Seeders: 0, Leechers: 100}}
+	// Paused by the user and being moved, neither is touched despite the demand
+	fd.add(&client.Torrent{Hash: "ddd", Name: "user paused", State: client.Paused, Progress: 1})
+	fd.add(&client.Torrent{Hash: "eee", Name: "moving", State: client.Paused, Progress: 1})
+	fd.trackers["ddd"] = []client.Tracker{{Seeders: 0, Leechers: 100}}
+	fd.trackers["eee"] = []client.Tracker{{Seeders: 0, Leechers: 100}}
+	moveJobs["eee"] = &moveJob{Hash: "eee"}
+	defer delete(moveJobs, "eee")
+
+	state := func(hash string) client.State {
+		var tor client.Torrent
+		require.NoError(t, fd.Torrent(ctx, hash, &tor))
+		return tor.State
+	}
+	now := time.Now()
+	require.NoError(t, allocateSlots(ctx, now))
+	require.Equal(t, client.Paused, state("aaa"))
+	require.Equal(t, client.Queued, state("bbb"), "Queued torrents are moved up instead of started")
+	require.Equal(t, client.Paused, state("ccc"), "Incomplete torrents are not managed")
+	require.Equal(t, client.Paused, state("ddd"))
+	require.Equal(t, client.Paused, state("eee"))
+	require.Equal(t, map[string]bool{"aaa": true}, slotsPaused)
+	require.Equal(t, 1, fd.calls["Queue"])
+
+	// The client starts it, the unchanged ranking is not queued again
+	require.NoError(t, fd.setState("bbb", client.Seeding))
+	require.NoError(t, allocateSlots(ctx, now))
+	require.Equal(t, client.Seeding, state("bbb"))
+	require.Equal(t, 1, fd.calls["Queue"])
+
+	// Not uploading for idle_time rotates it out in favour of the next best
+	now = now.Add(time.Minute * 31)
+	require.NoError(t, allocateSlots(ctx, now))
+	require.Equal(t, client.Seeding, state("aaa"))
+	require.Equal(t, client.Paused, state("bbb"))
+	require.Equal(t, 2, fd.calls["Queue"])
+
+	// And it is given a slot again once the cool down has passed
+	now = now.Add(time.Minute * 31)
+	require.NoError(t, allocateSlots(ctx, now))
+	require.Equal(t, client.Seeding, state("bbb"))
+
+	// The paused set survives a restart
+	slotsPaused = nil
+	require.NoError(t, allocateSlots(ctx, now))
+	require.Equal(t, map[string]bool{"aaa": true}, slotsPaused)
+	require.Equal(t, client.Paused, state("ddd"))
+}
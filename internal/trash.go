@@ -0,0 +1,409 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/leighmacdonald/golib"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	trashRecordFile  = "record.json"
+	trashTorrentFile = "meta.torrent"
+	trashDataDir     = "data"
+	// trashMembersDir holds the metainfo of the other group members as <hash>.torrent
+	trashMembersDir = "members"
+)
+
+var ErrNotInTrash = errors.New("Torrent not found in trash")
+
+// trashRecord is the metadata stored alongside each trashed payload so it can be restored
+type trashRecord struct {
+	Hash  string `json:"hash"`
+	Name  string `json:"name"`
+	Label string `json:"label"`
+	// Path is the original download location of the torrent
+	Path string `json:"path"`
+	// DataPath is where the payload currently lives
+	DataPath  string    `json:"data_path"`
+	Size      int64     `json:"size"`
+	TrashedOn time.Time `json:"trashed_on"`
+	// Members are the other torrents of the group, their data lives inside the payload
+	Members []trashMember `json:"members,omitempty"`
+	// Restored is set once the payload and the root are back in the client, only the members are left
+	Restored bool `json:"restored,omitempty"`
+}
+
+// trashMember is a torrent that was removed along with the trashed payload it shares
+type trashMember struct {
+	Hash  string `json:"hash"`
+	Name  string `json:"name"`
+	Label string `json:"label"`
+	Path  string `json:"path"`
+}
+
+func trashEnabled() bool {
+	return config.Trash != nil && config.Trash.Enabled
+}
+
+// trashDir returns the trash root for a tier
+func trashDir(cfg *checkConfig) string {
+	if filepath.IsAbs(config.Trash.Path) {
+		return config.Trash.Path
+	}
+	return filepath.Join(cfg.Path, config.Trash.Path)
+}
+
+func writeTrashRecord(dir string, rec *trashRecord) error {
+	b, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, trashRecordFile), b, 0644)
+}
+
+func readTrashRecord(dir string) (*trashRecord, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, trashRecordFile))
+	if err != nil {
+		return nil, err
+	}
+	var rec trashRecord
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// trashTorrent moves the payload of the group root into the trash directory of the tier along with
+// the metainfo of every member required to restore them, then removes the group from the client
+// without deleting data. The group is paused while the payload is moved and is kept when the payload
+// cannot be moved.
+func trashTorrent(ctx context.Context, group torrentGroup, cfg *checkConfig) error {
+	t := group.root()
+	if t.Path == "" || t.Name == "" {
+		return errors.Errorf("Cannot trash torrent without a known path")
+	}
+	meta, err := driver.Export(ctx, t.Hash)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to export metainfo, refusing to trash")
+	}
+	dir := filepath.Join(trashDir(cfg), strings.ToLower(t.Hash))
+	if err := os.MkdirAll(filepath.Join(dir, trashDataDir), 0755); err != nil {
+		return errors.Wrapf(err, "Failed to create trash dir")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, trashTorrentFile), meta, 0644); err != nil {
+		return errors.Wrapf(err, "Failed to write trash metainfo")
+	}
+	var members []trashMember
+	hashes := []string{t.Hash}
+	for _, m := range group {
+		if m.Hash == t.Hash {
+			continue
+		}
+		if err := writeTrashMember(ctx, dir, m); err != nil {
+			if errRm := os.RemoveAll(dir); errRm != nil {
+				t.Log().Errorf("Failed to remove trash entry: %v", errRm)
+			}
+			return err
+		}
+		members = append(members, trashMember{Hash: m.Hash, Name: m.Name, Label: m.Label, Path: m.Path})
+		hashes = append(hashes, m.Hash)
+	}
+	src := filepath.Join(t.Path, t.Name)
+	dest := filepath.Join(dir, trashDataDir, t.Name)
+	rec := &trashRecord{
+		Hash:      t.Hash,
+		Name:      t.Name,
+		Label:     t.Label,
+		Path:      t.Path,
+		DataPath:  dest,
+		Size:      t.Size,
+		TrashedOn: time.Now(),
+		Members:   members,
+	}
+	if err := writeTrashRecord(dir, rec); err != nil {
+		return errors.Wrapf(err, "Failed to write trash record")
+	}
+	// abort drops the trash entry and resumes the group, leaving it as it was
+	abort := func(reason error) error {
+		for _, m := range group {
+			if m.State == client.Paused {
+				continue
+			}
+			if err := driver.Start(ctx, m.Hash); err != nil && !errors.Is(err, client.ErrUnknownTorrent) {
+				m.Log().Errorf("Failed to resume torrent: %v", err)
+			}
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			t.Log().Errorf("Failed to remove trash entry: %v", err)
+		}
+		return reason
+	}
+	if err := driver.PauseMany(ctx, hashes); err != nil {
+		return abort(errors.Wrapf(err, "Failed to pause torrents"))
+	}
+	if err := os.Rename(src, dest); err != nil {
+		return abort(errors.Wrapf(err, "Failed to move payload into trash"))
+	}
+	// The members are removed first, the root is only removed once nothing else uses its data
+	if err := driver.RemoveMany(ctx, hashes[1:], false); err != nil {
+		if errMv := os.Rename(dest, src); errMv != nil {
+			t.Log().Errorf("Failed to move payload out of trash: %v", errMv)
+			return errors.Wrapf(err, "Failed to remove group members")
+		}
+		return abort(errors.Wrapf(err, "Failed to remove group members"))
+	}
+	if err := driver.Remove(ctx, t.Hash, false); err != nil {
+		if errMv := os.Rename(dest, src); errMv != nil {
+			// The record still restores the whole group from the trash
+			t.Log().Errorf("Failed to move payload out of trash: %v", errMv)
+			return err
+		}
+		if failed := addTrashMembers(ctx, driver, dir, members); len(failed) > 0 {
+			t.Log().Errorf("Failed to re-add %d group members", len(failed))
+		}
+		return abort(err)
+	}
+	// The trash restores the group itself, restore-all must not add it back once purged
+	dropBackup(hashes)
+	return nil
+}
+
+// writeTrashMember stores the metainfo of a group member in the trash entry
+func writeTrashMember(ctx context.Context, dir string, m *client.Torrent) error {
+	meta, err := driver.Export(ctx, m.Hash)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to export metainfo of group member %s, refusing to trash", m.Hash)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, trashMembersDir), 0755); err != nil {
+		return errors.Wrapf(err, "Failed to create trash dir")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, trashMembersDir, strings.ToLower(m.Hash)+".torrent"), meta, 0644); err != nil {
+		return errors.Wrapf(err, "Failed to write trash metainfo")
+	}
+	return nil
+}
+
+// trashEntries returns all trash entry directories across the configured tiers
+func trashEntries() []string {
+	var dirs []string
+	seen := make(map[string]bool)
+	for _, cfg := range config.Checks.Paths {
+		root := trashDir(cfg)
+		if seen[root] {
+			continue
+		}
+		seen[root] = true
+		dirs = append(dirs, tierTrashEntries(root)...)
+	}
+	return dirs
+}
+
+// tierTrashEntries returns the entry directories of a single trash root
+func tierTrashEntries(root string) []string {
+	var dirs []string
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("Failed to read trash dir %s: %v", root, err)
+		}
+		return nil
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			dirs = append(dirs, filepath.Join(root, e.Name()))
+		}
+	}
+	return dirs
+}
+
+func findTrashEntry(hash string) (*trashRecord, string, error) {
+	for _, dir := range trashEntries() {
+		if !strings.EqualFold(filepath.Base(dir), hash) {
+			continue
+		}
+		rec, err := readTrashRecord(dir)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "Failed to read trash record")
+		}
+		return rec, dir, nil
+	}
+	return nil, "", ErrNotInTrash
+}
+
+// purgeTrash permanently deletes trash entries older than the retention period
+func purgeTrash() {
+	if !trashEnabled() {
+		return
+	}
+	for _, dir := range trashEntries() {
+		rec, err := readTrashRecord(dir)
+		if err != nil {
+			log.Warnf("Invalid trash entry %s: %v", dir, err)
+			continue
+		}
+		if time.Since(rec.TrashedOn) < config.Trash.Retention {
+			continue
+		}
+		_ = purgeTrashEntry(dir, rec)
+	}
+}
+
+// purgeTrashEntry permanently deletes a trashed payload along with its entry
+func purgeTrashEntry(dir string, rec *trashRecord) error {
+	l := log.WithFields(log.Fields{"name": rec.Name, "hash": rec.Hash})
+	if dryRun() {
+		l.Infof("[DRY] Purged torrent from trash")
+		return nil
+	}
+	if err := os.RemoveAll(rec.DataPath); err != nil {
+		l.Errorf("Failed to purge trashed data: %v", err)
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		l.Errorf("Failed to remove trash entry: %v", err)
+		return err
+	}
+	l.Infof("Purged torrent from trash")
+	return nil
+}
+
+// reclaimTrash purges the oldest entries in the trash of the tier, ignoring the retention, until at
+// least size bytes are freed and returns the bytes freed. A trashed payload stays on the tiers
+// filesystem so it only frees space once purged.
+func reclaimTrash(cfg *checkConfig, size int64) int64 {
+	type entry struct {
+		dir string
+		rec *trashRecord
+	}
+	var entries []entry
+	for _, dir := range tierTrashEntries(trashDir(cfg)) {
+		rec, err := readTrashRecord(dir)
+		if err != nil {
+			log.Warnf("Invalid trash entry %s: %v", dir, err)
+			continue
+		}
+		entries = append(entries, entry{dir: dir, rec: rec})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].rec.TrashedOn.Before(entries[j].rec.TrashedOn)
+	})
+	var freed int64
+	for _, e := range entries {
+		if freed >= size {
+			break
+		}
+		if err := purgeTrashEntry(e.dir, e.rec); err != nil {
+			continue
+		}
+		freed += e.rec.Size
+	}
+	return freed
+}
+
+// addTrashMembers adds the group members of a trash entry back to the client, the members which
+// failed to be added are returned
+func addTrashMembers(ctx context.Context, cl client.Driver, dir string, members []trashMember) []trashMember {
+	var failed []trashMember
+	for _, m := range members {
+		l := log.WithFields(log.Fields{"name": m.Name, "hash": m.Hash})
+		meta, err := ioutil.ReadFile(filepath.Join(dir, trashMembersDir, strings.ToLower(m.Hash)+".torrent"))
+		if err != nil {
+			l.Errorf("Failed to read trashed metainfo: %v", err)
+			failed = append(failed, m)
+			continue
+		}
+		if err := cl.Add(ctx, m.Hash+".torrent", bytes.NewReader(meta), m.Path, m.Label, client.AddOptions{}); err != nil {
+			l.Errorf("Failed to re-add group member: %v", err)
+			failed = append(failed, m)
+		}
+	}
+	return failed
+}
+
+// Restore moves a trashed payload back to its original location and re-adds the torrent along with
+// the other members of its group
+func Restore(ctx context.Context, hash string) error {
+	rec, dir, err := findTrashEntry(hash)
+	if err != nil {
+		return err
+	}
+	cl, err := newDriver(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := cl.Close(); err != nil {
+			log.Errorf("Failed to close connection: %v", err)
+		}
+	}()
+	return restoreTrash(ctx, cl, rec, dir)
+}
+
+// restoreTrash restores the trash entry, the record is updated as it goes so a failed restore can be
+// retried from where it stopped
+func restoreTrash(ctx context.Context, cl client.Driver, rec *trashRecord, dir string) error {
+	if !rec.Restored {
+		if err := restoreTrashRoot(ctx, cl, rec, dir); err != nil {
+			return err
+		}
+	}
+	if failed := addTrashMembers(ctx, cl, dir, rec.Members); len(failed) > 0 {
+		rec.Members = failed
+		if err := writeTrashRecord(dir, rec); err != nil {
+			log.Errorf("Failed to write trash record: %v", err)
+		}
+		return errors.Errorf("%d group members failed to restore, their metainfo is kept in %s",
+			len(failed), filepath.Join(dir, trashMembersDir))
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Warnf("Failed to cleanup trash entry: %v", err)
+	}
+	log.WithFields(log.Fields{"name": rec.Name, "hash": rec.Hash}).Infof("Restored torrent from trash")
+	return nil
+}
+
+// restoreTrashRoot moves the payload back to its original location and re-adds the root of the group
+func restoreTrashRoot(ctx context.Context, cl client.Driver, rec *trashRecord, dir string) error {
+	meta, err := ioutil.ReadFile(filepath.Join(dir, trashTorrentFile))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read trashed metainfo")
+	}
+	dest := filepath.Join(rec.Path, rec.Name)
+	if rec.DataPath != dest {
+		if golib.Exists(dest) {
+			return errors.Errorf("Restore destination already exists: %s", dest)
+		}
+		if err := os.Rename(rec.DataPath, dest); err != nil {
+			return errors.Wrapf(err, "Failed to move payload out of trash")
+		}
+	}
+	if err := cl.Add(ctx, rec.Hash+".torrent", bytes.NewReader(meta), rec.Path, rec.Label, client.AddOptions{}); err != nil {
+		if rec.DataPath != dest {
+			if errMv := os.Rename(dest, rec.DataPath); errMv != nil {
+				log.Errorf("Failed to move payload back into trash: %v", errMv)
+				// The payload stays at its original location, the retry must look for it there
+				rec.DataPath = dest
+				if err := writeTrashRecord(dir, rec); err != nil {
+					log.Errorf("Failed to write trash record: %v", err)
+				}
+			}
+		}
+		return errors.Wrapf(err, "Failed to re-add torrent")
+	}
+	rec.DataPath = dest
+	rec.Restored = true
+	if err := writeTrashRecord(dir, rec); err != nil {
+		log.Errorf("Failed to write trash record: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// trashFixture adds a season pack and a cross seed of one of its episodes, sharing the packs payload
+func trashFixture(t *testing.T, fd *fakeDriver, root string) (*client.Torrent, *client.Torrent) {
+	ctx := context.Background()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "Show.S01"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "Show.S01", "e01.mkv"), make([]byte, 100), 0644))
+	require.NoError(t, fd.Add(ctx, "pack.torrent", bytes.NewReader(testMetaInfo("Show.S01", 1000)), root, "tv",
+		client.AddOptions{}))
+	require.NoError(t, fd.Add(ctx, "e01.torrent", bytes.NewReader(testMetaInfo("e01.mkv", 100)),
+		filepath.Join(root, "Show.S01"), "tv-xseed", client.AddOptions{}))
+	var pack, episode *client.Torrent
+	all, err := fd.Torrents(ctx)
+	require.NoError(t, err)
+	for _, tor := range all {
+		if tor.Name == "Show.S01" {
+			pack = tor
+		} else {
+			episode = tor
+		}
+	}
+	return pack, episode
+}
+
+func TestTrashRestore(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "seedr-trash")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(root) }()
+	prevConfig, prevDriver := config, driver
+	defer func() { config, driver = prevConfig, prevDriver }()
+	tier := &checkConfig{Path: root}
+	config = &configuration{
+		General: &generalConfig{StateDir: filepath.Join(root, "state")},
+		Trash:   &trashConfig{Enabled: true, Path: ".seedr_trash", Retention: time.Hour},
+	}
+	config.Checks = &struct {
+		Order []CheckOrder   `mapstructure:"order"`
+		Paths []*checkConfig `mapstructure:"paths"`
+	}{Paths: []*checkConfig{tier}}
+	fd := newFakeDriver()
+	driver = fd
+	pack, episode := trashFixture(t, fd, root)
+	all, err := fd.Torrents(ctx)
+	require.NoError(t, err)
+	group := groupOf(pack, all)
+	require.Len(t, group, 2)
+
+	require.NoError(t, trashTorrent(ctx, group, tier))
+	require.False(t, fd.removed[pack.Hash])
+	require.False(t, fd.removed[episode.Hash])
+	require.NoDirExists(t, filepath.Join(root, "Show.S01"))
+	rec, dir, err := findTrashEntry(pack.Hash)
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(rec.DataPath, "e01.mkv"))
+	require.Len(t, rec.Members, 1)
+	require.Equal(t, episode.Hash, rec.Members[0].Hash)
+
+	require.NoError(t, restoreTrash(ctx, fd, rec, dir))
+	require.FileExists(t, filepath.Join(root, "Show.S01", "e01.mkv"))
+	require.NoDirExists(t, dir)
+	var restored client.Torrent
+	require.NoError(t, fd.Torrent(ctx, pack.Hash, &restored))
+	require.Equal(t, root, restored.Path)
+	require.Equal(t, "tv", restored.Label)
+	require.NoError(t, fd.Torrent(ctx, episode.Hash, &restored))
+	require.Equal(t, filepath.Join(root, "Show.S01"), restored.Path)
+	require.Equal(t, "tv-xseed", restored.Label)
+
+	// A payload which cannot be moved into the trash keeps its torrent
+	require.NoError(t, os.RemoveAll(filepath.Join(root, "Show.S01")))
+	require.Error(t, trashTorrent(ctx, groupOf(pack, all), tier))
+	require.NoError(t, fd.Torrent(ctx, pack.Hash, &restored))
+	require.NoError(t, fd.Torrent(ctx, episode.Hash, &restored))
+	_, _, err = findTrashEntry(pack.Hash)
+	require.Equal(t, ErrNotInTrash, err)
+}
+
+func TestTrashRestoreRetry(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "seedr-trash")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(root) }()
+	prevConfig, prevDriver := config, driver
+	defer func() { config, driver = prevConfig, prevDriver }()
+	tier := &checkConfig{Path: root}
+	config = &configuration{
+		General: &generalConfig{StateDir: filepath.Join(root, "state")},
+		Trash:   &trashConfig{Enabled: true, Path: ".seedr_trash", Retention: time.Hour},
+	}
+	config.Checks = &struct {
+		Order []CheckOrder   `mapstructure:"order"`
+		Paths []*checkConfig `mapstructure:"paths"`
+	}{Paths: []*checkConfig{tier}}
+	fd := newFakeDriver()
+	driver = fd
+	pack, episode := trashFixture(t, fd, root)
+	all, err := fd.Torrents(ctx)
+	require.NoError(t, err)
+	require.NoError(t, trashTorrent(ctx, groupOf(pack, all), tier))
+	rec, dir, err := findTrashEntry(pack.Hash)
+	require.NoError(t, err)
+
+	// The member fails to restore after the payload and the root are back
+	memberMeta := filepath.Join(dir, trashMembersDir, strings.ToLower(episode.Hash)+".torrent")
+	meta, err := ioutil.ReadFile(memberMeta)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(memberMeta))
+	require.Error(t, restoreTrash(ctx, fd, rec, dir))
+	require.FileExists(t, filepath.Join(root, "Show.S01", "e01.mkv"))
+	var restored client.Torrent
+	require.NoError(t, fd.Torrent(ctx, pack.Hash, &restored))
+
+	// The retry picks up from the persisted record and only adds the member
+	require.NoError(t, ioutil.WriteFile(memberMeta, meta, 0644))
+	rec, dir, err = findTrashEntry(pack.Hash)
+	require.NoError(t, err)
+	require.True(t, rec.Restored)
+	require.Equal(t, filepath.Join(root, "Show.S01"), rec.DataPath)
+	require.NoError(t, restoreTrash(ctx, fd, rec, dir))
+	require.NoDirExists(t, dir)
+	require.NoError(t, fd.Torrent(ctx, episode.Hash, &restored))
+	require.Equal(t, "tv-xseed", restored.Label)
+}
+
+func TestPurgeTrash(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "seedr-purge")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(root) }()
+	prevConfig, prevDriver := config, driver
+	defer func() { config, driver = prevConfig, prevDriver }()
+	tier := &checkConfig{Path: root}
+	config = &configuration{
+		General: &generalConfig{StateDir: filepath.Join(root, "state")},
+		Trash:   &trashConfig{Enabled: true, Path: ".seedr_trash", Retention: time.Hour},
+	}
+	config.Checks = &struct {
+		Order []CheckOrder   `mapstructure:"order"`
+		Paths []*checkConfig `mapstructure:"paths"`
+	}{Paths: []*checkConfig{tier}}
+	fd := newFakeDriver()
+	driver = fd
+	var hashes []string
+	for i, name := range []string{"old.bin", "new.bin", "newest.bin"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, name), make([]byte, 100), 0644))
+		require.NoError(t, fd.Add(ctx, name+".torrent", bytes.NewReader(testMetaInfo(name, 100)), root, "",
+			client.AddOptions{}))
+		all, err := fd.Torrents(ctx)
+		require.NoError(t, err)
+		for _, tor := range all {
+			if tor.Name == name {
+				require.NoError(t, trashTorrent(ctx, torrentGroup{tor}, tier))
+				hashes = append(hashes, tor.Hash)
+			}
+		}
+		// Backdate the entries so they are ordered
+		dir := filepath.Join(trashDir(tier), strings.ToLower(hashes[i]))
+		rec, err := readTrashRecord(dir)
+		require.NoError(t, err)
+		rec.TrashedOn = time.Now().Add(-time.Duration(2-i) * time.Hour)
+		require.NoError(t, writeTrashRecord(dir, rec))
+	}
+
+	// Only the oldest is purged when it frees enough space
+	require.Equal(t, int64(100), reclaimTrash(tier, 50))
+	_, _, err = findTrashEntry(hashes[0])
+	require.Equal(t, ErrNotInTrash, err)
+
+	// The newest entry is within the retention
+	purgeTrash()
+	_, _, err = findTrashEntry(hashes[1])
+	require.Equal(t, ErrNotInTrash, err)
+	rec, _, err := findTrashEntry(hashes[2])
+	require.NoError(t, err)
+	require.FileExists(t, rec.DataPath)
+}
+
+func TestTrashKeptAfterRemoval(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "seedr-reclaim")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(root) }()
+	prevConfig, prevDriver := config, driver
+	defer func() { config, driver = prevConfig, prevDriver }()
+	tier := &checkConfig{Path: root, MinFree: 200}
+	config = &configuration{
+		General: &generalConfig{StateDir: filepath.Join(root, "state")},
+		Trash:   &trashConfig{Enabled: true, Path: ".seedr_trash", Retention: time.Hour},
+	}
+	config.Checks = &struct {
+		Order []CheckOrder   `mapstructure:"order"`
+		Paths []*checkConfig `mapstructure:"paths"`
+	}{Paths: []*checkConfig{tier}}
+	fd := newFakeDriver()
+	driver = fd
+	var torrents []*client.Torrent
+	for _, name := range []string{"old.bin", "new.bin"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, name), make([]byte, 100), 0644))
+		require.NoError(t, fd.Add(ctx, name+".torrent", bytes.NewReader(testMetaInfo(name, 100)), root, "",
+			client.AddOptions{}))
+	}
+	all, err := fd.Torrents(ctx)
+	require.NoError(t, err)
+	for _, tor := range all {
+		if tor.Name == "old.bin" {
+			require.NoError(t, trashTorrent(ctx, torrentGroup{tor}, tier))
+		} else {
+			tor.Progress = 1
+			torrents = append(torrents, tor)
+		}
+	}
+	fd.free[root] = 50
+
+	// The old trash is purged first, the torrent trashed to make up the rest is kept
+	require.NoError(t, checkMinFree(ctx, newActionBatch(), torrents, tier, 0, 1))
+	for _, tor := range all {
+		rec, _, err := findTrashEntry(tor.Hash)
+		if tor.Name == "old.bin" {
+			require.Equal(t, ErrNotInTrash, err)
+			continue
+		}
+		require.NoError(t, err)
+		require.FileExists(t, rec.DataPath)
+	}
+}
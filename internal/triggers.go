@@ -1,18 +1,35 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	"github.com/dustin/go-humanize"
 	"github.com/leighmacdonald/seedr/pkg/client"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"path/filepath"
 	"sort"
 	"time"
 )
 
-var checkFuncs = map[CheckOrder]func(torrents []*client.Torrent, cfg *checkConfig, pathCurrent int, pathTotal int) error{
+// statePollInterval is how often the client is polled while waiting on a long running operation
+var statePollInterval = time.Second * 5
+
+var checkFuncs = map[CheckOrder]func(ctx context.Context, b *actionBatch, torrents []*client.Torrent, cfg *checkConfig, pathCurrent int, pathTotal int) error{
 	MinFree:  checkMinFree,
 	MaxRatio: checkRatio,
+	Forecast: checkForecast,
+}
+
+// defaultCheckOrder is used when checks.order is not set, the forecast trigger must be listed explicitly
+var defaultCheckOrder = []CheckOrder{MinFree, MaxRatio}
+
+// checkOrder returns the checks to run in the order they run
+func checkOrder() []CheckOrder {
+	if len(config.Checks.Order) == 0 {
+		return defaultCheckOrder
+	}
+	return config.Checks.Order
 }
 
 // TODO add finished_time to status map
@@ -45,50 +62,226 @@ func removeTorrents(hashes []string, set []*client.Torrent) []*client.Torrent {
 	return s
 }
 
-func checkMinFree(torrents []*client.Torrent, cfg *checkConfig, pathCurrent int, pathTotal int) error {
+// torrentsInTier returns the torrents with a download location inside the tier path
+func torrentsInTier(torrents []*client.Torrent, cfg *checkConfig) []*client.Torrent {
+	var tier []*client.Torrent
+	for _, t := range torrents {
+		if t.Path == "" {
+			continue
+		}
+		ok, err := isSubPath(cfg.Path, t.Path)
+		if err != nil || !ok {
+			continue
+		}
+		tier = append(tier, t)
+	}
+	return tier
+}
+
+// unscheduled filters out torrents which already have a queued or active move
+func unscheduled(torrents []*client.Torrent) []*client.Torrent {
+	if !moveQueueEnabled() {
+		return torrents
+	}
+	var s []*client.Torrent
+	for _, t := range torrents {
+		if !isMoveScheduled(t.Hash) {
+			s = append(s, t)
+		}
+	}
+	return s
+}
+
+// moveTorrent moves the torrent, along with its group, to dest right away
+func moveTorrent(ctx context.Context, t *client.Torrent, dest string) error {
+	all, err := driver.Torrents(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to get torrents")
+	}
+	group := groupOf(t, all)
+	if err := arrGuardGroup(ctx, group); err != nil {
+		return err
+	}
+	return moveGroup(ctx, group, dest)
+}
+
+// movedTo returns true when the torrent is already at dest, eg: moved along with another member of
+// its group
+func movedTo(t *client.Torrent, dest string) bool {
+	return t.Path != "" && filepath.Clean(t.Path) == filepath.Clean(dest)
+}
+
+// moveGroup moves the group to dest, using the local mover when enabled. Every torrent sharing the
+// payload is moved along with it: the group is paused, the root payload moved and the other members
+// are pointed at the new location.
+func moveGroup(ctx context.Context, group torrentGroup, dest string) error {
+	root := group.root()
+	if movedTo(root, dest) {
+		return nil
+	}
+	if len(group) == 1 {
+		if moverEnabled() {
+			return localMove(ctx, root, dest)
+		}
+		return driver.Move(ctx, root.Hash, dest)
+	}
+	var paused []string
+	for _, m := range group {
+		if m.Hash != root.Hash && m.State != client.Paused {
+			paused = append(paused, m.Hash)
+		}
+	}
+	if err := driver.PauseMany(ctx, paused); err != nil {
+		return errors.Wrapf(err, "Failed to pause group members")
+	}
+	var err error
+	if moverEnabled() {
+		err = localMove(ctx, root, dest)
+	} else if err = driver.Move(ctx, root.Hash, dest); err == nil {
+		err = waitMoveComplete(ctx, root.Hash)
+	}
+	if err == nil {
+		for _, m := range group {
+			if m.Hash == root.Hash {
+				continue
+			}
+			loc, errRel := group.relocate(m, dest)
+			if errRel == nil {
+				errRel = driver.SetLocation(ctx, m.Hash, loc)
+			}
+			if errRel != nil {
+				m.Log().Errorf("Failed to update group member location: %v", errRel)
+				continue
+			}
+			m.Log().Infof("Moved along with group root %s", root.Hash)
+		}
+	}
+	for _, hash := range paused {
+		if errStart := driver.Start(ctx, hash); errStart != nil {
+			log.WithField("hash", hash).Errorf("Failed to resume group member: %v", errStart)
+		}
+	}
+	return err
+}
+
+// waitMoveComplete blocks until the client is no longer moving the torrent
+func waitMoveComplete(ctx context.Context, hash string) error {
+	return waitMovesComplete(ctx, []string{hash})
+}
+
+// removeTorrent removes the torrent and its data, or moves it into the trash when enabled. Every
+// torrent sharing the payload is removed with it, the data is only deleted along with the last
+// member, the root of the group. The last seeder protection is skipped for emergency removals. The
+// removal is done when the batch is flushed, unless the trash is used.
+func removeTorrent(ctx context.Context, b *actionBatch, t *client.Torrent, cfg *checkConfig, emergency bool, reason string) error {
+	all, err := b.torrents(ctx)
+	if err != nil {
+		return err
+	}
+	group := groupOf(t, all)
+	if err := arrGuardGroup(ctx, group); err != nil {
+		return err
+	}
+	if !emergency {
+		if err := seederGuardGroup(ctx, group); err != nil {
+			return err
+		}
+	}
+	if err := guardRemove(group); err != nil {
+		return err
+	}
+	return b.remove(ctx, group, cfg, reason)
+}
+
+// countUntilFree returns how many of the torrents, in order, need to be cleared to reach minFree. The
+// torrents freeing no space are sorted last by sortReclaimable and are never counted.
+func countUntilFree(torrents []*client.Torrent, bytesFree int64, minFree int64) int {
+	count := 0
+	for _, t := range torrents {
+		if bytesFree > minFree {
+			break
+		}
+		freed := freedBy(t)
+		if freed == 0 {
+			break
+		}
+		bytesFree += freed
+		count++
+	}
+	return count
+}
+
+func checkMinFree(ctx context.Context, b *actionBatch, torrents []*client.Torrent, cfg *checkConfig, pathCurrent int, pathTotal int) error {
 	// Last tier has special meaning, because there is nowhere else to go, this is what will trigger deletions.
 	lastTier := pathCurrent == pathTotal-1
-	bytesFree, err := driver.FreeSpace(cfg.Path)
+	bytesFree, err := freeSpace(ctx, cfg.Path)
 	if err != nil {
 		return errors.Errorf("Failed to get disk info; %v", err)
 	}
+	if err := checkFreePlausible(cfg.Path, bytesFree); err != nil {
+		tripSafety(err)
+		return err
+	}
 	var removed []string
-	var moved []string
+	// Moves already queued out of this tier will free their space once they complete
+	pending := scheduledBytesFrom(cfg.Path)
 	// Disk space related triggers should happen first as they are the bigger blocker for keeping
 	// us competitive.
-	if bytesFree < cfg.MinFree {
+	if lastTier && trashEnabled() && bytesFree+pending < cfg.MinFree {
+		// Trashed payloads are the first to go, before any torrent is removed. The torrents trashed
+		// below only free their space once a later check purges them, oldest first.
+		bytesFree += reclaimTrash(cfg, cfg.MinFree-(bytesFree+pending))
+	}
+	if bytesFree+pending < cfg.MinFree {
 		log.Debugf("Path use triggered: %v", cfg.Path)
-		// Get oldest first
+		// Get oldest first, preferring those which actually free space
 		sortAge(torrents)
+		sortReclaimable(torrents)
+		if err := checkTierLimit(cfg, countUntilFree(torrents, bytesFree+pending, cfg.MinFree), len(torrents)); err != nil {
+			tripSafety(err)
+			return err
+		}
 
 		// move to next tier if exists
 		// newFree is our expected free space after the operation completes
 		// TODO The deluge API will return right away, so we need to track in progress long operations like this
-		newFree := bytesFree
+		newFree := bytesFree + pending
+		var protected []*client.Torrent
 		for _, t := range torrents {
+			freed := freedBy(t)
+			if freed == 0 {
+				// Sorted last by sortReclaimable, none of the remaining torrents free any space
+				log.WithField("path", cfg.Path).Debugf("Remaining torrents free no space")
+				break
+			}
 			if lastTier {
-				if config.General.DryRunMode {
+				if dryRun() {
 					t.Log().Infof("[DRY] Removed torrent (disk free)")
 				} else {
-					if err := driver.Remove(t.Hash, true); err != nil {
+					if err := removeTorrent(ctx, b, t, cfg, false, "disk free"); err != nil {
+						if errors.Is(err, ErrLastSeeder) {
+							t.Log().Warnf("Skipped removal, last seeder protection: %v", err)
+							protected = append(protected, t)
+							continue
+						}
 						t.Log().Errorf("Failed to delete torrent (disk used): %v", err)
 						continue
 					}
-					t.Log().Infof("Removed torrent (disk free)")
 				}
 			} else {
-				if config.General.DryRunMode {
+				dest := config.Checks.Paths[pathCurrent+1].Path
+				if dryRun() {
 					t.Log().Infof("[DRY] Moved torrent to next storage tier (disk free)")
+				} else if moveQueueEnabled() {
+					scheduleMove(t, dest, true)
 				} else {
-					if err := driver.Move(t.Hash, config.Checks.Paths[pathCurrent+1].Path); err != nil {
+					if err := b.move(ctx, t, dest, "disk free"); err != nil {
 						t.Log().Errorf("Failed to move torrent to next tier: %v", err)
 						continue
 					}
-					t.Log().Infof("Moved torrent to next storage tier (disk free)")
 				}
-				moved = append(moved, t.Hash)
 			}
-			newFree += t.Size
+			newFree += freed
 			removed = append(removed, t.Hash)
 			if newFree > cfg.MinFree {
 				log.WithFields(log.Fields{
@@ -98,57 +291,95 @@ func checkMinFree(torrents []*client.Torrent, cfg *checkConfig, pathCurrent int,
 				break
 			}
 		}
-	}
-	// Wait for torrents that are moving to complete before continuing
-	for len(moved) > 0 {
-		for _, hash := range moved {
-			var torrent client.Torrent
-			if err := driver.Torrent(hash, &torrent); err != nil {
-				log.Errorf("Failed to get moved torrent state: %v", err)
-			} else {
-				if torrent.State != client.Moving {
-					moved = removeString(moved, hash)
-					torrent.Log().Infof("Mmove operation completed")
-				} else {
-					torrent.Log().Infof("Waiting for move operation")
-				}
-			}
+		if newFree <= cfg.MinFree && len(protected) > 0 && lastSeederEmergency() {
+			newFree = removeProtected(ctx, b, protected, cfg, bytesFree, newFree)
 		}
-		time.Sleep(time.Second * 5)
 	}
+	// Wait for torrents that are moving to complete before continuing
+	b.flush(ctx, true)
 	torrents = removeTorrents(removed, torrents)
 	return nil
 }
 
-func checkRatio(torrents []*client.Torrent, cfg *checkConfig, pathCurrent int, pathTotal int) error {
+// removeProtected is the min_free emergency escalation. It removes torrents skipped by the last seeder
+// protection, those with the most other seeders first, until enough space is free. The expected free
+// space afterwards is returned.
+func removeProtected(ctx context.Context, b *actionBatch, protected []*client.Torrent, cfg *checkConfig, bytesFree int64, newFree int64) int64 {
+	notify("last_seeder_emergency", "Free space on %s is below %s with only protected torrents left, removing up to %d",
+		cfg.Path, humanize.Bytes(uint64(cfg.MinFree)), len(protected))
+	seeders := make(map[string]int, len(protected))
+	for _, t := range protected {
+		seeders[t.Hash] = otherSeeders(ctx, t)
+	}
+	sort.SliceStable(protected, func(i, j int) bool {
+		return seeders[protected[i].Hash] > seeders[protected[j].Hash]
+	})
+	for _, t := range protected {
+		freed := freedBy(t)
+		if freed == 0 {
+			continue
+		}
+		if err := removeTorrent(ctx, b, t, cfg, true, "disk free emergency"); err != nil {
+			t.Log().Errorf("Failed to delete protected torrent (disk used): %v", err)
+			continue
+		}
+		t.Log().WithField("seeders", seeders[t.Hash]).Warnf("Removing protected torrent (disk free emergency)")
+		newFree += freed
+		if newFree > cfg.MinFree {
+			log.WithFields(log.Fields{
+				"cleared": humanize.Bytes(uint64(newFree - bytesFree)),
+				"free":    humanize.Bytes(uint64(newFree)),
+			}).Info("Free space threshold met")
+			break
+		}
+	}
+	return newFree
+}
+
+func checkRatio(ctx context.Context, b *actionBatch, torrents []*client.Torrent, cfg *checkConfig, pathCurrent int, pathTotal int) error {
 	// Last tier has special meaning, because there is nowhere else to go, this is what will trigger deletions.
 	lastTier := pathCurrent == pathTotal-1
 	var removed []string
 	if cfg.MaxRatio > -1 {
 		sortRatio(torrents)
+		affected := 0
+		for _, t := range torrents {
+			if t.Ratio > cfg.MaxRatio {
+				affected++
+			}
+		}
+		if err := checkTierLimit(cfg, affected, len(torrents)); err != nil {
+			tripSafety(err)
+			return err
+		}
 		for _, t := range torrents {
 			if t.Ratio > cfg.MaxRatio {
 				l := log.WithFields(log.Fields{"name": t.Name, "ratio": fmt.Sprintf("%.2f", t.Ratio), "hash": t.Hash})
 				if lastTier {
-					if config.General.DryRunMode {
+					if dryRun() {
 						l.Infof("[DRY] Removed torrent (ratio): %s ratio: %f", t.Name, t.Ratio)
 					} else {
-						if err := driver.Remove(t.Hash, true); err != nil {
+						if err := removeTorrent(ctx, b, t, cfg, false, "ratio"); err != nil {
+							if errors.Is(err, ErrLastSeeder) {
+								l.Warnf("Skipped removal, last seeder protection: %v", err)
+								continue
+							}
 							l.Errorf("Failed to delete torrent (ratio): %v", err)
 							continue
 						}
-						l.Infof("Removed torrent from last available tier")
 					}
 
 				} else {
-					if config.General.DryRunMode {
+					dest := config.Checks.Paths[pathCurrent+1].Path
+					if dryRun() {
 						l.Infof("[DRY] Move torrent to lower storage tier")
+					} else if moveQueueEnabled() {
+						scheduleMove(t, dest, false)
 					} else {
-						if err := driver.Move(t.Hash, config.Checks.Paths[pathCurrent+1].Path); err != nil {
-							l.Errorf("Failed to move torrent to next tier")
+						if err := b.move(ctx, t, dest, "ratio"); err != nil {
+							l.Errorf("Failed to move torrent to next tier: %v", err)
 							continue
 						}
-						l.Infof("Moved torrent to lower storage tier")
 					}
 				}
 				removed = append(removed, t.Hash)
@@ -159,12 +390,20 @@ func checkRatio(torrents []*client.Torrent, cfg *checkConfig, pathCurrent int, p
 	return nil
 }
 
-func checkStatus(torrents []*client.Torrent) {
+// checkStatus runs every check against every tier. The actions of each check are batched and applied
+// before the next check runs.
+func checkStatus(ctx context.Context, torrents []*client.Torrent) {
 	checkConfigs := checksByPriority()
-	for checkName, checkFn := range checkFuncs {
+	safety.beginTick()
+	b := newActionBatch()
+	for _, checkName := range checkOrder() {
+		checkFn := checkFuncs[checkName]
 		for i, pc := range checkConfigs {
 			log.Debugf("Perfoming check: %s", checkName)
-			if err := checkFn(torrents, pc, i, len(checkConfigs)); err != nil {
+			units := groupUnits(unscheduled(torrentsInTier(torrents, pc)))
+			err := checkFn(ctx, b, units, pc, i, len(checkConfigs))
+			b.flush(ctx, false)
+			if err != nil {
 				log.Errorf("Failed to perform check func: %v", err)
 				return
 			}
@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/leighmacdonald/golib"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	watchAddedDir  = "added"
+	watchFailedDir = "failed"
+	// watchSettle is how long a file must be unmodified before it is picked up so that we do not
+	// read files that are still being written
+	watchSettle = time.Second * 2
+)
+
+// watchConfig defines the directories scanned for new .torrent files. Files in a subdirectory of a
+// watch dir are added with the subdirectory name as their label.
+type watchConfig struct {
+	Enabled bool     `mapstructure:"enabled"`
+	Dirs    []string `mapstructure:"dirs"`
+	// PollIntervalStr is how often the dirs are rescanned, this is the only way new files are found
+	// when inotify is unavailable
+	PollIntervalStr string `mapstructure:"poll_interval"`
+	PollInterval    time.Duration
+}
+
+func watchEnabled() bool {
+	return config.Watch != nil && config.Watch.Enabled
+}
+
+// watchLabel returns the label for a file found in the watch dir root
+func watchLabel(root string, file string) string {
+	rel, err := filepath.Rel(root, filepath.Dir(file))
+	if err != nil || rel == "." {
+		return ""
+	}
+	return strings.Split(rel, string(os.PathSeparator))[0]
+}
+
+// watchDest returns a path in dir for the file that does not overwrite anything already there
+func watchDest(dir string, name string) string {
+	p := filepath.Join(dir, name)
+	if !golib.Exists(p) {
+		return p
+	}
+	ext := filepath.Ext(name)
+	return filepath.Join(dir, fmt.Sprintf("%s.%d%s", strings.TrimSuffix(name, ext), time.Now().UnixNano(), ext))
+}
+
+// processWatchFile adds the torrent and moves it into the added or failed dir, failures get a
+// sidecar file with the error message
+func processWatchFile(ctx context.Context, root string, file string) {
+	label := watchLabel(root, file)
+	l := log.WithFields(log.Fields{"file": file, "label": label})
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		err = addTorrent(ctx, filepath.Base(file), data, label)
+	}
+	destDir := filepath.Join(root, watchAddedDir)
+	if err != nil {
+		destDir = filepath.Join(root, watchFailedDir)
+	}
+	if errDir := os.MkdirAll(destDir, 0755); errDir != nil {
+		l.Errorf("Failed to create dir: %v", errDir)
+		return
+	}
+	dest := watchDest(destDir, filepath.Base(file))
+	if errMv := os.Rename(file, dest); errMv != nil {
+		l.Errorf("Failed to move watched file: %v", errMv)
+		return
+	}
+	if err != nil {
+		l.Errorf("Failed to add watched torrent: %v", err)
+		if errW := ioutil.WriteFile(dest+".error", []byte(err.Error()+"\n"), 0644); errW != nil {
+			l.Errorf("Failed to write error file: %v", errW)
+		}
+		return
+	}
+	l.Infof("Added watched torrent")
+}
+
+// isLabelDir returns true for the direct subdirectories of a watch dir, other than the added and failed
+// dirs, which are used as labels
+func isLabelDir(p string) bool {
+	name := filepath.Base(p)
+	if name == watchAddedDir || name == watchFailedDir {
+		return false
+	}
+	for _, dir := range config.Watch.Dirs {
+		if filepath.Clean(filepath.Dir(p)) == filepath.Clean(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanWatchDir processes all settled .torrent files in the root and its label subdirectories
+func scanWatchDir(ctx context.Context, root string) {
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if p != root && !isLabelDir(p) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.EqualFold(filepath.Ext(p), ".torrent") || time.Since(info.ModTime()) < watchSettle {
+			return nil
+		}
+		processWatchFile(ctx, root, p)
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Failed to scan watch dir %s: %v", root, err)
+	}
+}
+
+func scanWatchDirs(ctx context.Context) {
+	for _, dir := range config.Watch.Dirs {
+		scanWatchDir(ctx, dir)
+	}
+}
+
+// newWatcher sets up inotify on the watch dirs and their label subdirectories
+func newWatcher() (*fsnotify.Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range config.Watch.Dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			_ = w.Close()
+			return nil, err
+		}
+		if err := w.Add(dir); err != nil {
+			_ = w.Close()
+			return nil, errors.Wrapf(err, "Failed to watch %s", dir)
+		}
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			_ = w.Close()
+			return nil, err
+		}
+		for _, info := range infos {
+			if info.IsDir() && isLabelDir(filepath.Join(dir, info.Name())) {
+				if err := w.Add(filepath.Join(dir, info.Name())); err != nil {
+					_ = w.Close()
+					return nil, errors.Wrapf(err, "Failed to watch %s", info.Name())
+				}
+			}
+		}
+	}
+	return w, nil
+}
+
+func watchWorker(ctx context.Context) {
+	// Both stay nil when polling so their cases never fire
+	var events chan fsnotify.Event
+	var errs chan error
+	w, err := newWatcher()
+	if err != nil {
+		log.Warnf("Inotify unavailable, falling back to polling watch dirs: %v", err)
+	} else {
+		events = w.Events
+		errs = w.Errors
+		defer func() {
+			if err := w.Close(); err != nil {
+				log.Errorf("Failed to close watcher: %v", err)
+			}
+		}()
+	}
+	scanWatchDirs(ctx)
+	poll := time.NewTicker(config.Watch.PollInterval)
+	settle := time.NewTimer(watchSettle)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(ev.Name); err == nil && info.IsDir() && isLabelDir(ev.Name) {
+					if err := w.Add(ev.Name); err != nil {
+						log.Errorf("Failed to watch %s: %v", ev.Name, err)
+					}
+				}
+			}
+			// Wait for writes to stop before scanning
+			settle.Reset(watchSettle + time.Millisecond*100)
+		case err := <-errs:
+			// The watcher stops sending events until its errors are read, eg: after the event queue
+			// overflowed, and events may have been lost so the dirs are scanned
+			log.Errorf("Watcher error: %v", err)
+			scanWatchDirs(ctx)
+		case <-settle.C:
+			scanWatchDirs(ctx)
+		case <-poll.C:
+			scanWatchDirs(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func startWatch(ctx context.Context) {
+	if !watchEnabled() {
+		return
+	}
+	log.Debugf("Watching %d dirs for torrent files", len(config.Watch.Dirs))
+	go watchWorker(ctx)
+}
@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchDir(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "seedr-watch")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(root) }()
+	prev := config
+	config = &configuration{Watch: &watchConfig{Dirs: []string{root}}}
+	defer func() { config = prev }()
+
+	require.Equal(t, "", watchLabel(root, filepath.Join(root, "a.torrent")))
+	require.Equal(t, "tv", watchLabel(root, filepath.Join(root, "tv", "a.torrent")))
+	require.True(t, isLabelDir(filepath.Join(root, "tv")))
+	require.False(t, isLabelDir(filepath.Join(root, watchFailedDir)))
+	require.False(t, isLabelDir(filepath.Join(root, "tv", "nested")))
+
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "tv"), 0755))
+	bad := filepath.Join(root, "tv", "bad.torrent")
+	require.NoError(t, ioutil.WriteFile(bad, []byte("not a torrent"), 0644))
+	old := time.Now().Add(-time.Minute)
+	require.NoError(t, os.Chtimes(bad, old, old))
+	scanWatchDir(ctx, root)
+
+	failed := filepath.Join(root, watchFailedDir, "bad.torrent")
+	require.FileExists(t, failed)
+	require.FileExists(t, failed+".error")
+	require.NoFileExists(t, bad)
+}
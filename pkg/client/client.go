@@ -1,10 +1,15 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
@@ -17,6 +22,8 @@ var (
 	ErrDuplicateDriver = errors.New("Duplicate driver name")
 	ErrAuthFailed      = errors.New("Authentication failed")
 	ErrDriverError     = errors.New("Backend driver error")
+	ErrUnsupported     = errors.New("Unsupported operation")
+	ErrInvalidConfig   = errors.New("Invalid client configuration")
 )
 
 type State int
@@ -35,6 +42,33 @@ const (
 	Any
 )
 
+func (s State) String() string {
+	switch s {
+	case Active:
+		return "active"
+	case Allocating:
+		return "allocating"
+	case Checking:
+		return "checking"
+	case Downloading:
+		return "downloading"
+	case Seeding:
+		return "seeding"
+	case Paused:
+		return "paused"
+	case Error:
+		return "error"
+	case Queued:
+		return "queued"
+	case Moving:
+		return "moving"
+	case Any:
+		return "any"
+	default:
+		return "unknown"
+	}
+}
+
 type QueuePos int
 
 const (
@@ -44,26 +78,277 @@ const (
 	Bottom
 )
 
+// FilePriority is the download priority of a single file within a torrent
+type FilePriority int
+
+const (
+	// PrioritySkip excludes the file from being downloaded
+	PrioritySkip FilePriority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+func (p FilePriority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// File is a single file within a torrent
+type File struct {
+	// Index is the position of the file within the torrent, it is used to address the file when
+	// setting its priority
+	Index int
+	// Path is relative to the torrents download location
+	Path string
+	Size int64
+	// Progress is the completed fraction of the file, 0.0-1.0
+	Progress float64
+	Priority FilePriority
+}
+
+// Capability is an optional feature of a client. Methods depending on a capability the client does
+// not have return ErrUnsupported.
+type Capability int
+
+const (
+	// CapQueue is changing the queue position of torrents with Queue
+	CapQueue Capability = iota
+	// CapLabels is applying the label passed to Add
+	CapLabels
+	// CapVerify is rechecking the data of torrents with Verify
+	CapVerify
+	// CapMoveData is Move and MoveMany moving the data along with the torrent
+	CapMoveData
+	// CapFreeSpace is FreeSpace reporting the free space of any path on the clients host
+	CapFreeSpace
+	// CapEvents is the client pushing torrent state changes instead of only being polled
+	CapEvents
+	// CapFilePriorities is reading and setting the priority of single files
+	CapFilePriorities
+	// CapAnnounce is forcing a reannounce with Announce
+	CapAnnounce
+	// CapSetLocation is SetLocation pointing the torrent at a payload already in place without
+	// moving or replacing any of its files, the local mover relies on it
+	CapSetLocation
+	// CapSessionLimits is SetSessionSettings applying the active torrent and global connection limits
+	CapSessionLimits
+)
+
+// AllCapabilities lists every known capability
+var AllCapabilities = []Capability{CapQueue, CapLabels, CapVerify, CapMoveData, CapFreeSpace, CapEvents,
+	CapFilePriorities, CapAnnounce, CapSetLocation, CapSessionLimits}
+
+func (c Capability) String() string {
+	switch c {
+	case CapQueue:
+		return "queue"
+	case CapLabels:
+		return "labels"
+	case CapVerify:
+		return "verify"
+	case CapMoveData:
+		return "move data"
+	case CapFreeSpace:
+		return "free space by path"
+	case CapEvents:
+		return "events"
+	case CapFilePriorities:
+		return "file priorities"
+	case CapAnnounce:
+		return "announce"
+	case CapSetLocation:
+		return "set location"
+	case CapSessionLimits:
+		return "session limits"
+	default:
+		return "unknown"
+	}
+}
+
+// Capabilities is the set of optional features supported by a client
+type Capabilities uint
+
+func NewCapabilities(caps ...Capability) Capabilities {
+	var c Capabilities
+	for _, cp := range caps {
+		c |= 1 << uint(cp)
+	}
+	return c
+}
+
+// Has returns true when every one of the capabilities is in the set
+func (c Capabilities) Has(caps ...Capability) bool {
+	for _, cp := range caps {
+		if c&(1<<uint(cp)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Missing returns the known capabilities that are not in the set
+func (c Capabilities) Missing() []Capability {
+	var missing []Capability
+	for _, cp := range AllCapabilities {
+		if !c.Has(cp) {
+			missing = append(missing, cp)
+		}
+	}
+	return missing
+}
+
+func (c Capabilities) String() string {
+	var names []string
+	for _, cp := range AllCapabilities {
+		if c.Has(cp) {
+			names = append(names, cp.String())
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+type TrackerStatus int
+
+const (
+	TrackerUnknown TrackerStatus = iota
+	TrackerDisabled
+	TrackerNotContacted
+	TrackerWorking
+	TrackerUpdating
+	TrackerError
+)
+
+func (s TrackerStatus) String() string {
+	switch s {
+	case TrackerDisabled:
+		return "disabled"
+	case TrackerNotContacted:
+		return "not contacted"
+	case TrackerWorking:
+		return "working"
+	case TrackerUpdating:
+		return "updating"
+	case TrackerError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Tracker is the announce state of a single tracker of a torrent
+type Tracker struct {
+	URL     string
+	Tier    int
+	Status  TrackerStatus
+	Message string
+	// Seeders and Leechers are the swarm counts last reported by the tracker, -1 when unknown
+	Seeders  int
+	Leechers int
+	// NextAnnounce is zero when the client does not report it
+	NextAnnounce time.Time
+}
+
+// Peer is a single connected peer of a torrent
+type Peer struct {
+	// Address is the ip:port of the peer
+	Address string
+	Client  string
+	// Progress is the fraction of the torrent the peer has, 0.0-1.0
+	Progress float64
+	// SpeedUP is the rate we are uploading to the peer in bytes/sec
+	SpeedUP int64
+	// SpeedDN is the rate we are downloading from the peer in bytes/sec
+	SpeedDN int64
+}
+
+// SessionSettings are the global transfer settings of the client. Rates are in bytes/sec and a zero
+// value for any of the settings means unlimited. Fields left nil are not changed by SetSessionSettings
+// and are nil when read if the client has no such setting.
+type SessionSettings struct {
+	UploadLimit              *int64
+	DownloadLimit            *int64
+	MaxActiveDownloads       *int
+	MaxActiveSeeding         *int
+	MaxConnections           *int
+	MaxConnectionsPerTorrent *int
+}
+
+// AddOptions are the optional settings used when adding a torrent
+type AddOptions struct {
+	// Paused adds the torrent without starting it so the client does not touch the data until it is
+	// started
+	Paused bool
+}
+
 // Driver defines our common interface for interacting with the backend torrent clients
 type Driver interface {
-	Add(filename string, torrent io.Reader, path string, label string) error
-	Announce(hash string) error
-	ClientVersion() (string, error)
+	Add(ctx context.Context, filename string, torrent io.Reader, path string, label string, opts AddOptions) error
+	Announce(ctx context.Context, hash string) error
+	// Capabilities returns the optional features supported by the client
+	Capabilities() Capabilities
+	ClientVersion(ctx context.Context) (string, error)
 	Close() error
-	FreeSpace(path string) (int64, error)
-	Login() error
-	Move(hash string, dest string) error
-	Pause(hash string) error
-	PauseAll() error
-	Queue(hash string, position QueuePos) error
-	Remove(hash string, deleteData bool) error
-	Start(hash string) error
-	StartAll() error
-	Stop(hash string) error
-	Torrent(hash string, torrent *Torrent) error
-	Torrents() ([]*Torrent, error)
-	TorrentsWithState(statuses ...State) ([]*Torrent, error)
-	Verify(hash string) error
+	// Export returns the raw bencoded .torrent metainfo for the torrent
+	Export(ctx context.Context, hash string) ([]byte, error)
+	// Files returns the files of the torrent ordered by their index
+	Files(ctx context.Context, hash string) ([]File, error)
+	FreeSpace(ctx context.Context, path string) (int64, error)
+	Login(ctx context.Context) error
+	Move(ctx context.Context, hash string, dest string) error
+	// MoveMany moves the data of every torrent to dest using as few calls as the client allows
+	MoveMany(ctx context.Context, hashes []string, dest string) error
+	Pause(ctx context.Context, hash string) error
+	PauseAll(ctx context.Context) error
+	// PauseMany pauses every torrent using as few calls as the client allows
+	PauseMany(ctx context.Context, hashes []string) error
+	// Peers returns the currently connected peers of the torrent
+	Peers(ctx context.Context, hash string) ([]Peer, error)
+	Queue(ctx context.Context, hash string, position QueuePos) error
+	Remove(ctx context.Context, hash string, deleteData bool) error
+	// RemoveMany removes every torrent using as few calls as the client allows. Hashes unknown to the
+	// client are ignored.
+	RemoveMany(ctx context.Context, hashes []string, deleteData bool) error
+	SetFilePriority(ctx context.Context, hash string, index int, priority FilePriority) error
+	SessionSettings(ctx context.Context) (*SessionSettings, error)
+	// SetSessionSettings updates the non nil settings. ErrUnsupported is returned without changing
+	// anything when a setting the client does not have is set.
+	SetSessionSettings(ctx context.Context, settings *SessionSettings) error
+	// SetLimits sets the upload and download rate limits of a single torrent in bytes/sec, 0 is unlimited
+	SetLimits(ctx context.Context, hash string, upload int64, download int64) error
+	// SetLocation points the client at a new download location without moving any data
+	SetLocation(ctx context.Context, hash string, dest string) error
+	Start(ctx context.Context, hash string) error
+	StartAll(ctx context.Context) error
+	Stop(ctx context.Context, hash string) error
+	Torrent(ctx context.Context, hash string, torrent *Torrent) error
+	Torrents(ctx context.Context) ([]*Torrent, error)
+	TorrentsWithState(ctx context.Context, statuses ...State) ([]*Torrent, error)
+	// TorrentsByHash returns the torrents keyed by their hash, hashes unknown to the client are left out
+	TorrentsByHash(ctx context.Context, hashes []string) (map[string]*Torrent, error)
+	// Trackers returns the state of each tracker of the torrent
+	Trackers(ctx context.Context, hash string) ([]Tracker, error)
+	Verify(ctx context.Context, hash string) error
+}
+
+// Stateless is implemented by drivers whose calls are independent HTTP requests. They have no connection
+// to tear down, reconnecting only needs a new Login.
+type Stateless interface {
+	Stateless() bool
+}
+
+// isStateless returns true when the driver is a Stateless driver reporting itself as such
+func isStateless(d Driver) bool {
+	s, ok := d.(Stateless)
+	return ok && s.Stateless()
 }
 
 type DriverFactory interface {
@@ -74,9 +359,35 @@ type Config struct {
 	Driver   string `mapstructure:"driver"`
 	Username string `mapstructure:"user"`
 	Password string `mapstructure:"password"`
-	Host     string `mapstructure:"host"`
-	Port     uint16 `mapstructure:"port"`
-	TLS      bool   `mapstructure:"tls"`
+	// PasswordFile and PasswordEnv are alternatives to Password, see LoadCredentials
+	PasswordFile string `mapstructure:"password_file"`
+	PasswordEnv  string `mapstructure:"password_env"`
+	Host         string `mapstructure:"host"`
+	Port         uint16 `mapstructure:"port"`
+	// Socket is the path of a unix socket used instead of the host and port, only rtorrent SCGI supports it
+	Socket string `mapstructure:"socket"`
+	TLS    bool   `mapstructure:"tls"`
+	// CAFile is a PEM bundle used to verify the clients certificate instead of the system roots
+	CAFile string `mapstructure:"ca_file"`
+	// CertFile and KeyFile are the PEM client certificate and key presented to the client
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// InsecureSkipVerify accepts any certificate presented by the client
+	InsecureSkipVerify bool `mapstructure:"insecure_skip_verify"`
+	// BasePath is prepended to the paths of HTTP based clients, eg: a WebUI reverse proxied under /qbittorrent
+	BasePath string `mapstructure:"base_path"`
+	// BasicAuthUser and BasicAuthPassword are sent with every request of HTTP based clients, eg: for a
+	// reverse proxy requiring authentication
+	BasicAuthUser         string `mapstructure:"basic_auth_user"`
+	BasicAuthPassword     string `mapstructure:"basic_auth_password"`
+	BasicAuthPasswordFile string `mapstructure:"basic_auth_password_file"`
+	BasicAuthPasswordEnv  string `mapstructure:"basic_auth_password_env"`
+	// TimeoutStr bounds each call to the client, defaults to 30s
+	TimeoutStr string `mapstructure:"timeout"`
+	Timeout    time.Duration
+	// StateDir is the clients own state directory holding the <hash>.torrent files it has loaded. This is
+	// used as a fallback for exporting metainfo when the client does not provide a method itself.
+	StateDir string `mapstructure:"state_dir"`
 }
 
 // Torrent is a common data container for the backend Driver
@@ -97,14 +408,33 @@ type Torrent struct {
 	SpeedDN    int64
 	Uploaded   int64
 	Downloaded int64
-	StatusMsg  string
-	State      State
+	// Progress is the completed fraction of the wanted data, 0.0-1.0
+	Progress  float64
+	StatusMsg string
+	State     State
 }
 
 func (t *Torrent) Log() *log.Entry {
 	return log.WithFields(log.Fields{"name": t.Name, "ratio": fmt.Sprintf("%.2f", t.Ratio), "hash": t.Hash})
 }
 
+// ReadStateFile will read the <hash>.torrent file from the clients state directory
+func ReadStateFile(stateDir string, hash string) ([]byte, error) {
+	if stateDir == "" {
+		return nil, errors.Wrapf(ErrUnsupported, "No state_dir configured")
+	}
+	for _, name := range []string{strings.ToLower(hash), strings.ToUpper(hash)} {
+		b, err := ioutil.ReadFile(filepath.Join(stateDir, name+".torrent"))
+		if err == nil {
+			return b, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, ErrUnknownTorrent
+}
+
 func New(cfg *Config) (Driver, error) {
 	driversMu.RLock()
 	defer driversMu.RUnlock()
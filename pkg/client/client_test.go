@@ -0,0 +1,19 @@
+package client
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	caps := NewCapabilities(CapQueue, CapMoveData)
+	require.True(t, caps.Has(CapQueue))
+	require.True(t, caps.Has(CapQueue, CapMoveData))
+	require.False(t, caps.Has(CapQueue, CapLabels))
+	require.False(t, NewCapabilities().Has(CapQueue))
+	require.Equal(t, "queue, move data", caps.String())
+	missing := caps.Missing()
+	require.Len(t, missing, len(AllCapabilities)-2)
+	require.NotContains(t, missing, CapQueue)
+	require.Contains(t, missing, CapEvents)
+}
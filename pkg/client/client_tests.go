@@ -1,9 +1,11 @@
 package client
 
 import (
+	"context"
 	"github.com/anacrolix/torrent/bencode"
 	"github.com/anacrolix/torrent/metainfo"
 	"github.com/leighmacdonald/golib"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 	"io/ioutil"
@@ -87,14 +89,62 @@ func generateTorrent() (string, string) {
 }
 
 func DriverTestSuite(t *testing.T, driver Driver) {
+	ctx := context.Background()
 	testBinFile, testTorrentFile := generateTorrent()
 	defer func() {
 		_ = os.Remove(testTorrentFile)
 		_ = os.Remove(testBinFile)
 	}()
 	filename := filepath.Base(testTorrentFile)
-	require.NoErrorf(t, driver.Login(), "Failed to login")
+	require.NoErrorf(t, driver.Login(ctx), "Failed to login")
 	fp, err := os.Open(testTorrentFile)
 	require.NoError(t, err, "Failed to open test torrent")
-	require.NoError(t, driver.Add(filename, fp, "/downloads", "test"))
+	require.NoError(t, driver.Add(ctx, filename, fp, "/downloads", "test", AddOptions{}))
+	mi, err := metainfo.LoadFromFile(testTorrentFile)
+	require.NoError(t, err, "Failed to load test torrent")
+	hash := mi.HashInfoBytes().HexString()
+	trackers, err := driver.Trackers(ctx, hash)
+	require.NoError(t, err, "Failed to get trackers")
+	for _, tr := range trackers {
+		require.NotEmpty(t, tr.URL)
+	}
+	_, err = driver.Peers(ctx, hash)
+	require.NoError(t, err, "Failed to get peers")
+	byHash, err := driver.TorrentsByHash(ctx, []string{hash, strings.Repeat("0", len(hash))})
+	require.NoError(t, err, "Failed to get torrents by hash")
+	require.Len(t, byHash, 1, "Unknown hashes should be left out")
+	require.Equal(t, hash, byHash[hash].Hash)
+	require.NoError(t, driver.PauseMany(ctx, []string{hash}), "Failed to pause torrents")
+	if err := driver.SetLimits(ctx, hash, 1024*1024, 0); err != ErrUnsupported {
+		require.NoError(t, err, "Failed to set torrent limits")
+	}
+	if settings, err := driver.SessionSettings(ctx); err != ErrUnsupported {
+		require.NoError(t, err, "Failed to get session settings")
+		require.NoError(t, driver.SetSessionSettings(ctx, &SessionSettings{UploadLimit: settings.UploadLimit}))
+	}
+	caps := driver.Capabilities()
+	for c, fn := range map[Capability]func() error{
+		CapVerify:   func() error { return driver.Verify(ctx, hash) },
+		CapAnnounce: func() error { return driver.Announce(ctx, hash) },
+		CapQueue:    func() error { return driver.Queue(ctx, hash, Top) },
+	} {
+		if caps.Has(c) {
+			require.NoErrorf(t, fn(), "Failed to %s", c)
+		} else {
+			require.Truef(t, errors.Is(fn(), ErrUnsupported), "Unsupported %s should return ErrUnsupported", c)
+		}
+	}
+	files, err := driver.Files(ctx, hash)
+	require.NoError(t, err, "Failed to get files")
+	require.Len(t, files, 1)
+	require.Equal(t, int64(10000), files[0].Size)
+	require.Equal(t, 0, files[0].Index)
+	err = driver.SetFilePriority(ctx, hash, files[0].Index, PriorityHigh)
+	if err == ErrUnsupported {
+		return
+	}
+	require.NoError(t, err, "Failed to set file priority")
+	files, err = driver.Files(ctx, hash)
+	require.NoError(t, err, "Failed to get files")
+	require.Equal(t, PriorityHigh, files[0].Priority)
 }
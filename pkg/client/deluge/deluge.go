@@ -1,15 +1,18 @@
 package deluge
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	deluge "github.com/gdm85/go-libdeluge"
+	"github.com/gdm85/go-rencode"
 	"github.com/leighmacdonald/seedr/pkg/client"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"io/ioutil"
 	"strings"
+	"time"
 )
 
 const driverName = "deluge"
@@ -42,10 +45,119 @@ func mapStates(states ...client.State) []deluge.TorrentState {
 	return dStates
 }
 
+// queueMethods maps the queue positions to their core.queue_* call
+var queueMethods = map[client.QueuePos]string{
+	client.Top:    "core.queue_top",
+	client.Up:     "core.queue_up",
+	client.Down:   "core.queue_down",
+	client.Bottom: "core.queue_bottom",
+}
+
+// statusKeys are the status keys decoded into the library TorrentStatus
+var statusKeys = []string{
+	"state", "tracker_host", "tracker_status", "next_announce", "name", "total_size", "progress",
+	"num_seeds", "total_seeds", "num_peers", "total_peers", "eta", "download_payload_rate",
+	"upload_payload_rate", "ratio", "distributed_copies", "num_pieces", "piece_length", "total_done",
+	"files", "file_priorities", "file_progress", "peers", "is_seed", "is_finished", "active_time",
+	"seeding_time", "time_added", "completed_time", "download_location", "private",
+}
+
+// extraKeys are the status keys the library does not include in its TorrentStatus. The label key is
+// only present when the label plugin is enabled.
+var extraKeys = []string{"label", "total_uploaded", "message"}
+
+// statusRequest returns every status key requested for a torrent
+func statusRequest() rencode.List {
+	var keys rencode.List
+	for _, k := range statusKeys {
+		keys.Add(k)
+	}
+	for _, k := range extraKeys {
+		keys.Add(k)
+	}
+	return keys
+}
+
+// hashList converts the hashes into the list of torrent ids taken by the core calls
+func hashList(hashes []string) rencode.List {
+	var ids rencode.List
+	for _, h := range hashes {
+		ids.Add(h)
+	}
+	return ids
+}
+
+// decodeStatus reads the status values of a torrent into the library type and returns the values
+// so the extraKeys can be read. The daemon returns no values for unknown torrents.
+func decodeStatus(v interface{}) (*deluge.TorrentStatus, map[string]interface{}, error) {
+	values, err := toMap(v)
+	if err != nil {
+		return nil, nil, errors.Wrapf(client.ErrDriverError, "Failed to read torrent status: %v", err)
+	}
+	if len(values) == 0 {
+		return nil, nil, client.ErrUnknownTorrent
+	}
+	// The library rejects any key that is not a field of the struct
+	var known rencode.Dictionary
+	for _, k := range statusKeys {
+		if value, found := values[k]; found {
+			known.Add(k, value)
+		}
+	}
+	var status deluge.TorrentStatus
+	if err := known.ToStruct(&status, ""); err != nil {
+		return nil, nil, errors.Wrapf(client.ErrDriverError, "Failed to read torrent status: %v", err)
+	}
+	return &status, values, nil
+}
+
 func mapTorrentStatus(status *deluge.TorrentStatus, torrent *client.Torrent) {
 	torrent.Name = status.Name
+	torrent.Path = status.DownloadLocation
 	torrent.Size = status.TotalSize
 	torrent.Ratio = float64(status.Ratio)
+	torrent.Progress = float64(status.Progress) / 100
+	torrent.Tracker = status.TrackerHost
+	torrent.Seeds = int(status.NumSeeds)
+	torrent.Peers = int(status.NumPeers)
+	torrent.SpeedUP = status.UploadPayloadRate
+	torrent.SpeedDN = status.DownloadPayloadRate
+	torrent.Downloaded = status.TotalDone
+	torrent.SeedTime = time.Duration(status.SeedingTime) * time.Second
+	if status.TimeAdded > 0 {
+		torrent.AddedOn = time.Unix(int64(status.TimeAdded), 0)
+	}
+	torrent.StatusMsg = status.TrackerStatus
+	torrent.State = getState(status)
+}
+
+// mapExtraStatus fills in the fields from the extraKeys status values
+func mapExtraStatus(values map[string]interface{}, torrent *client.Torrent) {
+	if v, found := values["label"]; found {
+		torrent.Label = toString(v)
+	}
+	if v, found := values["total_uploaded"]; found {
+		torrent.Uploaded = toInt64(v)
+	}
+	// The message is "OK" unless the torrent has errored
+	if msg := toString(values["message"]); msg != "" && msg != "OK" {
+		torrent.StatusMsg = msg
+	}
+}
+
+// mapFilePriority converts a libtorrent priority, 0 skips the file, 1-3 are low, 4 is the default
+// and 7 the highest
+func mapFilePriority(p int64) client.FilePriority {
+	switch {
+	case p <= 0:
+		return client.PrioritySkip
+	case p < 4:
+		return client.PriorityLow
+	case p < 7:
+		return client.PriorityNormal
+	default:
+		return client.PriorityHigh
+	}
 }
 
 func getState(status *deluge.TorrentStatus) client.State {
@@ -57,60 +169,292 @@ func getState(status *deluge.TorrentStatus) client.State {
 	return s
 }
 
+// Deluge sends every call over its own RPC client. The library is only used for its types, its
+// connection never verifies the daemons certificate and would send the password to anyone.
 type Deluge struct {
-	cfg    *client.Config
-	client deluge.DelugeClient
+	cfg *client.Config
+	rpc *rpcClient
+}
+
+// torrentStatus returns the status of a single torrent
+func (d Deluge) torrentStatus(ctx context.Context, hash string) (*deluge.TorrentStatus, map[string]interface{}, error) {
+	resp, err := d.rpc.call(ctx, "core.get_torrent_status", hash, statusRequest())
+	if err != nil {
+		return nil, nil, errors.Wrapf(client.ErrDriverError, "Failed to get torrent status: %v", err)
+	}
+	return decodeStatus(resp)
 }
 
-func (d Deluge) FreeSpace(path string) (int64, error) {
-	return d.client.GetFreeSpace(path)
+func (d Deluge) FreeSpace(ctx context.Context, path string) (int64, error) {
+	resp, err := d.rpc.call(ctx, "core.get_free_space", path)
+	if err != nil {
+		return 0, errors.Wrapf(client.ErrDriverError, "Failed to get free space: %v", err)
+	}
+	return toInt64(resp), nil
 }
 
-// TODO set label
-func (d Deluge) Add(filename string, torrent io.Reader, path string, label string) error {
+// Add loads the torrent and sets its label, the label is created first if it does not exist yet
+func (d Deluge) Add(ctx context.Context, filename string, torrent io.Reader, path string, label string, opts client.AddOptions) error {
 	b, err := ioutil.ReadAll(torrent)
 	if err != nil {
 		return err
 	}
-	e := base64.StdEncoding.EncodeToString(b)
-	hash, err := d.client.AddTorrentFile(filename, e, &deluge.Options{
-		DownloadLocation: &path,
-		V2:               deluge.V2Options{},
-	})
+	var options rencode.Dictionary
+	options.Add("download_location", path)
+	options.Add("add_paused", opts.Paused)
+	resp, err := d.rpc.call(ctx, "core.add_torrent_file", filename, base64.StdEncoding.EncodeToString(b), options)
 	if err != nil {
-		return err
+		return errors.Wrapf(client.ErrDriverError, "Failed to add torrent: %v", err)
 	}
+	// No hash is returned when the torrent was already added
+	hash := toString(resp)
 	log.Debugf("Added torrent %s [%s]", filename, hash)
+	if label == "" || hash == "" {
+		return nil
+	}
+	// The torrent is already added, failing here would have the caller add it again
+	if err := d.setLabel(ctx, hash, label); err != nil {
+		log.Errorf("Failed to set label %s on added torrent %s: %v", label, hash, err)
+	}
 	return nil
 }
 
-func (d Deluge) Announce(hash string) error {
-	return d.client.ForceReannounce([]string{hash})
+// setLabel applies the label, deluge only allows lower case labels so it is converted first
+func (d Deluge) setLabel(ctx context.Context, hash string, label string) error {
+	label = strings.ToLower(label)
+	resp, err := d.rpc.call(ctx, "label.get_labels")
+	if err != nil {
+		return errors.Wrapf(client.ErrDriverError, "Failed to get labels: %v", err)
+	}
+	known := false
+	if labels, ok := resp.(rencode.List); ok {
+		for _, l := range labels.Values() {
+			if toString(l) == label {
+				known = true
+				break
+			}
+		}
+	}
+	if !known {
+		if _, err := d.rpc.call(ctx, "label.add", label); err != nil {
+			return errors.Wrapf(client.ErrDriverError, "Failed to create label: %v", err)
+		}
+		log.Debugf("Created label: %s", label)
+	}
+	if _, err := d.rpc.call(ctx, "label.set_torrent", hash, label); err != nil {
+		return errors.Wrapf(client.ErrDriverError, "Failed to set label: %v", err)
+	}
+	return nil
+}
+
+func (d Deluge) Capabilities() client.Capabilities {
+	return client.NewCapabilities(client.CapQueue, client.CapLabels, client.CapVerify, client.CapMoveData,
+		client.CapFreeSpace, client.CapFilePriorities, client.CapAnnounce, client.CapSetLocation,
+		client.CapSessionLimits)
+}
+
+func (d Deluge) Announce(ctx context.Context, hash string) error {
+	if _, err := d.rpc.call(ctx, "core.force_reannounce", hashList([]string{hash})); err != nil {
+		return errors.Wrapf(client.ErrDriverError, "Failed to announce torrent: %v", err)
+	}
+	return nil
+}
+
+// Export reads the metainfo from the deluge state directory as there is no RPC call exposing it
+func (d Deluge) Export(ctx context.Context, hash string) ([]byte, error) {
+	return client.ReadStateFile(d.cfg.StateDir, hash)
 }
 
-func (d Deluge) ClientVersion() (string, error) {
-	dv, err := d.client.DaemonVersion()
+func (d Deluge) Files(ctx context.Context, hash string) ([]client.File, error) {
+	status, _, err := d.torrentStatus(ctx, hash)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	cv, err := d.client.GetLibtorrentVersion()
+	files := make([]client.File, len(status.Files))
+	for i, f := range status.Files {
+		files[i] = client.File{Index: int(f.Index), Path: f.Path, Size: f.Size, Priority: client.PriorityNormal}
+		if i < len(status.FileProgress) {
+			files[i].Progress = float64(status.FileProgress[i])
+		}
+		if i < len(status.FilePriorities) {
+			files[i].Priority = mapFilePriority(status.FilePriorities[i])
+		}
+	}
+	return files, nil
+}
+
+// filePriorities maps the priorities to the values used by the deluge UI
+var filePriorities = map[client.FilePriority]int64{
+	client.PrioritySkip:   0,
+	client.PriorityLow:    1,
+	client.PriorityNormal: 4,
+	client.PriorityHigh:   7,
+}
+
+// SetFilePriority updates the file_priorities torrent option which must contain every file, so the
+// current priorities are fetched first
+func (d Deluge) SetFilePriority(ctx context.Context, hash string, index int, priority client.FilePriority) error {
+	status, _, err := d.torrentStatus(ctx, hash)
 	if err != nil {
-		return "", err
+		return err
+	}
+	if index < 0 || index >= len(status.FilePriorities) {
+		return errors.Wrapf(client.ErrDriverError, "Invalid file index: %d", index)
+	}
+	var priorities rencode.List
+	for i, p := range status.FilePriorities {
+		if i == index {
+			p = filePriorities[priority]
+		}
+		priorities.Add(p)
+	}
+	var options rencode.Dictionary
+	options.Add("file_priorities", priorities)
+	if _, err := d.rpc.call(ctx, "core.set_torrent_options", rencode.NewList(hash), options); err != nil {
+		return errors.Wrapf(client.ErrDriverError, "Failed to set file priority: %v", err)
+	}
+	return nil
+}
+
+// sessionKeys are the core config keys backing the session settings
+var sessionKeys = []interface{}{
+	"max_upload_speed", "max_download_speed", "max_active_downloading", "max_active_seeding",
+	"max_connections_global", "max_connections_per_torrent",
+}
+
+// fromLimit converts a deluge limit where -1 is unlimited into our convention of zero being unlimited
+func fromLimit(v interface{}) int64 {
+	n := toInt64(v)
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// toLimit converts zero as unlimited to deluges -1
+func toLimit(v int64) int64 {
+	if v <= 0 {
+		return -1
 	}
-	return fmt.Sprintf("%s / %s", dv, cv), nil
+	return v
 }
 
-func (d Deluge) Login() error {
-	if err := d.client.Connect(); err != nil {
-		return errors.Wrapf(client.ErrAuthFailed, "failed to connect to client: %v", err)
+func (d Deluge) SessionSettings(ctx context.Context) (*client.SessionSettings, error) {
+	resp, err := d.rpc.call(ctx, "core.get_config_values", rencode.NewList(sessionKeys...))
+	if err != nil {
+		return nil, errors.Wrapf(client.ErrDriverError, "Failed to get config: %v", err)
 	}
-	plugins, err := d.client.GetEnabledPlugins()
+	values, err := toMap(resp)
+	if err != nil {
+		return nil, errors.Wrapf(client.ErrDriverError, "Failed to read config: %v", err)
+	}
+	// Rates are KiB/s floats
+	up := int64(toFloat64(values["max_upload_speed"]) * 1024)
+	down := int64(toFloat64(values["max_download_speed"]) * 1024)
+	if up < 0 {
+		up = 0
+	}
+	if down < 0 {
+		down = 0
+	}
+	downloads := int(fromLimit(values["max_active_downloading"]))
+	seeding := int(fromLimit(values["max_active_seeding"]))
+	conns := int(fromLimit(values["max_connections_global"]))
+	perTorrent := int(fromLimit(values["max_connections_per_torrent"]))
+	return &client.SessionSettings{
+		UploadLimit:              &up,
+		DownloadLimit:            &down,
+		MaxActiveDownloads:       &downloads,
+		MaxActiveSeeding:         &seeding,
+		MaxConnections:           &conns,
+		MaxConnectionsPerTorrent: &perTorrent,
+	}, nil
+}
+
+func (d Deluge) SetSessionSettings(ctx context.Context, settings *client.SessionSettings) error {
+	var values rencode.Dictionary
+	if settings.UploadLimit != nil {
+		values.Add("max_upload_speed", float64(*speedLimit(*settings.UploadLimit)))
+	}
+	if settings.DownloadLimit != nil {
+		values.Add("max_download_speed", float64(*speedLimit(*settings.DownloadLimit)))
+	}
+	for key, v := range map[string]*int{
+		"max_active_downloading":      settings.MaxActiveDownloads,
+		"max_active_seeding":          settings.MaxActiveSeeding,
+		"max_connections_global":      settings.MaxConnections,
+		"max_connections_per_torrent": settings.MaxConnectionsPerTorrent,
+	} {
+		if v != nil {
+			values.Add(key, toLimit(int64(*v)))
+		}
+	}
+	if values.Length() == 0 {
+		return nil
+	}
+	if _, err := d.rpc.call(ctx, "core.set_config", values); err != nil {
+		return errors.Wrapf(client.ErrDriverError, "Failed to set config: %v", err)
+	}
+	return nil
+}
+
+// speedLimit converts bytes/sec into deluges KiB/s where -1 is unlimited
+func speedLimit(limit int64) *int {
+	v := -1
+	if limit > 0 {
+		v = int(limit / 1024)
+		if v == 0 {
+			v = 1
+		}
+	}
+	return &v
+}
+
+// setOptions updates the torrent options of the torrents
+func (d Deluge) setOptions(ctx context.Context, hashes []string, options rencode.Dictionary) error {
+	if _, err := d.rpc.call(ctx, "core.set_torrent_options", hashList(hashes), options); err != nil {
+		return errors.Wrapf(client.ErrDriverError, "Failed to set torrent options: %v", err)
+	}
+	return nil
+}
+
+func (d Deluge) SetLimits(ctx context.Context, hash string, upload int64, download int64) error {
+	var options rencode.Dictionary
+	options.Add("max_upload_speed", *speedLimit(upload))
+	options.Add("max_download_speed", *speedLimit(download))
+	return d.setOptions(ctx, []string{hash}, options)
+}
+
+func (d Deluge) ClientVersion(ctx context.Context) (string, error) {
+	dv, err := d.rpc.call(ctx, "daemon.info")
+	if err != nil {
+		return "", errors.Wrapf(client.ErrDriverError, "Failed to get daemon version: %v", err)
+	}
+	cv, err := d.rpc.call(ctx, "core.get_libtorrent_version")
+	if err != nil {
+		return "", errors.Wrapf(client.ErrDriverError, "Failed to get libtorrent version: %v", err)
+	}
+	return fmt.Sprintf("%s / %s", toString(dv), toString(cv)), nil
+}
+
+// Login connects and logs in once the daemons certificate has been verified against the system roots
+// or ca_file. Nothing is verified when insecure_skip_verify is set.
+func (d Deluge) Login(ctx context.Context) error {
+	if err := d.rpc.connect(ctx); err != nil {
+		// Only an exception raised by daemon.login is a rejected login
+		if _, ok := err.(rpcError); ok {
+			return errors.Wrapf(client.ErrAuthFailed, "failed to login: %v", err)
+		}
+		return errors.Wrapf(err, "failed to connect to client")
+	}
+	resp, err := d.rpc.call(ctx, "core.get_enabled_plugins")
 	if err != nil {
 		return errors.Wrapf(client.ErrDriverError, "failed to get enabled plugins: %v", err)
 	}
 	labelEnabled := false
-	for _, name := range plugins {
-		if strings.ToLower(name) == "label" {
+	plugins, _ := resp.(rencode.List)
+	for _, name := range plugins.Values() {
+		if strings.ToLower(toString(name)) == "label" {
 			labelEnabled = true
 			break
 		}
@@ -121,24 +465,66 @@ func (d Deluge) Login() error {
 	return nil
 }
 
-func (d Deluge) Move(hash string, dest string) error {
-	return d.client.MoveStorage([]string{hash}, dest)
+// moveStorage moves the data of the torrents to dest
+func (d Deluge) moveStorage(ctx context.Context, hashes []string, dest string) error {
+	if _, err := d.rpc.call(ctx, "core.move_storage", hashList(hashes), dest); err != nil {
+		return errors.Wrapf(client.ErrDriverError, "Failed to move torrents: %v", err)
+	}
+	return nil
+}
+
+func (d Deluge) Move(ctx context.Context, hash string, dest string) error {
+	return d.moveStorage(ctx, []string{hash}, dest)
 }
 
-func (d Deluge) Pause(hash string) error {
-	return d.client.PauseTorrents(hash)
+func (d Deluge) MoveMany(ctx context.Context, hashes []string, dest string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	return d.moveStorage(ctx, hashes, dest)
+}
+
+// SetLocation uses move_storage as deluge has no location only update. Any files still present at the
+// old location will be moved over those at the destination, so callers must move them out of the way first.
+func (d Deluge) SetLocation(ctx context.Context, hash string, dest string) error {
+	return d.moveStorage(ctx, []string{hash}, dest)
+}
+
+func (d Deluge) pause(ctx context.Context, hashes []string) error {
+	if _, err := d.rpc.call(ctx, "core.pause_torrents", hashList(hashes)); err != nil {
+		return errors.Wrapf(client.ErrDriverError, "Failed to pause torrents: %v", err)
+	}
+	return nil
+}
+
+func (d Deluge) resume(ctx context.Context, hashes []string) error {
+	if _, err := d.rpc.call(ctx, "core.resume_torrents", hashList(hashes)); err != nil {
+		return errors.Wrapf(client.ErrDriverError, "Failed to resume torrents: %v", err)
+	}
+	return nil
 }
 
-func (d Deluge) PauseAll() error {
-	hashes, err := d.getAllHashes()
+func (d Deluge) Pause(ctx context.Context, hash string) error {
+	return d.pause(ctx, []string{hash})
+}
+
+func (d Deluge) PauseAll(ctx context.Context) error {
+	hashes, err := d.getAllHashes(ctx)
 	if err != nil {
 		return err
 	}
-	return d.client.PauseTorrents(hashes...)
+	return d.pause(ctx, hashes)
+}
+
+func (d Deluge) PauseMany(ctx context.Context, hashes []string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	return d.pause(ctx, hashes)
 }
 
-func (d Deluge) getAllHashes() ([]string, error) {
-	torrents, err := d.Torrents()
+func (d Deluge) getAllHashes(ctx context.Context) ([]string, error) {
+	torrents, err := d.Torrents(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -149,17 +535,41 @@ func (d Deluge) getAllHashes() ([]string, error) {
 	return hashes, nil
 }
 
-func (d Deluge) Queue(hash string, position client.QueuePos) error {
-	// TODO need to add support in lib for queue_* calls
+func (d Deluge) Peers(ctx context.Context, hash string) ([]client.Peer, error) {
+	status, _, err := d.torrentStatus(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	peers := make([]client.Peer, len(status.Peers))
+	for i, p := range status.Peers {
+		peers[i] = client.Peer{
+			Address:  p.IP,
+			Client:   p.Client,
+			Progress: float64(p.Progress),
+			SpeedUP:  p.UpSpeed,
+			SpeedDN:  p.DownSpeed,
+		}
+	}
+	return peers, nil
+}
+
+func (d Deluge) Queue(ctx context.Context, hash string, position client.QueuePos) error {
+	method, found := queueMethods[position]
+	if !found {
+		return errors.Wrapf(client.ErrDriverError, "Invalid queue position: %d", position)
+	}
+	if _, err := d.rpc.call(ctx, method, rencode.NewList(hash)); err != nil {
+		return errors.Wrapf(client.ErrDriverError, "Failed to queue torrent: %v", err)
+	}
 	return nil
 }
 
-func (d Deluge) Remove(hash string, deleteData bool) error {
-	ok, err := d.client.RemoveTorrent(hash, deleteData)
+func (d Deluge) Remove(ctx context.Context, hash string, deleteData bool) error {
+	resp, err := d.rpc.call(ctx, "core.remove_torrent", hash, deleteData)
 	if err != nil {
 		return errors.Wrapf(client.ErrDriverError, "Failed to remove torrent: %v", err)
 	}
-	if !ok {
+	if ok, _ := resp.(bool); !ok {
 		log.Warnf("Torrent not removed, does not exist?: %s", hash)
 	} else {
 		log.Infof("Removed torrent: %s", hash)
@@ -167,88 +577,197 @@ func (d Deluge) Remove(hash string, deleteData bool) error {
 	return nil
 }
 
-func (d Deluge) Start(hash string) error {
-	return d.client.ResumeTorrents(hash)
+// RemoveMany uses remove_torrents, the torrents deluge failed to remove are logged as there is no
+// way to tell an unknown torrent apart from other failures
+func (d Deluge) RemoveMany(ctx context.Context, hashes []string, deleteData bool) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	resp, err := d.rpc.call(ctx, "core.remove_torrents", hashList(hashes), deleteData)
+	if err != nil {
+		return errors.Wrapf(client.ErrDriverError, "Failed to remove torrents: %v", err)
+	}
+	// Each failure is an (id, message) tuple
+	failed, _ := resp.(rencode.List)
+	for _, f := range failed.Values() {
+		if tuple, ok := f.(rencode.List); ok && tuple.Length() == 2 {
+			log.Warnf("Torrent not removed, does not exist?: %s: %s", toString(tuple.Values()[0]),
+				toString(tuple.Values()[1]))
+		}
+	}
+	return nil
 }
 
-func (d Deluge) StartAll() error {
-	hashes, err := d.getAllHashes()
+// Start resumes the torrent and hands it back to the queue manager in case it was stopped
+func (d Deluge) Start(ctx context.Context, hash string) error {
+	var options rencode.Dictionary
+	options.Add("auto_managed", true)
+	if err := d.setOptions(ctx, []string{hash}, options); err != nil {
+		return err
+	}
+	return d.resume(ctx, []string{hash})
+}
+
+func (d Deluge) StartAll(ctx context.Context) error {
+	hashes, err := d.getAllHashes(ctx)
 	if err != nil {
 		return err
 	}
-	return d.client.ResumeTorrents(hashes...)
+	return d.resume(ctx, hashes)
 }
 
-func (d Deluge) Stop(hash string) error {
-	return d.Pause(hash)
+// Stop pauses the torrent and takes it out of the queue manager so it is not resumed automatically,
+// deluge has no separate stopped state
+func (d Deluge) Stop(ctx context.Context, hash string) error {
+	var options rencode.Dictionary
+	options.Add("auto_managed", false)
+	if err := d.setOptions(ctx, []string{hash}, options); err != nil {
+		return err
+	}
+	return d.Pause(ctx, hash)
 }
 
-func (d Deluge) Torrent(hash string, torrent *client.Torrent) error {
-	status, err := d.client.TorrentStatus(hash)
+func (d Deluge) Torrent(ctx context.Context, hash string, torrent *client.Torrent) error {
+	status, values, err := d.torrentStatus(ctx, hash)
 	if err != nil {
 		return err
 	}
 	torrent.Hash = hash
 	mapTorrentStatus(status, torrent)
+	mapExtraStatus(values, torrent)
 	return nil
-
 }
 
-func statusToTorrents(states map[string]*deluge.TorrentStatus) ([]*client.Torrent, error) {
+// torrents returns the torrents with the hashes, every torrent when hashes is nil
+func (d Deluge) torrents(ctx context.Context, hashes []string) ([]*client.Torrent, error) {
+	var filter rencode.Dictionary
+	if hashes != nil {
+		filter.Add("id", hashList(hashes))
+	}
+	resp, err := d.rpc.call(ctx, "core.get_torrents_status", filter, statusRequest())
+	if err != nil {
+		return nil, errors.Wrapf(client.ErrDriverError, "Failed to get torrents: %v", err)
+	}
+	states, err := toMap(resp)
+	if err != nil {
+		return nil, errors.Wrapf(client.ErrDriverError, "Failed to read torrents: %v", err)
+	}
 	var torrents []*client.Torrent
-	for id, meta := range states {
-		var t client.Torrent
-		t.Hash = id
-		mapTorrentStatus(meta, &t)
-		torrents = append(torrents, &t)
+	for id, v := range states {
+		status, values, err := decodeStatus(v)
+		if err != nil {
+			return nil, err
+		}
+		t := &client.Torrent{Hash: id}
+		mapTorrentStatus(status, t)
+		mapExtraStatus(values, t)
+		torrents = append(torrents, t)
 	}
 	return torrents, nil
 }
 
-func (d Deluge) Torrents() ([]*client.Torrent, error) {
-	states, err := d.client.TorrentsStatus(deluge.StateUnspecified, nil)
+func (d Deluge) TorrentsByHash(ctx context.Context, hashes []string) (map[string]*client.Torrent, error) {
+	byHash := make(map[string]*client.Torrent, len(hashes))
+	// An empty id filter would match every torrent
+	if len(hashes) == 0 {
+		return byHash, nil
+	}
+	torrents, err := d.torrents(ctx, hashes)
 	if err != nil {
 		return nil, err
 	}
-	return statusToTorrents(states)
+	for _, t := range torrents {
+		byHash[t.Hash] = t
+	}
+	return byHash, nil
+}
+
+func (d Deluge) Torrents(ctx context.Context) ([]*client.Torrent, error) {
+	return d.torrents(ctx, nil)
 }
 
-func (d Deluge) TorrentsWithState(statuses ...client.State) ([]*client.Torrent, error) {
-	torrents, err := d.client.TorrentsStatus(deluge.StateUnspecified, nil)
+func (d Deluge) TorrentsWithState(ctx context.Context, statuses ...client.State) ([]*client.Torrent, error) {
+	torrents, err := d.torrents(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
-	valid := make(map[string]*deluge.TorrentStatus)
-	for hash, s := range torrents {
+	var valid []*client.Torrent
+	for _, t := range torrents {
 		for _, status := range statuses {
-			if getState(s) == status {
-				valid[hash] = s
+			if t.State == status {
+				valid = append(valid, t)
 				break
 			}
 		}
 	}
-	return statusToTorrents(valid)
+	return valid, nil
 }
 
-func (d Deluge) Verify(hash string) error {
-	// TODO Add force_recheck to library
+// Trackers only returns the tracker currently in use as deluge does not report the state of the others
+func (d Deluge) Trackers(ctx context.Context, hash string) ([]client.Tracker, error) {
+	status, _, err := d.torrentStatus(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	if status.TrackerHost == "" {
+		return nil, nil
+	}
+	tracker := client.Tracker{
+		URL:      status.TrackerHost,
+		Status:   mapTrackerStatus(status.TrackerStatus),
+		Message:  status.TrackerStatus,
+		Seeders:  int(status.TotalSeeds),
+		Leechers: int(status.TotalPeers),
+	}
+	if status.NextAnnounce > 0 {
+		tracker.NextAnnounce = time.Now().Add(time.Duration(status.NextAnnounce) * time.Second)
+	}
+	return []client.Tracker{tracker}, nil
+}
+
+// mapTrackerStatus parses the tracker_status message, eg: "Announce OK" or "Error: timed out"
+func mapTrackerStatus(msg string) client.TrackerStatus {
+	switch {
+	case msg == "":
+		return client.TrackerNotContacted
+	case strings.HasPrefix(msg, "Error"):
+		return client.TrackerError
+	case strings.HasPrefix(msg, "Announce Sent"):
+		return client.TrackerUpdating
+	default:
+		return client.TrackerWorking
+	}
+}
+
+func (d Deluge) Verify(ctx context.Context, hash string) error {
+	if _, err := d.rpc.call(ctx, "core.force_recheck", rencode.NewList(hash)); err != nil {
+		return errors.Wrapf(client.ErrDriverError, "Failed to verify torrent: %v", err)
+	}
 	return nil
 }
 
 func (d Deluge) Close() error {
-	return d.client.Close()
+	return d.rpc.close()
 }
 
 type Factory struct{}
 
 func (f Factory) New(cfg *client.Config) (client.Driver, error) {
-	c := deluge.NewV2(deluge.Settings{
-		Hostname: cfg.Host,
-		Port:     uint(cfg.Port),
-		Login:    cfg.Username,
-		Password: cfg.Password,
-	})
-	return Deluge{cfg: cfg, client: c}, nil
+	if cfg.Socket != "" || cfg.BasePath != "" || cfg.BasicAuthUser != "" {
+		return nil, errors.Wrapf(client.ErrInvalidConfig, "deluge does not support socket, base_path or basic auth")
+	}
+	tlsConfig, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig.InsecureSkipVerify {
+		log.Warnf("Certificate verification is disabled for deluge, the password is sent to any daemon")
+	}
+	rpc := newRPCClient(cfg.Host, cfg.Port, cfg.Username, cfg.Password, tlsConfig)
+	if cfg.Timeout > 0 {
+		rpc.timeout = cfg.Timeout
+	}
+	return Deluge{cfg: cfg, rpc: rpc}, nil
 }
 
 func init() {
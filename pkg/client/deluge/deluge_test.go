@@ -8,7 +8,7 @@ import (
 
 func TestDeluge(t *testing.T) {
 	f := Factory{}
-	c, err := f.New(client.Config{
+	c, err := f.New(&client.Config{
 		Driver:   "deluge",
 		Username: "test_user",
 		Password: "test_pass",
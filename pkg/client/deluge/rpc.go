@@ -0,0 +1,292 @@
+package deluge
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"github.com/gdm85/go-rencode"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// protocolVersion is the header version byte used by deluge 2.x daemons
+	protocolVersion = 1
+	msgResponse     = 1
+	msgError        = 2
+	msgEvent        = 3
+	rpcTimeout      = time.Second * 30
+)
+
+// rpcError is an exception raised by the daemon while handling a call
+type rpcError struct {
+	Method        string
+	ExceptionType string
+	Message       string
+}
+
+func (e rpcError) Error() string {
+	return fmt.Sprintf("RPC %s failed: %s('%s')", e.Method, e.ExceptionType, e.Message)
+}
+
+// rpcClient is a minimal deluge 2.x RPC client. Calls are serialized over a single connection.
+type rpcClient struct {
+	host     string
+	port     uint16
+	username string
+	password string
+	tls      *tls.Config
+	// timeout bounds calls made with a context without a deadline
+	timeout time.Duration
+	mu      *sync.Mutex
+	conn    net.Conn
+	serial  int64
+}
+
+func newRPCClient(host string, port uint16, username string, password string, tlsConfig *tls.Config) *rpcClient {
+	return &rpcClient{host: host, port: port, username: username, password: password, tls: tlsConfig,
+		timeout: rpcTimeout, mu: &sync.Mutex{}}
+}
+
+// connect opens the TLS connection and logs in
+func (c *rpcClient) connect(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: c.timeout},
+		Config:    c.tls,
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(c.host, fmt.Sprintf("%d", c.port)))
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	var kwargs rencode.Dictionary
+	kwargs.Add("client_version", "2.0.3")
+	if _, err := c.send(ctx, "daemon.login", rencode.NewList(c.username, c.password), kwargs); err != nil {
+		if c.conn != nil {
+			_ = c.conn.Close()
+			c.conn = nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *rpcClient) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// call performs a single RPC call returning the decoded return value
+func (c *rpcClient) call(ctx context.Context, method string, args ...interface{}) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil, errors.New("Not connected")
+	}
+	return c.send(ctx, method, rencode.NewList(args...), rencode.Dictionary{})
+}
+
+// send writes the call and waits for its response. Any failure other than an exception raised by the
+// daemon may leave the stream part way through a message, the connection is closed so the next call
+// cannot read the rest of it as its own response.
+func (c *rpcClient) send(ctx context.Context, method string, args rencode.List, kwargs rencode.Dictionary) (interface{}, error) {
+	v, err := c.exchange(ctx, method, args, kwargs)
+	if err != nil {
+		if _, ok := err.(rpcError); !ok {
+			_ = c.conn.Close()
+			c.conn = nil
+		}
+	}
+	return v, err
+}
+
+// exchange does the call for send. The connection deadline follows the deadline of ctx and is moved up
+// to now when ctx is cancelled, failing any blocked read or write.
+func (c *rpcClient) exchange(ctx context.Context, method string, args rencode.List, kwargs rencode.Dictionary) (interface{}, error) {
+	c.serial++
+	if c.serial == math.MaxInt64 {
+		c.serial = 1
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(c.timeout)
+	}
+	conn := c.conn
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	body, err := encodeMessage(rencode.NewList(rencode.NewList(c.serial, method, args, kwargs)))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(body); err != nil {
+		return nil, err
+	}
+	for {
+		resp, err := readMessage(conn)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		var msgType int64
+		if err := resp.Scan(&msgType); err != nil {
+			return nil, err
+		}
+		if msgType == msgEvent {
+			// Events are only sent to clients registered for them, ignore any that arrive anyway
+			continue
+		}
+		resp.Shift(1)
+		var serial int64
+		if err := resp.Scan(&serial); err != nil {
+			return nil, err
+		}
+		resp.Shift(1)
+		if serial != c.serial {
+			return nil, errors.Errorf("Response serial mismatch: got %d expected %d", serial, c.serial)
+		}
+		switch msgType {
+		case msgResponse:
+			if resp.Length() == 0 {
+				return nil, nil
+			}
+			return resp.Values()[0], nil
+		case msgError:
+			e := rpcError{Method: method}
+			values := resp.Values()
+			if len(values) > 0 {
+				e.ExceptionType = toString(values[0])
+			}
+			if len(values) > 1 {
+				if exArgs, ok := values[1].(rencode.List); ok && exArgs.Length() > 0 {
+					e.Message = toString(exArgs.Values()[0])
+				}
+			}
+			return nil, e
+		default:
+			return nil, errors.Errorf("Unknown message type: %d", msgType)
+		}
+	}
+}
+
+// encodeMessage rencodes and compresses v, prefixed with the protocol header
+func encodeMessage(v interface{}) ([]byte, error) {
+	var body bytes.Buffer
+	zw := zlib.NewWriter(&body)
+	enc := rencode.NewEncoder(zw)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, 5, 5+body.Len())
+	msg[0] = protocolVersion
+	binary.BigEndian.PutUint32(msg[1:], uint32(body.Len()))
+	return append(msg, body.Bytes()...), nil
+}
+
+// readMessage reads and decodes a single message
+func readMessage(r io.Reader) (rencode.List, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return rencode.List{}, err
+	}
+	if header[0] != protocolVersion {
+		return rencode.List{}, errors.Errorf("Unsupported protocol version: %d", header[0])
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return rencode.List{}, err
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return rencode.List{}, err
+	}
+	var msg rencode.List
+	if err := rencode.NewDecoder(zr).Scan(&msg); err != nil {
+		return rencode.List{}, err
+	}
+	return msg, nil
+}
+
+func toString(v interface{}) string {
+	switch s := v.(type) {
+	case []byte:
+		return string(s)
+	case string:
+		return s
+	default:
+		return ""
+	}
+}
+
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int8:
+		return int64(n)
+	case int16:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case int:
+		return int64(n)
+	case float32:
+		return int64(n)
+	case float64:
+		return int64(n)
+	default:
+		return 0
+	}
+}
+
+func toFloat64(v interface{}) float64 {
+	switch n := v.(type) {
+	case float32:
+		return float64(n)
+	case float64:
+		return n
+	default:
+		return float64(toInt64(v))
+	}
+}
+
+// toMap converts a decoded dictionary into a string keyed map
+func toMap(v interface{}) (map[string]interface{}, error) {
+	d, ok := v.(rencode.Dictionary)
+	if !ok {
+		return nil, errors.Errorf("Unexpected response type: %T", v)
+	}
+	return d.Zip()
+}
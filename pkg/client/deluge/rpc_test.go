@@ -0,0 +1,467 @@
+package deluge
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/gdm85/go-rencode"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testHash = "0123456789abcdef0123456789abcdef01234567"
+
+// fakeDaemon is a deluge RPC stand-in speaking rencode over TLS. Torrent status values are kept
+// by status key so only the requested keys are returned, like the real daemon.
+type fakeDaemon struct {
+	mu       sync.Mutex
+	listener net.Listener
+	cert     []byte
+	torrents map[string]map[string]interface{}
+	labels   []string
+	config   map[string]interface{}
+	calls    []string
+	// conns counts the accepted connections
+	conns int
+}
+
+func newStatus(name string) map[string]interface{} {
+	var file rencode.Dictionary
+	file.Add("index", int64(0))
+	file.Add("size", int64(1000))
+	file.Add("offset", int64(0))
+	file.Add("path", name+"/file.bin")
+	var file2 rencode.Dictionary
+	file2.Add("index", int64(1))
+	file2.Add("size", int64(2000))
+	file2.Add("offset", int64(1000))
+	file2.Add("path", name+"/file2.bin")
+	return map[string]interface{}{
+		"state": "Seeding", "tracker_host": "tracker.example.com", "tracker_status": "Announce OK",
+		"next_announce": int64(600), "name": name, "total_size": int64(3000), "progress": float32(100),
+		"num_seeds": int64(2), "total_seeds": int64(10), "num_peers": int64(1), "total_peers": int64(4),
+		"eta": float32(0), "download_payload_rate": int64(0), "upload_payload_rate": int64(2048),
+		"ratio": float32(1.5), "distributed_copies": float32(1), "num_pieces": int64(1),
+		"piece_length": int64(262144), "total_done": int64(3000), "files": rencode.NewList(file, file2),
+		"file_priorities": rencode.NewList(int64(4), int64(4)),
+		"file_progress":   rencode.NewList(float32(1), float32(1)),
+		"peers":           rencode.NewList(), "is_seed": true, "is_finished": true,
+		"active_time": int64(7200), "seeding_time": int64(3600), "time_added": float32(1600000000),
+		"completed_time": int64(1600003600), "download_location": "/data", "private": false,
+		"total_uploaded": int64(4500), "message": "OK", "auto_managed": true,
+	}
+}
+
+func newFakeDaemon(t *testing.T) *fakeDaemon {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "deluge"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	require.NoError(t, err)
+	d := &fakeDaemon{
+		listener: l,
+		cert:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		torrents: map[string]map[string]interface{}{testHash: newStatus("test")},
+		config: map[string]interface{}{
+			"max_upload_speed": float64(-1), "max_download_speed": float64(100),
+			"max_active_downloading": int64(3), "max_active_seeding": int64(5),
+			"max_connections_global": int64(200), "max_connections_per_torrent": int64(-1),
+		},
+	}
+	go d.serve()
+	return d
+}
+
+func (d *fakeDaemon) serve() {
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			return
+		}
+		d.mu.Lock()
+		d.conns++
+		d.mu.Unlock()
+		go d.handle(conn)
+	}
+}
+
+func (d *fakeDaemon) handle(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	for {
+		msg, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		var req rencode.List
+		if err := msg.Scan(&req); err != nil {
+			return
+		}
+		var serial int64
+		var method string
+		var args rencode.List
+		if err := req.Scan(&serial, &method, &args); err != nil {
+			return
+		}
+		var resp rencode.List
+		result, err := d.dispatch(method, args.Values())
+		if err != nil {
+			resp = rencode.NewList(msgError, serial, "KeyError", rencode.NewList(err.Error()),
+				rencode.Dictionary{}, "Traceback")
+		} else {
+			resp = rencode.NewList(msgResponse, serial, result)
+		}
+		b, err := encodeMessage(resp)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(b); err != nil {
+			return
+		}
+	}
+}
+
+func (d *fakeDaemon) status(hash string, keys rencode.List) (rencode.Dictionary, bool) {
+	var values rencode.Dictionary
+	status, found := d.torrents[hash]
+	if !found {
+		return values, false
+	}
+	for _, k := range keys.Values() {
+		if v, ok := status[toString(k)]; ok {
+			values.Add(toString(k), v)
+		}
+	}
+	return values, true
+}
+
+func (d *fakeDaemon) hashes(v interface{}) []string {
+	var hashes []string
+	if l, ok := v.(rencode.List); ok {
+		for _, h := range l.Values() {
+			hashes = append(hashes, toString(h))
+		}
+	} else {
+		hashes = append(hashes, toString(v))
+	}
+	return hashes
+}
+
+func (d *fakeDaemon) dispatch(method string, args []interface{}) (interface{}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls = append(d.calls, method)
+	switch method {
+	case "daemon.login":
+		if toString(args[0]) != "user" || toString(args[1]) != "pass" {
+			return nil, errors.New("Password does not match")
+		}
+		return int64(10), nil
+	case "core.get_enabled_plugins":
+		return rencode.NewList("Label"), nil
+	case "core.get_torrent_status":
+		values, found := d.status(toString(args[0]), args[1].(rencode.List))
+		if !found {
+			return rencode.Dictionary{}, nil
+		}
+		return values, nil
+	case "core.get_torrents_status":
+		filter, err := toMap(args[0])
+		if err != nil {
+			return nil, err
+		}
+		var result rencode.Dictionary
+		for hash := range d.torrents {
+			if ids, found := filter["id"]; found && !contains(d.hashes(ids), hash) {
+				continue
+			}
+			values, _ := d.status(hash, args[1].(rencode.List))
+			result.Add(hash, values)
+		}
+		return result, nil
+	case "daemon.info":
+		return "2.0.3", nil
+	case "core.get_libtorrent_version":
+		return "1.2.11.0", nil
+	case "core.get_free_space":
+		return int64(5000), nil
+	case "core.force_reannounce":
+		return nil, nil
+	case "core.move_storage":
+		for _, h := range d.hashes(args[0]) {
+			d.torrents[h]["download_location"] = toString(args[1])
+		}
+		return nil, nil
+	case "core.remove_torrent":
+		hash := toString(args[0])
+		if _, found := d.torrents[hash]; !found {
+			return false, nil
+		}
+		delete(d.torrents, hash)
+		return true, nil
+	case "core.remove_torrents":
+		failed := rencode.NewList()
+		for _, h := range d.hashes(args[0]) {
+			if _, found := d.torrents[h]; !found {
+				failed.Add(rencode.NewList(h, "Torrent not found"))
+				continue
+			}
+			delete(d.torrents, h)
+		}
+		return failed, nil
+	case "core.pause_torrents":
+		for _, h := range d.hashes(args[0]) {
+			d.torrents[h]["state"] = "Paused"
+		}
+		return nil, nil
+	case "core.resume_torrents":
+		for _, h := range d.hashes(args[0]) {
+			d.torrents[h]["state"] = "Seeding"
+		}
+		return nil, nil
+	case "core.set_torrent_options":
+		options, err := toMap(args[1])
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range d.hashes(args[0]) {
+			for k, v := range options {
+				d.torrents[h][k] = v
+			}
+		}
+		return nil, nil
+	case "core.add_torrent_file":
+		d.torrents[testHash+"ff"] = newStatus(toString(args[0]))
+		return testHash + "ff", nil
+	case "core.force_recheck":
+		for _, h := range d.hashes(args[0]) {
+			d.torrents[h]["state"] = "Checking"
+		}
+		return nil, nil
+	case "core.queue_top", "core.queue_up", "core.queue_down", "core.queue_bottom":
+		return nil, nil
+	case "core.get_config_values":
+		var result rencode.Dictionary
+		keys := args[0].(rencode.List)
+		for _, k := range keys.Values() {
+			result.Add(toString(k), d.config[toString(k)])
+		}
+		return result, nil
+	case "core.set_config":
+		values, err := toMap(args[0])
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range values {
+			d.config[k] = v
+		}
+		return nil, nil
+	case "label.get_labels":
+		l := rencode.NewList()
+		for _, label := range d.labels {
+			l.Add(label)
+		}
+		return l, nil
+	case "label.add":
+		label := toString(args[0])
+		if label != strings.ToLower(label) || strings.ContainsAny(label, " !") {
+			return nil, errors.New("Invalid label, valid characters:[a-z0-9_-]")
+		}
+		for _, l := range d.labels {
+			if l == label {
+				return nil, errors.New("Label already exists")
+			}
+		}
+		d.labels = append(d.labels, label)
+		return nil, nil
+	case "label.set_torrent":
+		d.torrents[toString(args[0])]["label"] = toString(args[1])
+		return nil, nil
+	}
+	return nil, errors.Errorf("Unknown method: %s", method)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *fakeDaemon) called(method string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, c := range d.calls {
+		if c == method {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDelugeRPC(t *testing.T) {
+	ctx := context.Background()
+	daemon := newFakeDaemon(t)
+	defer func() { _ = daemon.listener.Close() }()
+	port := uint16(daemon.listener.Addr().(*net.TCPAddr).Port)
+
+	dir, err := ioutil.TempDir("", "seedr-deluge")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	caFile := filepath.Join(dir, "daemon.cert")
+	require.NoError(t, ioutil.WriteFile(caFile, daemon.cert, 0600))
+
+	unverified, err := Factory{}.New(&client.Config{Host: "127.0.0.1", Port: port, Username: "user", Password: "pass"})
+	require.NoError(t, err)
+	require.Error(t, unverified.Login(ctx), "The self signed certificate should not be trusted by default")
+	_, err = unverified.ClientVersion(ctx)
+	require.Error(t, err)
+	_, err = unverified.Torrents(ctx)
+	require.Error(t, err)
+	require.False(t, daemon.called("daemon.login"), "The password must not be sent to an unverified daemon")
+
+	bad, err := Factory{}.New(&client.Config{Host: "127.0.0.1", Port: port, Username: "user", Password: "nope",
+		InsecureSkipVerify: true})
+	require.NoError(t, err)
+	require.True(t, errors.Is(bad.Login(ctx), client.ErrAuthFailed))
+
+	d, err := Factory{}.New(&client.Config{Host: "127.0.0.1", Port: port, Username: "user", Password: "pass",
+		CAFile: caFile})
+	require.NoError(t, err)
+	require.NoError(t, d.Login(ctx))
+	defer func() { _ = d.Close() }()
+
+	var tor client.Torrent
+	require.NoError(t, d.Torrent(ctx, testHash, &tor))
+	require.Equal(t, "test", tor.Name)
+	require.Equal(t, "/data", tor.Path)
+	require.Equal(t, "tracker.example.com", tor.Tracker)
+	require.Equal(t, int64(4500), tor.Uploaded)
+	require.Equal(t, int64(3000), tor.Downloaded)
+	require.Equal(t, time.Hour, tor.SeedTime)
+	require.Equal(t, time.Unix(1600000000, 0), tor.AddedOn)
+	require.Equal(t, "Announce OK", tor.StatusMsg)
+	require.Equal(t, client.Seeding, tor.State)
+	require.Equal(t, 1.0, tor.Progress)
+
+	require.NoError(t, d.Add(ctx, "new.torrent", strings.NewReader("d4:infode"), "/data", "TV", client.AddOptions{}))
+	require.Equal(t, []string{"tv"}, daemon.labels)
+	// An existing label is reused
+	require.NoError(t, d.Add(ctx, "other.torrent", strings.NewReader("d4:infode"), "/data", "tv", client.AddOptions{}))
+	require.Equal(t, []string{"tv"}, daemon.labels)
+	torrents, err := d.Torrents(ctx)
+	require.NoError(t, err)
+	require.Len(t, torrents, 2)
+	for _, t2 := range torrents {
+		if t2.Hash == testHash+"ff" {
+			require.Equal(t, "tv", t2.Label)
+		}
+	}
+	// The torrent is kept when only the label fails
+	require.NoError(t, d.Add(ctx, "other.torrent", strings.NewReader("d4:infode"), "/data", "bad label!",
+		client.AddOptions{}))
+	require.Equal(t, []string{"tv"}, daemon.labels)
+	require.Contains(t, daemon.torrents, testHash+"ff")
+
+	for _, pos := range []client.QueuePos{client.Top, client.Up, client.Down, client.Bottom} {
+		require.NoError(t, d.Queue(ctx, testHash, pos))
+	}
+	for _, m := range []string{"core.queue_top", "core.queue_up", "core.queue_down", "core.queue_bottom"} {
+		require.True(t, daemon.called(m), m)
+	}
+
+	require.NoError(t, d.Verify(ctx, testHash))
+	require.NoError(t, d.Torrent(ctx, testHash, &tor))
+	require.Equal(t, client.Checking, tor.State)
+
+	require.NoError(t, d.Stop(ctx, testHash))
+	require.NoError(t, d.Torrent(ctx, testHash, &tor))
+	require.Equal(t, client.Paused, tor.State)
+	require.Equal(t, false, daemon.torrents[testHash]["auto_managed"])
+	require.NoError(t, d.Start(ctx, testHash))
+	require.Equal(t, true, daemon.torrents[testHash]["auto_managed"])
+
+	require.NoError(t, d.SetFilePriority(ctx, testHash, 1, client.PriorityHigh))
+	files, err := d.Files(ctx, testHash)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	require.Equal(t, client.PriorityNormal, files[0].Priority)
+	require.Equal(t, client.PriorityHigh, files[1].Priority)
+	require.Error(t, d.SetFilePriority(ctx, testHash, 5, client.PriorityHigh))
+
+	s, err := d.SessionSettings(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), *s.UploadLimit)
+	require.Equal(t, int64(102400), *s.DownloadLimit)
+	require.Equal(t, 3, *s.MaxActiveDownloads)
+	require.Equal(t, 0, *s.MaxConnectionsPerTorrent)
+	up, seeding := int64(1024*1024), 0
+	require.NoError(t, d.SetSessionSettings(ctx, &client.SessionSettings{UploadLimit: &up, MaxActiveSeeding: &seeding}))
+	s, err = d.SessionSettings(ctx)
+	require.NoError(t, err)
+	require.Equal(t, up, *s.UploadLimit)
+	require.Equal(t, 0, *s.MaxActiveSeeding)
+	require.Equal(t, int64(-1), toInt64(daemon.config["max_active_seeding"]))
+
+	version, err := d.ClientVersion(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "2.0.3 / 1.2.11.0", version)
+	free, err := d.FreeSpace(ctx, "/data")
+	require.NoError(t, err)
+	require.Equal(t, int64(5000), free)
+	require.NoError(t, d.Announce(ctx, testHash))
+	require.NoError(t, d.MoveMany(ctx, []string{testHash}, "/slow"))
+	byHash, err := d.TorrentsByHash(ctx, []string{testHash})
+	require.NoError(t, err)
+	require.Len(t, byHash, 1)
+	require.Equal(t, "/slow", byHash[testHash].Path)
+	require.Equal(t, client.ErrUnknownTorrent, d.Torrent(ctx, "unknown", &tor))
+	require.NoError(t, d.RemoveMany(ctx, []string{testHash + "ff", "unknown"}, false))
+	require.NoError(t, d.Remove(ctx, "unknown", false))
+	torrents, err = d.Torrents(ctx)
+	require.NoError(t, err)
+	require.Len(t, torrents, 1)
+	daemon.mu.Lock()
+	conns := daemon.conns
+	daemon.mu.Unlock()
+	require.Equal(t, 3, conns, "Every call of a driver is sent over its one verified connection")
+
+	// An exception raised by the daemon keeps the connection, any other failure drops it
+	rpc := d.(Deluge).rpc
+	_, err = rpc.call(ctx, "core.unknown")
+	require.Error(t, err)
+	require.NotNil(t, rpc.conn)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = rpc.call(cancelled, "core.get_config")
+	require.Error(t, err)
+	require.Nil(t, rpc.conn)
+	_, err = rpc.call(ctx, "core.get_config")
+	require.EqualError(t, err, "Not connected")
+}
@@ -0,0 +1,312 @@
+package client
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// LockedDriver serialises all calls to the wrapped Driver. Some backends, deluge in particular,
+// cannot multiplex calls over their connection so this must be used whenever a driver is shared
+// between goroutines. Each call, including the wait for the lock, is bounded by the timeout.
+type LockedDriver struct {
+	driver  Driver
+	timeout time.Duration
+	// sem holds the lock, a channel is used so waiting can be abandoned when the context is done
+	sem chan struct{}
+}
+
+// lockedResult is the outcome of a call made while holding the lock
+type lockedResult struct {
+	v   interface{}
+	err error
+}
+
+// NewLockedDriver wraps driver, a zero timeout only uses the deadline of the callers context
+func NewLockedDriver(driver Driver, timeout time.Duration) *LockedDriver {
+	return &LockedDriver{driver: driver, timeout: timeout, sem: make(chan struct{}, 1)}
+}
+
+// call runs fn once the lock is acquired. When the context is done first the error of the context is
+// returned straight away, the lock is held until fn returns as the driver may still be using its
+// connection. The result is passed back over a channel so a call that outlives its context never
+// writes to anything the caller still holds.
+func (l *LockedDriver) call(ctx context.Context, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if l.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.timeout)
+		defer cancel()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	select {
+	case l.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	done := make(chan lockedResult, 1)
+	go func() {
+		defer func() { <-l.sem }()
+		v, err := fn(ctx)
+		done <- lockedResult{v: v, err: err}
+	}()
+	select {
+	case r := <-done:
+		return r.v, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// do is call for the methods which only return an error
+func (l *LockedDriver) do(ctx context.Context, fn func(ctx context.Context) error) error {
+	_, err := l.call(ctx, func(ctx context.Context) (interface{}, error) {
+		return nil, fn(ctx)
+	})
+	return err
+}
+
+func (l *LockedDriver) Add(ctx context.Context, filename string, torrent io.Reader, path string, label string, opts AddOptions) error {
+	return l.do(ctx, func(ctx context.Context) error {
+		return l.driver.Add(ctx, filename, torrent, path, label, opts)
+	})
+}
+
+func (l *LockedDriver) Announce(ctx context.Context, hash string) error {
+	return l.do(ctx, func(ctx context.Context) error {
+		return l.driver.Announce(ctx, hash)
+	})
+}
+
+func (l *LockedDriver) ClientVersion(ctx context.Context) (string, error) {
+	v, err := l.call(ctx, func(ctx context.Context) (interface{}, error) {
+		return l.driver.ClientVersion(ctx)
+	})
+	if err != nil {
+		return "", err
+	}
+	return v.(string), nil
+}
+
+// Capabilities does not call the client so it is not serialised
+func (l *LockedDriver) Capabilities() Capabilities {
+	return l.driver.Capabilities()
+}
+
+// Stateless reports whether the wrapped driver is stateless
+func (l *LockedDriver) Stateless() bool {
+	return isStateless(l.driver)
+}
+
+// Close waits for any call still in flight, closing the connection under it could crash the driver
+func (l *LockedDriver) Close() error {
+	l.sem <- struct{}{}
+	defer func() { <-l.sem }()
+	return l.driver.Close()
+}
+
+func (l *LockedDriver) Export(ctx context.Context, hash string) ([]byte, error) {
+	v, err := l.call(ctx, func(ctx context.Context) (interface{}, error) {
+		return l.driver.Export(ctx, hash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+func (l *LockedDriver) Files(ctx context.Context, hash string) ([]File, error) {
+	v, err := l.call(ctx, func(ctx context.Context) (interface{}, error) {
+		return l.driver.Files(ctx, hash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]File), nil
+}
+
+func (l *LockedDriver) FreeSpace(ctx context.Context, path string) (int64, error) {
+	v, err := l.call(ctx, func(ctx context.Context) (interface{}, error) {
+		return l.driver.FreeSpace(ctx, path)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return v.(int64), nil
+}
+
+func (l *LockedDriver) Login(ctx context.Context) error {
+	return l.do(ctx, func(ctx context.Context) error {
+		return l.driver.Login(ctx)
+	})
+}
+
+func (l *LockedDriver) Move(ctx context.Context, hash string, dest string) error {
+	return l.do(ctx, func(ctx context.Context) error {
+		return l.driver.Move(ctx, hash, dest)
+	})
+}
+
+func (l *LockedDriver) MoveMany(ctx context.Context, hashes []string, dest string) error {
+	return l.do(ctx, func(ctx context.Context) error {
+		return l.driver.MoveMany(ctx, hashes, dest)
+	})
+}
+
+func (l *LockedDriver) Pause(ctx context.Context, hash string) error {
+	return l.do(ctx, func(ctx context.Context) error {
+		return l.driver.Pause(ctx, hash)
+	})
+}
+
+func (l *LockedDriver) PauseAll(ctx context.Context) error {
+	return l.do(ctx, func(ctx context.Context) error {
+		return l.driver.PauseAll(ctx)
+	})
+}
+
+func (l *LockedDriver) PauseMany(ctx context.Context, hashes []string) error {
+	return l.do(ctx, func(ctx context.Context) error {
+		return l.driver.PauseMany(ctx, hashes)
+	})
+}
+
+func (l *LockedDriver) Peers(ctx context.Context, hash string) ([]Peer, error) {
+	v, err := l.call(ctx, func(ctx context.Context) (interface{}, error) {
+		return l.driver.Peers(ctx, hash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]Peer), nil
+}
+
+func (l *LockedDriver) Queue(ctx context.Context, hash string, position QueuePos) error {
+	return l.do(ctx, func(ctx context.Context) error {
+		return l.driver.Queue(ctx, hash, position)
+	})
+}
+
+func (l *LockedDriver) Remove(ctx context.Context, hash string, deleteData bool) error {
+	return l.do(ctx, func(ctx context.Context) error {
+		return l.driver.Remove(ctx, hash, deleteData)
+	})
+}
+
+func (l *LockedDriver) SetFilePriority(ctx context.Context, hash string, index int, priority FilePriority) error {
+	return l.do(ctx, func(ctx context.Context) error {
+		return l.driver.SetFilePriority(ctx, hash, index, priority)
+	})
+}
+
+func (l *LockedDriver) RemoveMany(ctx context.Context, hashes []string, deleteData bool) error {
+	return l.do(ctx, func(ctx context.Context) error {
+		return l.driver.RemoveMany(ctx, hashes, deleteData)
+	})
+}
+
+func (l *LockedDriver) SessionSettings(ctx context.Context) (*SessionSettings, error) {
+	v, err := l.call(ctx, func(ctx context.Context) (interface{}, error) {
+		return l.driver.SessionSettings(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*SessionSettings), nil
+}
+
+func (l *LockedDriver) SetSessionSettings(ctx context.Context, settings *SessionSettings) error {
+	return l.do(ctx, func(ctx context.Context) error {
+		return l.driver.SetSessionSettings(ctx, settings)
+	})
+}
+
+func (l *LockedDriver) SetLimits(ctx context.Context, hash string, upload int64, download int64) error {
+	return l.do(ctx, func(ctx context.Context) error {
+		return l.driver.SetLimits(ctx, hash, upload, download)
+	})
+}
+
+func (l *LockedDriver) SetLocation(ctx context.Context, hash string, dest string) error {
+	return l.do(ctx, func(ctx context.Context) error {
+		return l.driver.SetLocation(ctx, hash, dest)
+	})
+}
+
+func (l *LockedDriver) Start(ctx context.Context, hash string) error {
+	return l.do(ctx, func(ctx context.Context) error {
+		return l.driver.Start(ctx, hash)
+	})
+}
+
+func (l *LockedDriver) StartAll(ctx context.Context) error {
+	return l.do(ctx, func(ctx context.Context) error {
+		return l.driver.StartAll(ctx)
+	})
+}
+
+func (l *LockedDriver) Stop(ctx context.Context, hash string) error {
+	return l.do(ctx, func(ctx context.Context) error {
+		return l.driver.Stop(ctx, hash)
+	})
+}
+
+func (l *LockedDriver) Torrent(ctx context.Context, hash string, torrent *Torrent) error {
+	v, err := l.call(ctx, func(ctx context.Context) (interface{}, error) {
+		var t Torrent
+		err := l.driver.Torrent(ctx, hash, &t)
+		return &t, err
+	})
+	if err != nil {
+		return err
+	}
+	*torrent = *v.(*Torrent)
+	return nil
+}
+
+func (l *LockedDriver) Torrents(ctx context.Context) ([]*Torrent, error) {
+	v, err := l.call(ctx, func(ctx context.Context) (interface{}, error) {
+		return l.driver.Torrents(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]*Torrent), nil
+}
+
+func (l *LockedDriver) TorrentsByHash(ctx context.Context, hashes []string) (map[string]*Torrent, error) {
+	v, err := l.call(ctx, func(ctx context.Context) (interface{}, error) {
+		return l.driver.TorrentsByHash(ctx, hashes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[string]*Torrent), nil
+}
+
+func (l *LockedDriver) TorrentsWithState(ctx context.Context, statuses ...State) ([]*Torrent, error) {
+	v, err := l.call(ctx, func(ctx context.Context) (interface{}, error) {
+		return l.driver.TorrentsWithState(ctx, statuses...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]*Torrent), nil
+}
+
+func (l *LockedDriver) Trackers(ctx context.Context, hash string) ([]Tracker, error) {
+	v, err := l.call(ctx, func(ctx context.Context) (interface{}, error) {
+		return l.driver.Trackers(ctx, hash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]Tracker), nil
+}
+
+func (l *LockedDriver) Verify(ctx context.Context, hash string) error {
+	return l.do(ctx, func(ctx context.Context) error {
+		return l.driver.Verify(ctx, hash)
+	})
+}
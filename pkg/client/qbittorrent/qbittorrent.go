@@ -1,6 +1,8 @@
 package qbittorrent
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/KnutZuidema/go-qbittorrent"
 	"github.com/KnutZuidema/go-qbittorrent/pkg/model"
@@ -9,24 +11,42 @@ import (
 	log "github.com/sirupsen/logrus"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 )
 
 const driverName = "qbittorrent"
 
 var (
 	stateMap = map[model.TorrentState]client.State{
-		model.StateUnknown:     client.Unknown,
-		model.StateAllocating:  client.Allocating,
-		model.StateCheckingDL:  client.Checking,
-		model.StateCheckingUP:  client.Checking,
-		model.StateDownloading: client.Downloading,
-		model.StateError:       client.Error,
-		model.StateMoving:      client.Moving,
-		model.StatePausedDL:    client.Paused,
-		model.StatePausedUP:    client.Paused,
-		model.StateQueuedDL:    client.Queued,
-		model.StateQueuedUP:    client.Queued,
-		model.StateUploading:   client.Seeding,
+		model.StateUnknown:            client.Unknown,
+		model.StateAllocating:         client.Allocating,
+		model.StateCheckingDL:         client.Checking,
+		model.StateCheckingUP:         client.Checking,
+		model.StateDownloading:        client.Downloading,
+		model.StateError:              client.Error,
+		model.StateMoving:             client.Moving,
+		model.StatePausedDL:           client.Paused,
+		model.StatePausedUP:           client.Paused,
+		model.StateQueuedDL:           client.Queued,
+		model.StateQueuedUP:           client.Queued,
+		model.StateUploading:          client.Seeding,
+		model.StateStalledUP:          client.Seeding,
+		model.StateForcedUP:           client.Seeding,
+		model.StateStalledDL:          client.Downloading,
+		model.StateForceDL:            client.Downloading,
+		model.StateMetaDL:             client.Downloading,
+		model.StateMissingFiles:       client.Error,
+		model.StateCheckingResumeData: client.Checking,
+	}
+	trackerStateMap = map[model.TrackerStatus]client.TrackerStatus{
+		model.TrackerStatusDisabled:     client.TrackerDisabled,
+		model.TrackerStatusNotContacted: client.TrackerNotContacted,
+		model.TrackerStatusWorking:      client.TrackerWorking,
+		model.TrackerStatusUpdating:     client.TrackerUpdating,
+		model.TrackerStatusNotWorking:   client.TrackerError,
 	}
 )
 
@@ -35,11 +55,11 @@ type QBittorrent struct {
 	qb  *qbittorrent.Client
 }
 
-func (driver QBittorrent) FreeSpace(path string) (int64, error) {
-	panic("implement me")
+func (driver QBittorrent) FreeSpace(ctx context.Context, path string) (int64, error) {
+	return 0, errors.Wrapf(client.ErrUnsupported, "qbittorrent cannot get free space of a path")
 }
 
-func (driver QBittorrent) Add(name string, torrent io.Reader, path string, label string) error {
+func (driver QBittorrent) Add(ctx context.Context, name string, torrent io.Reader, path string, label string, opts client.AddOptions) error {
 	b, err := ioutil.ReadAll(torrent)
 	if err != nil {
 		return err
@@ -47,17 +67,28 @@ func (driver QBittorrent) Add(name string, torrent io.Reader, path string, label
 	args := map[string][]byte{
 		name: b,
 	}
-	return driver.qb.Torrent.AddFiles(args, &model.AddTorrentsOptions{
+	options := &model.AddTorrentsOptions{
 		Savepath: path,
 		Category: label,
-	})
+	}
+	if opts.Paused {
+		options.Paused = "true"
+	}
+	return driver.qb.Torrent.AddFiles(args, options)
+}
+
+// Capabilities does not include CapFreeSpace, the WebUI only reports the free space of the default
+// save path. CapSetLocation is not included either as SetLocation may move data, see SetLocation.
+func (driver QBittorrent) Capabilities() client.Capabilities {
+	return client.NewCapabilities(client.CapQueue, client.CapLabels, client.CapVerify, client.CapMoveData,
+		client.CapFilePriorities, client.CapAnnounce, client.CapSessionLimits)
 }
 
-func (driver QBittorrent) Announce(hash string) error {
+func (driver QBittorrent) Announce(ctx context.Context, hash string) error {
 	return driver.qb.Torrent.ReannounceTorrents([]string{hash})
 }
 
-func (driver QBittorrent) ClientVersion() (string, error) {
+func (driver QBittorrent) ClientVersion(ctx context.Context) (string, error) {
 	appVer, err := driver.qb.Application.GetAppVersion()
 	if err != nil {
 		return "", err
@@ -69,21 +100,238 @@ func (driver QBittorrent) ClientVersion() (string, error) {
 	return fmt.Sprintf("%s / %s", appVer, apiVer), nil
 }
 
+// Export uses the torrents/export endpoint (qBittorrent 4.5+), falling back to the BT_backup
+// state directory for older versions.
+func (driver QBittorrent) Export(ctx context.Context, hash string) ([]byte, error) {
+	params := url.Values{}
+	params.Add("hash", hash)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, driver.qb.Torrent.BaseUrl+"/export?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := driver.qb.Torrent.Client.Do(req)
+	if err == nil {
+		defer func() {
+			if errC := resp.Body.Close(); errC != nil {
+				log.Errorf("Failed to close response body: %v", errC)
+			}
+		}()
+		if resp.StatusCode == http.StatusOK {
+			return ioutil.ReadAll(resp.Body)
+		}
+		log.Debugf("Export endpoint unavailable (%s), trying state_dir", resp.Status)
+	}
+	return client.ReadStateFile(driver.cfg.StateDir, hash)
+}
+
+// getJSON decodes a GET request against the api. This is used for endpoints the library does not
+// cover or decodes incorrectly.
+func (driver QBittorrent) getJSON(ctx context.Context, endpoint string, params url.Values, target interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := driver.qb.Torrent.Client.Do(req)
+	if err != nil {
+		return errors.Wrapf(client.ErrDriverError, "Failed to query %s: %v", endpoint, err)
+	}
+	defer func() {
+		if errC := resp.Body.Close(); errC != nil {
+			log.Errorf("Failed to close response body: %v", errC)
+		}
+	}()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return client.ErrUnknownTorrent
+	default:
+		return errors.Wrapf(client.ErrDriverError, "Invalid response status: %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(target)
+}
+
+// preferences is the subset of app/preferences managed by seedr. The library model is not used as
+// it would send every preference back when only some are changed.
+type preferences struct {
+	UpLimit             *int64 `json:"up_limit,omitempty"`
+	DlLimit             *int64 `json:"dl_limit,omitempty"`
+	MaxActiveDownloads  *int   `json:"max_active_downloads,omitempty"`
+	MaxActiveUploads    *int   `json:"max_active_uploads,omitempty"`
+	MaxConnec           *int   `json:"max_connec,omitempty"`
+	MaxConnecPerTorrent *int   `json:"max_connec_per_torrent,omitempty"`
+}
+
+// fromUnlimited converts qbittorrents -1 is unlimited counts to our 0 is unlimited form
+func fromUnlimited(v *int) *int {
+	if v == nil || *v >= 0 {
+		return v
+	}
+	r := 0
+	return &r
+}
+
+func toUnlimited(v *int) *int {
+	if v == nil || *v != 0 {
+		return v
+	}
+	r := -1
+	return &r
+}
+
+func (driver QBittorrent) SessionSettings(ctx context.Context) (*client.SessionSettings, error) {
+	var prefs preferences
+	if err := driver.getJSON(ctx, driver.qb.Application.BaseUrl+"/preferences", url.Values{}, &prefs); err != nil {
+		return nil, err
+	}
+	return &client.SessionSettings{
+		UploadLimit:              prefs.UpLimit,
+		DownloadLimit:            prefs.DlLimit,
+		MaxActiveDownloads:       fromUnlimited(prefs.MaxActiveDownloads),
+		MaxActiveSeeding:         fromUnlimited(prefs.MaxActiveUploads),
+		MaxConnections:           fromUnlimited(prefs.MaxConnec),
+		MaxConnectionsPerTorrent: fromUnlimited(prefs.MaxConnecPerTorrent),
+	}, nil
+}
+
+func (driver QBittorrent) SetSessionSettings(ctx context.Context, settings *client.SessionSettings) error {
+	prefs := preferences{
+		UpLimit:             settings.UploadLimit,
+		DlLimit:             settings.DownloadLimit,
+		MaxActiveDownloads:  toUnlimited(settings.MaxActiveDownloads),
+		MaxActiveUploads:    toUnlimited(settings.MaxActiveSeeding),
+		MaxConnec:           toUnlimited(settings.MaxConnections),
+		MaxConnecPerTorrent: toUnlimited(settings.MaxConnectionsPerTorrent),
+	}
+	b, err := json.Marshal(prefs)
+	if err != nil {
+		return err
+	}
+	form := url.Values{}
+	form.Add("json", string(b))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, driver.qb.Application.BaseUrl+"/setPreferences",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := driver.qb.Application.Client.Do(req)
+	if err != nil {
+		return errors.Wrapf(client.ErrDriverError, "Failed to set preferences: %v", err)
+	}
+	if errC := resp.Body.Close(); errC != nil {
+		log.Errorf("Failed to close response body: %v", errC)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Wrapf(client.ErrDriverError, "Invalid response status: %s", resp.Status)
+	}
+	return nil
+}
+
+func (driver QBittorrent) SetLimits(ctx context.Context, hash string, upload int64, download int64) error {
+	hashes := []string{hash}
+	if err := driver.qb.Torrent.SetUploadLimits(hashes, int(upload)); err != nil {
+		return err
+	}
+	return driver.qb.Torrent.SetDownloadLimits(hashes, int(download))
+}
+
+// torrentFile is an entry of the torrents/files endpoint. The library model has invalid json tags
+// so it cannot be used.
+type torrentFile struct {
+	Index    *int    `json:"index"`
+	Name     string  `json:"name"`
+	Size     int64   `json:"size"`
+	Progress float64 `json:"progress"`
+	Priority int     `json:"priority"`
+}
+
+// mapFilePriority converts the qbittorrent priority, 0 skips the file, 1 is normal, 6 high and
+// 7 maximum. There is no low priority.
+func mapFilePriority(p int) client.FilePriority {
+	switch {
+	case p <= 0:
+		return client.PrioritySkip
+	case p >= 6:
+		return client.PriorityHigh
+	default:
+		return client.PriorityNormal
+	}
+}
+
+func (driver QBittorrent) Files(ctx context.Context, hash string) ([]client.File, error) {
+	params := url.Values{}
+	params.Add("hash", hash)
+	var qFiles []torrentFile
+	if err := driver.getJSON(ctx, driver.qb.Torrent.BaseUrl+"/files", params, &qFiles); err != nil {
+		return nil, err
+	}
+	files := make([]client.File, len(qFiles))
+	for i, f := range qFiles {
+		idx := i
+		// Versions before 4.2 do not include the index, the position is used instead
+		if f.Index != nil {
+			idx = *f.Index
+		}
+		files[i] = client.File{Index: idx, Path: f.Name, Size: f.Size, Progress: f.Progress,
+			Priority: mapFilePriority(f.Priority)}
+	}
+	return files, nil
+}
+
+// SetFilePriority maps low priority to normal as qbittorrent does not have a lower priority
+func (driver QBittorrent) SetFilePriority(ctx context.Context, hash string, index int, priority client.FilePriority) error {
+	var p model.TorrentPriority
+	switch priority {
+	case client.PrioritySkip:
+		p = model.PriorityDoNotDownload
+	case client.PriorityHigh:
+		p = model.PriorityHigh
+	default:
+		p = model.PriorityNormal
+	}
+	return driver.qb.Torrent.SetFilePriorities(hash, []string{strconv.Itoa(index)}, p)
+}
+
 func (driver QBittorrent) Close() error {
 	return nil
 }
 
-func (driver QBittorrent) Move(hash string, dest string) error {
+func (driver QBittorrent) Stateless() bool {
+	return true
+}
+
+func (driver QBittorrent) Move(ctx context.Context, hash string, dest string) error {
+	return driver.qb.Torrent.SetLocations([]string{hash}, dest)
+}
+
+func (driver QBittorrent) MoveMany(ctx context.Context, hashes []string, dest string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	return driver.qb.Torrent.SetLocations(hashes, dest)
+}
+
+// SetLocation uses the same setLocation endpoint as Move, qBittorrent has no way to only change the save
+// path. Whether files already at the destination are kept or replaced is not guaranteed by the API so
+// the local mover refuses to run against qBittorrent.
+func (driver QBittorrent) SetLocation(ctx context.Context, hash string, dest string) error {
 	return driver.qb.Torrent.SetLocations([]string{hash}, dest)
 }
 
-func (driver QBittorrent) Pause(hash string) error {
+func (driver QBittorrent) Pause(ctx context.Context, hash string) error {
 	return driver.qb.Torrent.StopTorrents([]string{hash})
 }
 
-func (driver QBittorrent) getHashes() ([]string, error) {
+func (driver QBittorrent) PauseMany(ctx context.Context, hashes []string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	return driver.qb.Torrent.StopTorrents(hashes)
+}
+
+func (driver QBittorrent) getHashes(ctx context.Context) ([]string, error) {
 	var hashes []string
-	torrents, err := driver.Torrents()
+	torrents, err := driver.Torrents(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -93,15 +341,49 @@ func (driver QBittorrent) getHashes() ([]string, error) {
 	return hashes, nil
 }
 
-func (driver QBittorrent) PauseAll() error {
-	hashes, err := driver.getHashes()
+func (driver QBittorrent) PauseAll(ctx context.Context) error {
+	hashes, err := driver.getHashes(ctx)
 	if err != nil {
 		return err
 	}
 	return driver.qb.Torrent.StopTorrents(hashes)
 }
 
-func (driver QBittorrent) Queue(hash string, position client.QueuePos) error {
+// torrentPeer is an entry of the sync/torrentPeers endpoint, the library model uses the wrong key
+// for the download speed
+type torrentPeer struct {
+	IP       string  `json:"ip"`
+	Port     int     `json:"port"`
+	Client   string  `json:"client"`
+	Progress float64 `json:"progress"`
+	DLSpeed  int64   `json:"dl_speed"`
+	UPSpeed  int64   `json:"up_speed"`
+}
+
+func (driver QBittorrent) Peers(ctx context.Context, hash string) ([]client.Peer, error) {
+	params := url.Values{}
+	params.Add("hash", hash)
+	params.Add("rid", "0")
+	var data struct {
+		Peers map[string]torrentPeer `json:"peers"`
+	}
+	if err := driver.getJSON(ctx, driver.qb.Sync.BaseUrl+"/torrentPeers", params, &data); err != nil {
+		return nil, err
+	}
+	var peers []client.Peer
+	for _, p := range data.Peers {
+		peers = append(peers, client.Peer{
+			Address:  fmt.Sprintf("%s:%d", p.IP, p.Port),
+			Client:   p.Client,
+			Progress: p.Progress,
+			SpeedUP:  p.UPSpeed,
+			SpeedDN:  p.DLSpeed,
+		})
+	}
+	return peers, nil
+}
+
+func (driver QBittorrent) Queue(ctx context.Context, hash string, position client.QueuePos) error {
 	hashes := []string{hash}
 	switch position {
 	case client.Top:
@@ -113,46 +395,66 @@ func (driver QBittorrent) Queue(hash string, position client.QueuePos) error {
 	}
 }
 
-func (driver QBittorrent) Remove(hash string, deleteData bool) error {
+func (driver QBittorrent) Remove(ctx context.Context, hash string, deleteData bool) error {
 	return driver.qb.Torrent.DeleteTorrents([]string{hash}, deleteData)
 }
 
-func (driver QBittorrent) Start(hash string) error {
+func (driver QBittorrent) RemoveMany(ctx context.Context, hashes []string, deleteData bool) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	return driver.qb.Torrent.DeleteTorrents(hashes, deleteData)
+}
+
+func (driver QBittorrent) Start(ctx context.Context, hash string) error {
 	return driver.qb.Torrent.ResumeTorrents([]string{hash})
 }
 
-func (driver QBittorrent) StartAll() error {
-	hashes, err := driver.getHashes()
+func (driver QBittorrent) StartAll(ctx context.Context) error {
+	hashes, err := driver.getHashes(ctx)
 	if err != nil {
 		return err
 	}
 	return driver.qb.Torrent.ResumeTorrents(hashes)
 }
 
-func (driver QBittorrent) Stop(hash string) error {
+func (driver QBittorrent) Stop(ctx context.Context, hash string) error {
 	return driver.qb.Torrent.StopTorrents([]string{hash})
 }
 
-func (driver QBittorrent) Torrent(hash string, torrent *client.Torrent) error {
-	torrents, err := driver.qb.Torrent.GetList(&model.GetTorrentListOptions{
-		Filter: model.FilterAll,
-	})
+func (driver QBittorrent) Torrent(ctx context.Context, hash string, torrent *client.Torrent) error {
+	torrents, err := driver.TorrentsByHash(ctx, []string{hash})
 	if err != nil {
 		return err
 	}
-	for _, t := range torrents {
-		if t.Hash == hash {
-			mapTorrentStatus(t, torrent)
-			return nil
-		}
+	t, found := torrents[hash]
+	if !found {
+		return client.ErrUnknownTorrent
+	}
+	*torrent = *t
+	return nil
+}
+
+// TorrentsByHash uses the hashes filter of the torrent list so only the requested torrents are sent
+func (driver QBittorrent) TorrentsByHash(ctx context.Context, hashes []string) (map[string]*client.Torrent, error) {
+	torrents := make(map[string]*client.Torrent, len(hashes))
+	if len(hashes) == 0 {
+		return torrents, nil
+	}
+	qTorrents, err := driver.torrentList(ctx, hashes)
+	if err != nil {
+		return nil, err
 	}
-	return client.ErrUnknownTorrent
+	for _, t := range qTorrents {
+		var torrent client.Torrent
+		mapTorrentStatus(t, &torrent)
+		torrents[torrent.Hash] = &torrent
+	}
+	return torrents, nil
 }
 
-func (driver QBittorrent) TorrentsWithState(statuses ...client.State) ([]client.Torrent, error) {
-	torrents, err := driver.qb.Torrent.GetList(&model.GetTorrentListOptions{
-		Filter: model.FilterAll,
-	})
+func (driver QBittorrent) TorrentsWithState(ctx context.Context, statuses ...client.State) ([]*client.Torrent, error) {
+	torrents, err := driver.torrentList(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -164,13 +466,13 @@ func (driver QBittorrent) TorrentsWithState(statuses ...client.State) ([]client.
 			}
 		}
 	}
-	var validTorrents []client.Torrent
+	var validTorrents []*client.Torrent
 	for _, t := range torrents {
 		for _, state := range validStates {
 			if state == t.State {
 				var tor client.Torrent
 				mapTorrentStatus(t, &tor)
-				validTorrents = append(validTorrents, tor)
+				validTorrents = append(validTorrents, &tor)
 				break
 			}
 		}
@@ -178,36 +480,89 @@ func (driver QBittorrent) TorrentsWithState(statuses ...client.State) ([]client.
 	return validTorrents, nil
 }
 
-func (driver QBittorrent) Verify(hash string) error {
+// Trackers skips the DHT, PeX and LSD pseudo trackers. qbittorrent does not report the next announce time.
+func (driver QBittorrent) Trackers(ctx context.Context, hash string) ([]client.Tracker, error) {
+	qTrackers, err := driver.qb.Torrent.GetTrackers(hash)
+	if err != nil {
+		return nil, errors.Wrapf(client.ErrDriverError, "Failed to get trackers: %v", err)
+	}
+	var trackers []client.Tracker
+	for _, t := range qTrackers {
+		if strings.HasPrefix(t.URL, "**") {
+			continue
+		}
+		trackers = append(trackers, client.Tracker{
+			URL:      t.URL,
+			Tier:     t.Tier,
+			Status:   trackerStateMap[t.Status],
+			Message:  t.Message,
+			Seeders:  t.NumSeeds,
+			Leechers: t.NumLeeches,
+		})
+	}
+	return trackers, nil
+}
+
+func (driver QBittorrent) Verify(ctx context.Context, hash string) error {
 	return driver.qb.Torrent.RecheckTorrents([]string{hash})
 }
 
-func (driver QBittorrent) Login() error {
+func (driver QBittorrent) Login(ctx context.Context) error {
 	if err := driver.qb.Login(driver.cfg.Username, driver.cfg.Password); err != nil {
 		return errors.Wrapf(client.ErrAuthFailed, "Error trying to login: %v", err)
 	}
 	return nil
 }
 
-func mapTorrentStatus(status *model.Torrent, torrent *client.Torrent) {
+// torrentInfo is an entry of the torrents/info endpoint, the library model is missing the save path
+type torrentInfo struct {
+	model.Torrent
+	SavePath string `json:"save_path"`
+}
+
+// torrentList fetches the torrents/info list, hashes filters the list when not empty
+func (driver QBittorrent) torrentList(ctx context.Context, hashes []string) ([]*torrentInfo, error) {
+	params := url.Values{}
+	params.Add("filter", string(model.FilterAll))
+	if len(hashes) > 0 {
+		params.Add("hashes", strings.Join(hashes, "|"))
+	}
+	var torrents []*torrentInfo
+	if err := driver.getJSON(ctx, driver.qb.Torrent.BaseUrl+"/info", params, &torrents); err != nil {
+		return nil, errors.Wrapf(err, "Failed to fetch torrents")
+	}
+	return torrents, nil
+}
+
+func mapTorrentStatus(status *torrentInfo, torrent *client.Torrent) {
 	torrent.Hash = status.Hash
 	torrent.Name = status.Name
+	torrent.Path = status.SavePath
+	torrent.Label = status.Category
 	torrent.Size = int64(status.Size)
 	torrent.Ratio = status.Ratio
-	// TODO get path
-	// torrent.Path = ???
+	torrent.Progress = status.Progress
+	torrent.Seeds = status.NumSeeds
+	torrent.Peers = status.NumLeechs
+	torrent.SpeedUP = int64(status.Upspeed)
+	torrent.SpeedDN = int64(status.Dlspeed)
+	state, found := stateMap[status.State]
+	if !found {
+		state = client.Unknown
+	}
+	torrent.State = state
 }
 
-func (driver QBittorrent) Torrents() ([]client.Torrent, error) {
-	qTorrents, err := driver.qb.Torrent.GetList(nil)
+func (driver QBittorrent) Torrents(ctx context.Context) ([]*client.Torrent, error) {
+	qTorrents, err := driver.torrentList(ctx, nil)
 	if err != nil {
-		return nil, errors.Wrapf(client.ErrDriverError, "Failed to fetch torrents: %v", err)
+		return nil, err
 	}
-	var torrents []client.Torrent
+	var torrents []*client.Torrent
 	for _, t := range qTorrents {
 		var torrent client.Torrent
 		mapTorrentStatus(t, &torrent)
-		torrents = append(torrents, torrent)
+		torrents = append(torrents, &torrent)
 	}
 	return torrents, nil
 }
@@ -215,8 +570,14 @@ func (driver QBittorrent) Torrents() ([]client.Torrent, error) {
 type Factory struct{}
 
 func (f Factory) New(cfg *client.Config) (client.Driver, error) {
-	url := fmt.Sprintf("http://%s:%d", cfg.Host, cfg.Port)
-	c := qbittorrent.NewClient(url, log.WithField("component", "QBitTorrent Client"))
+	transport, err := cfg.Transport()
+	if err != nil {
+		return nil, err
+	}
+	c := qbittorrent.NewClient(cfg.URL(""), log.WithField("component", "QBitTorrent Client"))
+	// The http client is shared by all of the library clients, the library calls do not accept a context
+	c.Application.Client.Timeout = cfg.Timeout
+	c.Application.Client.Transport = transport
 	return QBittorrent{cfg: cfg, qb: c}, nil
 }
 
@@ -1,14 +1,20 @@
 package qbittorrent
 
 import (
+	"context"
 	"github.com/leighmacdonald/seedr/pkg/client"
 	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 )
 
 func TestQBittorrent(t *testing.T) {
 	f := Factory{}
-	c, err := f.New(client.Config{
+	c, err := f.New(&client.Config{
 		Driver:   "qbittorrent",
 		Username: "test_user",
 		Password: "test_pass",
@@ -19,3 +25,27 @@ func TestQBittorrent(t *testing.T) {
 	require.NoErrorf(t, err, "failed to create qbittorrent client")
 	client.DriverTestSuite(t, c)
 }
+
+func TestQBittorrentTorrents(t *testing.T) {
+	var query url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/torrents/info" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		query = r.URL.Query()
+		_, _ = w.Write([]byte(`[{"hash":"abc","name":"Release","size":100,"progress":1,"state":"stalledUP",
+			"category":"tv","save_path":"/data/tv"}]`))
+	}))
+	defer srv.Close()
+	addr := srv.Listener.Addr().(*net.TCPAddr)
+	d, err := Factory{}.New(&client.Config{Host: addr.IP.String(), Port: uint16(addr.Port), Timeout: time.Second * 5})
+	require.NoError(t, err)
+	var torrent client.Torrent
+	require.NoError(t, d.Torrent(context.Background(), "abc", &torrent))
+	require.Equal(t, "abc", query.Get("hashes"))
+	require.Equal(t, "/data/tv", torrent.Path)
+	require.Equal(t, "tv", torrent.Label)
+	require.Equal(t, client.Seeding, torrent.State)
+	require.Equal(t, int64(100), torrent.Size)
+}
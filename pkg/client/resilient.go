@@ -0,0 +1,471 @@
+package client
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// connErrors are matched against error messages as most drivers wrap the underlying network error
+// as a string
+var connErrors = []string{
+	"connection refused",
+	"connection reset",
+	"connection aborted",
+	"broken pipe",
+	"use of closed network connection",
+	"i/o timeout",
+	"no route to host",
+	"network is unreachable",
+	"not connected",
+	"eof",
+}
+
+// IsConnectionError returns true when err indicates the connection to the client was lost, as
+// opposed to the client rejecting the call. A rejected login is not one, logging in again would
+// only fail the same way.
+func IsConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	// A call that timed out leaves the connection in an unknown state, eg: deluge would receive the
+	// late response as the reply to the next call
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range connErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Health is the connection state of a ResilientDriver
+type Health struct {
+	Connected bool `json:"connected"`
+	// Failures is the number of consecutive failed calls or reconnect attempts
+	Failures    int       `json:"failures"`
+	Reconnects  int       `json:"reconnects"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastFailure time.Time `json:"last_failure,omitempty"`
+	LastSuccess time.Time `json:"last_success,omitempty"`
+}
+
+// RetryOpts controls how a ResilientDriver reconnects
+type RetryOpts struct {
+	// MaxRetries is the number of times an idempotent call is retried after a connection failure
+	MaxRetries int
+	// MinBackoff is the delay before the first retry, doubling with each attempt up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// OnChange is called when the connection is lost or restored
+	OnChange func(health Health)
+}
+
+// ResilientDriver reconnects to the client when a call fails due to a lost connection. Idempotent
+// calls are retried with exponential backoff, calls that are not safe to repeat, such as Remove,
+// return the error and the connection is restored before the next call.
+type ResilientDriver struct {
+	driver Driver
+	opts   RetryOpts
+	mu     *sync.RWMutex
+	health Health
+	// reconnectMu serializes reconnects. generation counts them so the callers that saw the same
+	// connection fail only reconnect once.
+	reconnectMu *sync.Mutex
+	generation  int
+	// sleep is replaced in tests
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func NewResilientDriver(driver Driver, opts RetryOpts) *ResilientDriver {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = time.Second
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = opts.MinBackoff
+	}
+	return &ResilientDriver{
+		driver:      driver,
+		opts:        opts,
+		mu:          &sync.RWMutex{},
+		health:      Health{Connected: true},
+		reconnectMu: &sync.Mutex{},
+		sleep:       sleepContext,
+	}
+}
+
+// Health returns a copy of the current connection health
+func (r *ResilientDriver) Health() Health {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.health
+}
+
+// sleepContext waits for d, returning early with the error of ctx when it is done first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// backoff returns the delay before the given retry attempt, starting at 0
+func (r *ResilientDriver) backoff(attempt int) time.Duration {
+	d := r.opts.MinBackoff
+	for i := 0; i < attempt && d < r.opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.opts.MaxBackoff {
+		d = r.opts.MaxBackoff
+	}
+	return d
+}
+
+func (r *ResilientDriver) succeeded() {
+	r.mu.Lock()
+	restored := !r.health.Connected
+	r.health.Connected = true
+	r.health.Failures = 0
+	r.health.LastSuccess = time.Now()
+	h := r.health
+	r.mu.Unlock()
+	if restored && r.opts.OnChange != nil {
+		r.opts.OnChange(h)
+	}
+}
+
+func (r *ResilientDriver) failed(err error) {
+	r.mu.Lock()
+	lost := r.health.Connected
+	r.health.Connected = false
+	r.health.Failures++
+	r.health.LastError = err.Error()
+	r.health.LastFailure = time.Now()
+	h := r.health
+	r.mu.Unlock()
+	if lost && r.opts.OnChange != nil {
+		r.opts.OnChange(h)
+	}
+}
+
+func (r *ResilientDriver) currentGeneration() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.generation
+}
+
+// reconnect closes the existing connection, if any, and logs in again. Stateless drivers only log in.
+// Nothing is done when another caller reconnected since gen, the generation the caller saw fail.
+func (r *ResilientDriver) reconnect(ctx context.Context, gen int) error {
+	r.reconnectMu.Lock()
+	defer r.reconnectMu.Unlock()
+	if r.currentGeneration() != gen {
+		return nil
+	}
+	if !isStateless(r.driver) {
+		if err := r.driver.Close(); err != nil {
+			log.Debugf("Failed to close client connection: %v", err)
+		}
+	}
+	if err := r.driver.Login(ctx); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.generation++
+	r.health.Reconnects++
+	r.mu.Unlock()
+	r.succeeded()
+	log.Infof("Reconnected to client")
+	return nil
+}
+
+// call runs fn, reconnecting first if the connection was lost. Idempotent calls are retried up to
+// MaxRetries times after a connection failure, or until ctx is done. A rejected login is not retried.
+func (r *ResilientDriver) call(ctx context.Context, idempotent bool, fn func() error) error {
+	var err error
+	gen := r.currentGeneration()
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if errSleep := r.sleep(ctx, r.backoff(attempt-1)); errSleep != nil {
+				return errSleep
+			}
+		}
+		if !r.Health().Connected {
+			if err = r.reconnect(ctx, gen); err != nil {
+				r.failed(err)
+				if !idempotent || attempt >= r.opts.MaxRetries || !IsConnectionError(err) {
+					return errors.Wrapf(ErrDriverError, "Failed to reconnect to client: %v", err)
+				}
+				continue
+			}
+		}
+		gen = r.currentGeneration()
+		err = fn()
+		if err == nil {
+			r.succeeded()
+			return nil
+		}
+		if !IsConnectionError(err) || ctx.Err() != nil {
+			return err
+		}
+		r.failed(err)
+		if !idempotent || attempt >= r.opts.MaxRetries {
+			return err
+		}
+		log.Warnf("Lost connection to client, retrying: %v", err)
+	}
+}
+
+func (r *ResilientDriver) Add(ctx context.Context, filename string, torrent io.Reader, path string, label string, opts AddOptions) error {
+	return r.call(ctx, false, func() error {
+		return r.driver.Add(ctx, filename, torrent, path, label, opts)
+	})
+}
+
+func (r *ResilientDriver) Announce(ctx context.Context, hash string) error {
+	return r.call(ctx, true, func() error {
+		return r.driver.Announce(ctx, hash)
+	})
+}
+
+func (r *ResilientDriver) ClientVersion(ctx context.Context) (string, error) {
+	var v string
+	err := r.call(ctx, true, func() error {
+		var err error
+		v, err = r.driver.ClientVersion(ctx)
+		return err
+	})
+	return v, err
+}
+
+func (r *ResilientDriver) Capabilities() Capabilities {
+	return r.driver.Capabilities()
+}
+
+func (r *ResilientDriver) Close() error {
+	return r.driver.Close()
+}
+
+func (r *ResilientDriver) Export(ctx context.Context, hash string) ([]byte, error) {
+	var b []byte
+	err := r.call(ctx, true, func() error {
+		var err error
+		b, err = r.driver.Export(ctx, hash)
+		return err
+	})
+	return b, err
+}
+
+func (r *ResilientDriver) Files(ctx context.Context, hash string) ([]File, error) {
+	var files []File
+	err := r.call(ctx, true, func() error {
+		var err error
+		files, err = r.driver.Files(ctx, hash)
+		return err
+	})
+	return files, err
+}
+
+func (r *ResilientDriver) FreeSpace(ctx context.Context, path string) (int64, error) {
+	var free int64
+	err := r.call(ctx, true, func() error {
+		var err error
+		free, err = r.driver.FreeSpace(ctx, path)
+		return err
+	})
+	return free, err
+}
+
+func (r *ResilientDriver) Login(ctx context.Context) error {
+	if err := r.driver.Login(ctx); err != nil {
+		r.failed(err)
+		return err
+	}
+	r.succeeded()
+	return nil
+}
+
+// Move is not retried as the client may have started moving the data before the connection failed
+func (r *ResilientDriver) Move(ctx context.Context, hash string, dest string) error {
+	return r.call(ctx, false, func() error {
+		return r.driver.Move(ctx, hash, dest)
+	})
+}
+
+// MoveMany is not retried for the same reason as Move
+func (r *ResilientDriver) MoveMany(ctx context.Context, hashes []string, dest string) error {
+	return r.call(ctx, false, func() error {
+		return r.driver.MoveMany(ctx, hashes, dest)
+	})
+}
+
+func (r *ResilientDriver) Pause(ctx context.Context, hash string) error {
+	return r.call(ctx, true, func() error {
+		return r.driver.Pause(ctx, hash)
+	})
+}
+
+func (r *ResilientDriver) PauseAll(ctx context.Context) error {
+	return r.call(ctx, true, func() error {
+		return r.driver.PauseAll(ctx)
+	})
+}
+
+func (r *ResilientDriver) PauseMany(ctx context.Context, hashes []string) error {
+	return r.call(ctx, true, func() error {
+		return r.driver.PauseMany(ctx, hashes)
+	})
+}
+
+func (r *ResilientDriver) Peers(ctx context.Context, hash string) ([]Peer, error) {
+	var peers []Peer
+	err := r.call(ctx, true, func() error {
+		var err error
+		peers, err = r.driver.Peers(ctx, hash)
+		return err
+	})
+	return peers, err
+}
+
+// Queue is only retried for absolute positions, moving up or down again would move it twice
+func (r *ResilientDriver) Queue(ctx context.Context, hash string, position QueuePos) error {
+	return r.call(ctx, position == Top || position == Bottom, func() error {
+		return r.driver.Queue(ctx, hash, position)
+	})
+}
+
+func (r *ResilientDriver) Remove(ctx context.Context, hash string, deleteData bool) error {
+	return r.call(ctx, false, func() error {
+		return r.driver.Remove(ctx, hash, deleteData)
+	})
+}
+
+func (r *ResilientDriver) RemoveMany(ctx context.Context, hashes []string, deleteData bool) error {
+	return r.call(ctx, false, func() error {
+		return r.driver.RemoveMany(ctx, hashes, deleteData)
+	})
+}
+
+func (r *ResilientDriver) SessionSettings(ctx context.Context) (*SessionSettings, error) {
+	var settings *SessionSettings
+	err := r.call(ctx, true, func() error {
+		var err error
+		settings, err = r.driver.SessionSettings(ctx)
+		return err
+	})
+	return settings, err
+}
+
+func (r *ResilientDriver) SetSessionSettings(ctx context.Context, settings *SessionSettings) error {
+	return r.call(ctx, true, func() error {
+		return r.driver.SetSessionSettings(ctx, settings)
+	})
+}
+
+func (r *ResilientDriver) SetFilePriority(ctx context.Context, hash string, index int, priority FilePriority) error {
+	return r.call(ctx, true, func() error {
+		return r.driver.SetFilePriority(ctx, hash, index, priority)
+	})
+}
+
+func (r *ResilientDriver) SetLimits(ctx context.Context, hash string, upload int64, download int64) error {
+	return r.call(ctx, true, func() error {
+		return r.driver.SetLimits(ctx, hash, upload, download)
+	})
+}
+
+func (r *ResilientDriver) SetLocation(ctx context.Context, hash string, dest string) error {
+	return r.call(ctx, false, func() error {
+		return r.driver.SetLocation(ctx, hash, dest)
+	})
+}
+
+func (r *ResilientDriver) Start(ctx context.Context, hash string) error {
+	return r.call(ctx, true, func() error {
+		return r.driver.Start(ctx, hash)
+	})
+}
+
+func (r *ResilientDriver) StartAll(ctx context.Context) error {
+	return r.call(ctx, true, func() error {
+		return r.driver.StartAll(ctx)
+	})
+}
+
+func (r *ResilientDriver) Stop(ctx context.Context, hash string) error {
+	return r.call(ctx, true, func() error {
+		return r.driver.Stop(ctx, hash)
+	})
+}
+
+func (r *ResilientDriver) Torrent(ctx context.Context, hash string, torrent *Torrent) error {
+	return r.call(ctx, true, func() error {
+		return r.driver.Torrent(ctx, hash, torrent)
+	})
+}
+
+func (r *ResilientDriver) Torrents(ctx context.Context) ([]*Torrent, error) {
+	var torrents []*Torrent
+	err := r.call(ctx, true, func() error {
+		var err error
+		torrents, err = r.driver.Torrents(ctx)
+		return err
+	})
+	return torrents, err
+}
+
+func (r *ResilientDriver) TorrentsByHash(ctx context.Context, hashes []string) (map[string]*Torrent, error) {
+	var torrents map[string]*Torrent
+	err := r.call(ctx, true, func() error {
+		var err error
+		torrents, err = r.driver.TorrentsByHash(ctx, hashes)
+		return err
+	})
+	return torrents, err
+}
+
+func (r *ResilientDriver) TorrentsWithState(ctx context.Context, statuses ...State) ([]*Torrent, error) {
+	var torrents []*Torrent
+	err := r.call(ctx, true, func() error {
+		var err error
+		torrents, err = r.driver.TorrentsWithState(ctx, statuses...)
+		return err
+	})
+	return torrents, err
+}
+
+func (r *ResilientDriver) Trackers(ctx context.Context, hash string) ([]Tracker, error) {
+	var trackers []Tracker
+	err := r.call(ctx, true, func() error {
+		var err error
+		trackers, err = r.driver.Trackers(ctx, hash)
+		return err
+	})
+	return trackers, err
+}
+
+// Verify is not retried as a repeated call restarts the recheck
+func (r *ResilientDriver) Verify(ctx context.Context, hash string) error {
+	return r.call(ctx, false, func() error {
+		return r.driver.Verify(ctx, hash)
+	})
+}
@@ -0,0 +1,283 @@
+package client
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyDriver fails calls with a connection error until it logs in again
+type flakyDriver struct {
+	Driver
+	connected bool
+	failLogin int
+	logins    int
+	calls     int
+	removed   int
+	// wrongPassword rejects every login
+	wrongPassword bool
+}
+
+func (f *flakyDriver) Login(context.Context) error {
+	f.logins++
+	if f.wrongPassword {
+		return errors.Wrapf(ErrAuthFailed, "failed to login: Password does not match")
+	}
+	if f.failLogin > 0 {
+		f.failLogin--
+		return errors.Wrapf(ErrAuthFailed, "failed to connect to client: %v", syscall.ECONNREFUSED)
+	}
+	f.connected = true
+	return nil
+}
+
+func (f *flakyDriver) Close() error {
+	f.connected = false
+	return nil
+}
+
+func (f *flakyDriver) check() error {
+	f.calls++
+	if !f.connected {
+		return errors.New("write tcp 127.0.0.1:5000->127.0.0.1:58846: write: broken pipe")
+	}
+	return nil
+}
+
+func (f *flakyDriver) Torrents(context.Context) ([]*Torrent, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return []*Torrent{{Hash: "aaa"}}, nil
+}
+
+func (f *flakyDriver) Remove(context.Context, string, bool) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	f.removed++
+	return nil
+}
+
+func (f *flakyDriver) Pause(context.Context, string) error {
+	f.calls++
+	return ErrUnknownTorrent
+}
+
+func TestResilientDriver(t *testing.T) {
+	require.True(t, IsConnectionError(errors.Wrapf(ErrDriverError, "Failed: %v", syscall.ECONNRESET)))
+	require.True(t, IsConnectionError(syscall.ECONNREFUSED))
+	require.False(t, IsConnectionError(ErrUnknownTorrent))
+	require.False(t, IsConnectionError(errors.Wrapf(ErrAuthFailed, "Invalid password")))
+	require.False(t, IsConnectionError(nil))
+
+	fd := &flakyDriver{connected: true}
+	var changes []Health
+	r := NewResilientDriver(fd, RetryOpts{
+		MaxRetries: 3,
+		MinBackoff: time.Second,
+		MaxBackoff: time.Second * 3,
+		OnChange:   func(h Health) { changes = append(changes, h) },
+	})
+	var waits []time.Duration
+	r.sleep = func(_ context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	ctx := context.Background()
+
+	torrents, err := r.Torrents(ctx)
+	require.NoError(t, err)
+	require.Len(t, torrents, 1)
+	require.True(t, r.Health().Connected)
+
+	// The daemon restarted, the first reconnect fails while it is starting up
+	fd.connected = false
+	fd.failLogin = 1
+	torrents, err = r.Torrents(ctx)
+	require.NoError(t, err)
+	require.Len(t, torrents, 1)
+	require.Equal(t, []time.Duration{time.Second, time.Second * 2}, waits)
+	require.Equal(t, 1, r.Health().Reconnects)
+	require.Len(t, changes, 2)
+	require.False(t, changes[0].Connected)
+	require.True(t, changes[1].Connected)
+
+	// Remove is not retried, the connection is restored before the next call instead
+	fd.connected = false
+	waits = nil
+	fd.calls = 0
+	require.Error(t, r.Remove(ctx, "aaa", false))
+	require.Equal(t, 1, fd.calls)
+	require.Equal(t, 0, fd.removed)
+	require.False(t, r.Health().Connected)
+	require.NoError(t, r.Remove(ctx, "aaa", false))
+	require.Equal(t, 1, fd.removed)
+	require.Empty(t, waits)
+	require.Equal(t, 2, r.Health().Reconnects)
+
+	// Other errors are returned as is without touching the connection
+	fd.calls = 0
+	require.True(t, errors.Is(r.Pause(ctx, "aaa"), ErrUnknownTorrent))
+	require.Equal(t, 1, fd.calls)
+	require.True(t, r.Health().Connected)
+
+	// Giving up after max_retries
+	fd.connected = false
+	fd.failLogin = 10
+	waits = nil
+	_, err = r.Torrents(ctx)
+	require.Error(t, err)
+	require.Equal(t, []time.Duration{time.Second, time.Second * 2, time.Second * 3}, waits)
+	require.Equal(t, 4, r.Health().Failures)
+
+	// A rejected login is not retried
+	fd.wrongPassword = true
+	fd.logins = 0
+	waits = nil
+	_, err = r.Torrents(ctx)
+	require.Error(t, err)
+	require.Equal(t, 1, fd.logins)
+	require.Empty(t, waits)
+
+	// A call that timed out is treated as a lost connection
+	require.True(t, IsConnectionError(errors.Wrapf(context.DeadlineExceeded, "Failed")))
+	require.False(t, IsConnectionError(context.Canceled))
+}
+
+// sharedDriver loses its connection until logged in again, it is safe for concurrent use
+type sharedDriver struct {
+	Driver
+	mu        sync.Mutex
+	connected bool
+	logins    int
+}
+
+func (s *sharedDriver) Login(context.Context) error {
+	// Give the other callers time to pile up behind the reconnect
+	time.Sleep(time.Millisecond * 20)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logins++
+	s.connected = true
+	return nil
+}
+
+func (s *sharedDriver) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connected = false
+	return nil
+}
+
+func (s *sharedDriver) Torrents(context.Context) ([]*Torrent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.connected {
+		return nil, syscall.ECONNRESET
+	}
+	return nil, nil
+}
+
+func TestResilientDriverConcurrentReconnect(t *testing.T) {
+	sd := &sharedDriver{}
+	r := NewResilientDriver(sd, RetryOpts{MaxRetries: 3})
+	r.sleep = func(context.Context, time.Duration) error { return nil }
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := r.Torrents(ctx)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, sd.logins, "The callers that lost the same connection should only reconnect once")
+	require.Equal(t, 1, r.Health().Reconnects)
+}
+
+// statelessDriver counts the calls to Close, which would shut down a transmission daemon
+type statelessDriver struct {
+	flakyDriver
+	closes int
+}
+
+func (s *statelessDriver) Close() error {
+	s.closes++
+	return s.flakyDriver.Close()
+}
+
+func (s *statelessDriver) Stateless() bool {
+	return true
+}
+
+func TestResilientDriverStateless(t *testing.T) {
+	sd := &statelessDriver{}
+	r := NewResilientDriver(NewLockedDriver(sd, 0), RetryOpts{MaxRetries: 1})
+	r.sleep = func(context.Context, time.Duration) error { return nil }
+	ctx := context.Background()
+	_, err := r.Torrents(ctx)
+	require.NoError(t, err, "The lost session is restored by logging in again")
+	require.Equal(t, 1, sd.logins)
+	require.Equal(t, 0, sd.closes, "Stateless drivers are never closed on reconnect")
+}
+
+// slowDriver blocks Torrents until released
+type slowDriver struct {
+	Driver
+	release chan struct{}
+}
+
+func (s *slowDriver) Torrents(context.Context) ([]*Torrent, error) {
+	<-s.release
+	return nil, nil
+}
+
+func (s *slowDriver) Pause(context.Context, string) error {
+	return nil
+}
+
+func (s *slowDriver) Torrent(_ context.Context, hash string, torrent *Torrent) error {
+	<-s.release
+	torrent.Hash = hash
+	return nil
+}
+
+func TestLockedDriverTimeout(t *testing.T) {
+	sd := &slowDriver{release: make(chan struct{})}
+	l := NewLockedDriver(sd, time.Millisecond*50)
+	ctx := context.Background()
+	_, err := l.Torrents(ctx)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+	// The lock is still held by the hung call so others give up at their own deadline
+	require.True(t, errors.Is(l.Pause(ctx, "aaa"), context.DeadlineExceeded))
+	close(sd.release)
+	require.Eventually(t, func() bool { return l.Pause(ctx, "aaa") == nil }, time.Second, time.Millisecond*10)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	require.True(t, errors.Is(l.Pause(cancelled, "aaa"), context.Canceled))
+}
+
+func TestLockedDriverAbandonedResult(t *testing.T) {
+	sd := &slowDriver{release: make(chan struct{})}
+	l := NewLockedDriver(sd, time.Millisecond*50)
+	ctx := context.Background()
+	var torrent Torrent
+	require.True(t, errors.Is(l.Torrent(ctx, "aaa", &torrent), context.DeadlineExceeded))
+	close(sd.release)
+	require.Eventually(t, func() bool { return l.Pause(ctx, "aaa") == nil }, time.Second, time.Millisecond*10)
+	require.Empty(t, torrent.Hash, "A call that timed out must not write to the callers torrent")
+	require.NoError(t, l.Torrent(ctx, "aaa", &torrent))
+	require.Equal(t, "aaa", torrent.Hash)
+}
@@ -1,11 +1,13 @@
 package rtorrent
 
 import (
+	"context"
 	"fmt"
 	"github.com/leighmacdonald/seedr/pkg/client"
 	"github.com/mrobinsn/go-rtorrent/rtorrent"
 	"github.com/pkg/errors"
 	"io/ioutil"
+	"net/http"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -42,6 +44,46 @@ const (
 	DGetLabel rtorrent.Field = "d.get_custom1"
 
 	DVerify rtorrent.Field = "d.check_hash"
+	DErase  rtorrent.Field = "d.erase"
+
+	DRatio          rtorrent.Field = "d.ratio"
+	DCompletedBytes rtorrent.Field = "d.completed_bytes"
+
+	DSessionFile  rtorrent.Field = "d.session_file"
+	DSetDirectory rtorrent.Field = "d.directory.set"
+
+	DUpdatePriorities rtorrent.Field = "d.update_priorities"
+
+	// Files
+	FPath            rtorrent.Field = "f.path"
+	FSizeBytes       rtorrent.Field = "f.size_bytes"
+	FCompletedChunks rtorrent.Field = "f.completed_chunks"
+	FSizeChunks      rtorrent.Field = "f.size_chunks"
+	FPriority        rtorrent.Field = "f.priority"
+	FSetPriority     rtorrent.Field = "f.priority.set"
+
+	// Throttles
+	ThrottleGlobalUp   rtorrent.Field = "throttle.global_up.max_rate"
+	ThrottleGlobalDown rtorrent.Field = "throttle.global_down.max_rate"
+	ThrottleMaxPeers   rtorrent.Field = "throttle.max_peers.normal"
+
+	// Trackers
+	TURL              rtorrent.Field = "t.url"
+	TGroup            rtorrent.Field = "t.group"
+	TIsEnabled        rtorrent.Field = "t.is_enabled"
+	TScrapeComplete   rtorrent.Field = "t.scrape_complete"
+	TScrapeIncomplete rtorrent.Field = "t.scrape_incomplete"
+	TActivityTimeNext rtorrent.Field = "t.activity_time_next"
+	TFailedCounter    rtorrent.Field = "t.failed_counter"
+	TSuccessCounter   rtorrent.Field = "t.success_counter"
+
+	// Peers
+	PAddress          rtorrent.Field = "p.address"
+	PPort             rtorrent.Field = "p.port"
+	PClientVersion    rtorrent.Field = "p.client_version"
+	PCompletedPercent rtorrent.Field = "p.completed_percent"
+	PUpRate           rtorrent.Field = "p.up_rate"
+	PDownRate         rtorrent.Field = "p.down_rate"
 )
 
 type RTorrent struct {
@@ -50,16 +92,19 @@ type RTorrent struct {
 	connected bool
 }
 
-func (d RTorrent) FreeSpace(path string) (int64, error) {
-	panic("implement me")
+func (d RTorrent) FreeSpace(ctx context.Context, path string) (int64, error) {
+	return 0, errors.Wrapf(client.ErrUnsupported, "rtorrent cannot get free space of a path")
 }
 
-func (d RTorrent) Announce(hash string) error {
-	log.Debugf("Announce() not implemented")
-	return nil
+func (d RTorrent) Capabilities() client.Capabilities {
+	return client.NewCapabilities(client.CapLabels, client.CapFilePriorities, client.CapSetLocation)
+}
+
+func (d RTorrent) Announce(ctx context.Context, hash string) error {
+	return errors.Wrapf(client.ErrUnsupported, "rtorrent cannot announce")
 }
 
-func (d RTorrent) ClientVersion() (string, error) {
+func (d RTorrent) ClientVersion(ctx context.Context) (string, error) {
 	name, err := d.c.Name()
 	if err != nil {
 		return "", err
@@ -67,40 +112,250 @@ func (d RTorrent) ClientVersion() (string, error) {
 	return fmt.Sprintf("rtorrent %s", name), nil
 }
 
-func (d RTorrent) Close() error {
-	return nil
+// Export reads the session copy of the .torrent that rtorrent keeps for each loaded torrent
+func (d RTorrent) Export(ctx context.Context, hash string) ([]byte, error) {
+	result, err := d.c.XMLPRCClient().Call(string(DSessionFile), hash)
+	if err != nil {
+		return nil, errors.Wrap(err, "d.session_file XMLRPC call failed")
+	}
+	values, ok := result.([]interface{})
+	if ok && len(values) == 1 {
+		if sessionFile, ok := values[0].(string); ok && sessionFile != "" {
+			b, errRead := ioutil.ReadFile(sessionFile)
+			if errRead == nil {
+				return b, nil
+			}
+			log.Debugf("Could not read session file directly, trying state_dir: %v", errRead)
+		}
+	}
+	return client.ReadStateFile(d.cfg.StateDir, hash)
 }
 
-func (d RTorrent) Pause(hash string) error {
-	log.Debugf("Pause() not implemented")
-	return nil
+// Files uses f.multicall, rtorrent file priorities are 0 off, 1 normal and 2 high
+func (d RTorrent) Files(ctx context.Context, hash string) ([]client.File, error) {
+	results, err := d.c.XMLPRCClient().Call("f.multicall", hash, "",
+		FPath.Query(), FSizeBytes.Query(), FCompletedChunks.Query(), FSizeChunks.Query(), FPriority.Query())
+	if err != nil {
+		return nil, errors.Wrap(err, "f.multicall XMLRPC call failed")
+	}
+	var files []client.File
+	for _, outerResult := range results.([]interface{}) {
+		for i, innerResult := range outerResult.([]interface{}) {
+			fileData := innerResult.([]interface{})
+			f := client.File{
+				Index: i,
+				Path:  fileData[0].(string),
+				Size:  int64(fileData[1].(int)),
+			}
+			if chunks := fileData[3].(int); chunks > 0 {
+				f.Progress = float64(fileData[2].(int)) / float64(chunks)
+			}
+			switch fileData[4].(int) {
+			case 0:
+				f.Priority = client.PrioritySkip
+			case 2:
+				f.Priority = client.PriorityHigh
+			default:
+				f.Priority = client.PriorityNormal
+			}
+			files = append(files, f)
+		}
+	}
+	return files, nil
 }
 
-func (d RTorrent) PauseAll() error {
-	log.Debugf("Pause() not implemented")
+// SetFilePriority maps low priority to normal as rtorrent does not have a lower priority
+func (d RTorrent) SetFilePriority(ctx context.Context, hash string, index int, priority client.FilePriority) error {
+	p := 1
+	switch priority {
+	case client.PrioritySkip:
+		p = 0
+	case client.PriorityHigh:
+		p = 2
+	}
+	target := fmt.Sprintf("%s:f%d", hash, index)
+	if _, err := d.c.XMLPRCClient().Call(string(FSetPriority), target, p); err != nil {
+		return errors.Wrap(err, "f.priority.set XMLRPC call failed")
+	}
+	if _, err := d.c.XMLPRCClient().Call(string(DUpdatePriorities), hash); err != nil {
+		return errors.Wrap(err, "d.update_priorities XMLRPC call failed")
+	}
 	return nil
 }
 
-func (d RTorrent) Queue(hash string, position client.QueuePos) error {
-	log.Debugf("Queue() not implemented")
+// getInt reads a global integer value
+func (d RTorrent) getInt(field rtorrent.Field) (int64, error) {
+	result, err := d.c.XMLPRCClient().Call(string(field), "")
+	if err != nil {
+		return 0, errors.Wrapf(err, "%s XMLRPC call failed", field)
+	}
+	if values, ok := result.([]interface{}); ok && len(values) == 1 {
+		if v, ok := values[0].(int); ok {
+			return int64(v), nil
+		}
+	}
+	return 0, errors.Wrapf(client.ErrDriverError, "Invalid %s response: %v", field, result)
+}
+
+func (d RTorrent) setInt(field rtorrent.Field, value int64) error {
+	if _, err := d.c.XMLPRCClient().Call(string(field)+".set", "", int(value)); err != nil {
+		return errors.Wrapf(err, "%s.set XMLRPC call failed", field)
+	}
 	return nil
 }
 
-func (d RTorrent) Start(hash string) error {
-	log.Debugf("Start() not implemented")
+// SessionSettings only includes the global rates and the peers per torrent, rtorrent has no queue and
+// no global connection limit
+func (d RTorrent) SessionSettings(ctx context.Context) (*client.SessionSettings, error) {
+	up, err := d.getInt(ThrottleGlobalUp)
+	if err != nil {
+		return nil, err
+	}
+	down, err := d.getInt(ThrottleGlobalDown)
+	if err != nil {
+		return nil, err
+	}
+	peers, err := d.getInt(ThrottleMaxPeers)
+	if err != nil {
+		return nil, err
+	}
+	maxPeers := int(peers)
+	return &client.SessionSettings{UploadLimit: &up, DownloadLimit: &down, MaxConnectionsPerTorrent: &maxPeers}, nil
+}
+
+func (d RTorrent) SetSessionSettings(ctx context.Context, settings *client.SessionSettings) error {
+	if settings.MaxActiveDownloads != nil || settings.MaxActiveSeeding != nil || settings.MaxConnections != nil {
+		return errors.Wrapf(client.ErrUnsupported, "rtorrent has no queue or global connection limit")
+	}
+	if settings.UploadLimit != nil {
+		if err := d.setInt(ThrottleGlobalUp, *settings.UploadLimit); err != nil {
+			return err
+		}
+	}
+	if settings.DownloadLimit != nil {
+		if err := d.setInt(ThrottleGlobalDown, *settings.DownloadLimit); err != nil {
+			return err
+		}
+	}
+	if settings.MaxConnectionsPerTorrent != nil {
+		if err := d.setInt(ThrottleMaxPeers, int64(*settings.MaxConnectionsPerTorrent)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (d RTorrent) StartAll() error {
-	log.Debugf("StartAll() not implemented")
+// SetLimits is not supported, rtorrent only limits torrents through named throttle groups
+func (d RTorrent) SetLimits(ctx context.Context, hash string, upload int64, download int64) error {
+	return client.ErrUnsupported
+}
+
+func (d RTorrent) Close() error {
 	return nil
 }
 
-func (d RTorrent) Stop(hash string) error {
-	log.Debugf("Stop() not implemented")
+func (d RTorrent) Stateless() bool {
+	return true
+}
+
+func (d RTorrent) Pause(ctx context.Context, hash string) error {
+	return d.PauseMany(ctx, []string{hash})
+}
+
+// PauseMany stops all the torrents in a single request, unknown hashes are ignored
+func (d RTorrent) PauseMany(ctx context.Context, hashes []string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	calls := make([]map[string]interface{}, len(hashes))
+	for i, hash := range hashes {
+		calls[i] = multicallOf(DStop, hash)
+	}
+	_, err := d.multicall(calls)
+	return err
+}
+
+// multicallOf builds a single call of a system.multicall request
+func multicallOf(method rtorrent.Field, params ...interface{}) map[string]interface{} {
+	return map[string]interface{}{"methodName": string(method), "params": params}
+}
+
+// multicall sends all the calls in a single system.multicall request. The results are returned in
+// the same order, the result of a call that failed is nil.
+func (d RTorrent) multicall(calls []map[string]interface{}) ([]interface{}, error) {
+	result, err := d.c.XMLPRCClient().Call("system.multicall", calls)
+	if err != nil {
+		return nil, errors.Wrap(err, "system.multicall XMLRPC call failed")
+	}
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 1 {
+		return nil, errors.Wrapf(client.ErrDriverError, "Invalid system.multicall response")
+	}
+	responses, ok := values[0].([]interface{})
+	if !ok || len(responses) != len(calls) {
+		return nil, errors.Wrapf(client.ErrDriverError, "Invalid system.multicall response")
+	}
+	results := make([]interface{}, len(responses))
+	for i, resp := range responses {
+		// Successful calls are wrapped in a single value array, failed ones are a fault struct
+		if v, ok := resp.([]interface{}); ok && len(v) == 1 {
+			results[i] = v[0]
+		}
+	}
+	return results, nil
+}
+
+func (d RTorrent) PauseAll(ctx context.Context) error {
+	return errors.Wrapf(client.ErrUnsupported, "rtorrent cannot pause all torrents")
+}
+
+func (d RTorrent) Peers(ctx context.Context, hash string) ([]client.Peer, error) {
+	results, err := d.c.XMLPRCClient().Call("p.multicall", hash, "",
+		PAddress.Query(), PPort.Query(), PClientVersion.Query(), PCompletedPercent.Query(),
+		PUpRate.Query(), PDownRate.Query())
+	if err != nil {
+		return nil, errors.Wrap(err, "p.multicall XMLRPC call failed")
+	}
+	var peers []client.Peer
+	for _, outerResult := range results.([]interface{}) {
+		for _, innerResult := range outerResult.([]interface{}) {
+			peerData := innerResult.([]interface{})
+			peers = append(peers, client.Peer{
+				Address:  fmt.Sprintf("%s:%d", peerData[0].(string), peerData[1].(int)),
+				Client:   peerData[2].(string),
+				Progress: float64(peerData[3].(int)) / 100,
+				SpeedUP:  int64(peerData[4].(int)),
+				SpeedDN:  int64(peerData[5].(int)),
+			})
+		}
+	}
+	return peers, nil
+}
+
+func (d RTorrent) Queue(ctx context.Context, hash string, position client.QueuePos) error {
+	return errors.Wrapf(client.ErrUnsupported, "rtorrent has no queue")
+}
+
+// Start opens the torrent as well, it is closed when rtorrent stops it on its own
+func (d RTorrent) Start(ctx context.Context, hash string) error {
+	results, err := d.multicall([]map[string]interface{}{multicallOf(DOpen, hash), multicallOf(DStart, hash)})
+	if err != nil {
+		return err
+	}
+	if results[1] == nil {
+		return errors.Wrapf(client.ErrDriverError, "Failed to start torrent %s", hash)
+	}
 	return nil
 }
 
+func (d RTorrent) StartAll(ctx context.Context) error {
+	return errors.Wrapf(client.ErrUnsupported, "rtorrent cannot start all torrents")
+}
+
+func (d RTorrent) Stop(ctx context.Context, hash string) error {
+	return d.Pause(ctx, hash)
+}
+
 func (d RTorrent) GetTorrents(view rtorrent.View) ([]rtorrent.Torrent, error) {
 	args := []interface{}{"", string(view),
 		rtorrent.DName.Query(),
@@ -134,7 +389,7 @@ func (d RTorrent) GetTorrents(view rtorrent.View) ([]rtorrent.Torrent, error) {
 	return torrents, nil
 }
 
-func (d RTorrent) TorrentsWithState(statuses ...client.State) ([]client.Torrent, error) {
+func (d RTorrent) TorrentsWithState(ctx context.Context, statuses ...client.State) ([]*client.Torrent, error) {
 	rTorrents, err := d.c.GetTorrents(rtorrent.ViewMain)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch torrents")
@@ -142,16 +397,59 @@ func (d RTorrent) TorrentsWithState(statuses ...client.State) ([]client.Torrent,
 	for _, rt := range rTorrents {
 		log.Println(rt)
 	}
-	var torrents []client.Torrent
+	var torrents []*client.Torrent
 	return torrents, nil
 }
 
-func (d RTorrent) Verify(hash string) error {
-	log.Debugf("Verify() not implemented")
-	return nil
+// Trackers uses the torrents message for failing trackers as rtorrent does not keep one per tracker
+func (d RTorrent) Trackers(ctx context.Context, hash string) ([]client.Tracker, error) {
+	results, err := d.c.XMLPRCClient().Call("t.multicall", hash, "",
+		TURL.Query(), TGroup.Query(), TIsEnabled.Query(), TScrapeComplete.Query(), TScrapeIncomplete.Query(),
+		TActivityTimeNext.Query(), TFailedCounter.Query(), TSuccessCounter.Query())
+	if err != nil {
+		return nil, errors.Wrap(err, "t.multicall XMLRPC call failed")
+	}
+	var message string
+	if result, err := d.c.XMLPRCClient().Call(string(DMessage), hash); err == nil {
+		if values, ok := result.([]interface{}); ok && len(values) == 1 {
+			message, _ = values[0].(string)
+		}
+	}
+	var trackers []client.Tracker
+	for _, outerResult := range results.([]interface{}) {
+		for _, innerResult := range outerResult.([]interface{}) {
+			trackerData := innerResult.([]interface{})
+			tracker := client.Tracker{
+				URL:      trackerData[0].(string),
+				Tier:     trackerData[1].(int),
+				Seeders:  trackerData[3].(int),
+				Leechers: trackerData[4].(int),
+			}
+			if next := trackerData[5].(int); next > 0 {
+				tracker.NextAnnounce = time.Unix(int64(next), 0)
+			}
+			switch {
+			case trackerData[2].(int) == 0:
+				tracker.Status = client.TrackerDisabled
+			case trackerData[6].(int) > 0:
+				tracker.Status = client.TrackerError
+				tracker.Message = message
+			case trackerData[7].(int) > 0:
+				tracker.Status = client.TrackerWorking
+			default:
+				tracker.Status = client.TrackerNotContacted
+			}
+			trackers = append(trackers, tracker)
+		}
+	}
+	return trackers, nil
 }
 
-func (d RTorrent) Login() error {
+func (d RTorrent) Verify(ctx context.Context, hash string) error {
+	return errors.Wrapf(client.ErrUnsupported, "rtorrent cannot verify")
+}
+
+func (d RTorrent) Login(ctx context.Context) error {
 	if d.connected {
 		log.Warn("Already connected")
 		return nil
@@ -165,12 +463,12 @@ func (d RTorrent) Login() error {
 	return nil
 }
 
-func (d RTorrent) Torrents() ([]client.Torrent, error) {
+func (d RTorrent) Torrents(ctx context.Context) ([]*client.Torrent, error) {
 	rt, err := d.c.GetTorrents(rtorrent.ViewMain)
 	if err != nil {
 		return nil, err
 	}
-	var torrents []client.Torrent
+	var torrents []*client.Torrent
 	for _, t := range rt {
 		status, err := d.c.GetStatus(t)
 		if err != nil {
@@ -194,29 +492,133 @@ func (d RTorrent) Torrents() ([]client.Torrent, error) {
 			Downloaded: int64(status.CompletedBytes),
 			StatusMsg:  "",
 		}
-		torrents = append(torrents, torrent)
+		if t.Size > 0 {
+			torrent.Progress = float64(status.CompletedBytes) / float64(t.Size)
+		}
+		torrents = append(torrents, &torrent)
+	}
+	return torrents, nil
+}
+
+func (d RTorrent) Torrent(ctx context.Context, hash string, torrent *client.Torrent) error {
+	torrents, err := d.TorrentsByHash(ctx, []string{hash})
+	if err != nil {
+		return err
+	}
+	t, found := torrents[hash]
+	if !found {
+		return client.ErrUnknownTorrent
+	}
+	*torrent = *t
+	return nil
+}
+
+// byHashFields are fetched for each torrent by TorrentsByHash
+var byHashFields = []rtorrent.Field{
+	rtorrent.DName, rtorrent.DSizeInBytes, rtorrent.DBasePath, rtorrent.DLabel, DRatio, DUPRate, DDownRate,
+	DCompletedBytes, DUPTotal,
+}
+
+// TorrentsByHash fetches the fields of every torrent in a single system.multicall request, a torrent
+// is left out when rtorrent does not know the hash
+func (d RTorrent) TorrentsByHash(ctx context.Context, hashes []string) (map[string]*client.Torrent, error) {
+	torrents := make(map[string]*client.Torrent, len(hashes))
+	if len(hashes) == 0 {
+		return torrents, nil
+	}
+	var calls []map[string]interface{}
+	for _, hash := range hashes {
+		for _, field := range byHashFields {
+			calls = append(calls, multicallOf(field, hash))
+		}
+	}
+	results, err := d.multicall(calls)
+	if err != nil {
+		return nil, err
+	}
+	for i, hash := range hashes {
+		values := results[i*len(byHashFields) : (i+1)*len(byHashFields)]
+		name, ok := values[0].(string)
+		if !ok {
+			continue
+		}
+		t := &client.Torrent{Hash: hash, Name: name}
+		t.Path, _ = values[2].(string)
+		t.Label, _ = values[3].(string)
+		if size, ok := values[1].(int); ok {
+			t.Size = int64(size)
+		}
+		if ratio, ok := values[4].(int); ok {
+			t.Ratio = float64(ratio) / 1000
+		}
+		if rate, ok := values[5].(int); ok {
+			t.SpeedUP = int64(rate)
+		}
+		if rate, ok := values[6].(int); ok {
+			t.SpeedDN = int64(rate)
+		}
+		if completed, ok := values[7].(int); ok {
+			t.Downloaded = int64(completed)
+			if t.Size > 0 {
+				t.Progress = float64(completed) / float64(t.Size)
+			}
+		}
+		if uploaded, ok := values[8].(int); ok {
+			t.Uploaded = int64(uploaded)
+		}
+		torrents[hash] = t
 	}
 	return torrents, nil
 }
 
-func (d RTorrent) Torrent(hash string, torrent *client.Torrent) error {
-	panic("implement me")
+func (d RTorrent) Move(ctx context.Context, hash string, dest string) error {
+	return d.MoveMany(ctx, []string{hash}, dest)
+}
+
+// MoveMany is unsupported, rtorrent can only be pointed at a new directory with SetLocation
+func (d RTorrent) MoveMany(ctx context.Context, hashes []string, dest string) error {
+	return errors.Wrapf(client.ErrUnsupported, "rtorrent cannot move data")
+}
+
+// SetLocation updates the directory of a stopped torrent, multi file torrents will have their name appended
+func (d RTorrent) SetLocation(ctx context.Context, hash string, dest string) error {
+	if _, err := d.c.XMLPRCClient().Call(string(DSetDirectory), hash, dest); err != nil {
+		return errors.Wrap(err, "d.directory.set XMLRPC call failed")
+	}
+	return nil
 }
 
-func (d RTorrent) Move(hash string, dest string) error {
-	panic("implement me")
+func (d RTorrent) Remove(ctx context.Context, hash string, deleteData bool) error {
+	return d.RemoveMany(ctx, []string{hash}, deleteData)
 }
 
-func (d RTorrent) Remove(hash string, deleteData bool) error {
-	panic("implement me")
+// RemoveMany erases all the torrents in a single request, unknown hashes are ignored. rtorrent itself
+// never deletes data so removing with data is unsupported.
+func (d RTorrent) RemoveMany(ctx context.Context, hashes []string, deleteData bool) error {
+	if deleteData {
+		return errors.Wrapf(client.ErrUnsupported, "rtorrent cannot delete data")
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+	calls := make([]map[string]interface{}, len(hashes))
+	for i, hash := range hashes {
+		calls[i] = multicallOf(DErase, hash)
+	}
+	_, err := d.multicall(calls)
+	return err
 }
 
-func (d RTorrent) Add(name string, torrent io.Reader, path string, label string) error {
+func (d RTorrent) Add(ctx context.Context, name string, torrent io.Reader, path string, label string, opts client.AddOptions) error {
 	b, err := ioutil.ReadAll(torrent)
 	if err != nil {
 		return err
 	}
-	if err := d.c.AddTorrent(b,
+	add := d.c.AddTorrent
+	if opts.Paused {
+		add = d.c.AddTorrentStopped
+	}
+	if err := add(b,
 		rtorrent.DName.SetValue(name),
 		rtorrent.DLabel.SetValue(label),
 		rtorrent.DBasePath.SetValue(path)); err != nil {
@@ -227,18 +629,28 @@ func (d RTorrent) Add(name string, torrent io.Reader, path string, label string)
 
 type Factory struct{}
 
+// New connects over HTTP to the XMLRPC endpoint of a web server in front of rtorrent, the user and
+// password are sent as basic auth. When a socket is set rtorrent is spoken to directly over SCGI.
 func (f Factory) New(cfg *client.Config) (client.Driver, error) {
-	var url string
-	login := ""
-	if cfg.Username != "" && cfg.Password != "" {
-		login = fmt.Sprintf("%s:%s@", cfg.Username, cfg.Password)
+	if cfg.BasicAuthUser != "" && cfg.Username != "" {
+		return nil, errors.Wrapf(client.ErrInvalidConfig, "rtorrent sends user and password as basic auth, set either them or basic_auth_user")
 	}
-	if cfg.TLS {
-		url = fmt.Sprintf("https://%s%s:%d/RPC2", login, cfg.Host, cfg.Port)
+	url := cfg.URL("/RPC2")
+	var transport http.RoundTripper
+	if cfg.Socket != "" {
+		// The host of the url is not used, only the path is sent as the REQUEST_URI
+		url = "http://localhost/RPC2"
+		transport = scgiTransport{network: "unix", address: cfg.Socket}
 	} else {
-		url = fmt.Sprintf("http://%s%s:%d/RPC2", login, cfg.Host, cfg.Port)
+		t, err := cfg.Transport()
+		if err != nil {
+			return nil, err
+		}
+		transport = client.BasicAuth(t, cfg.Username, cfg.Password)
 	}
-	c := rtorrent.New(url, cfg.TLS)
+	// The library calls do not accept a context so the timeout is set on the http client instead
+	httpClient := &http.Client{Timeout: cfg.Timeout, Transport: transport}
+	c := rtorrent.New(url, false).WithHTTPClient(httpClient)
 	return RTorrent{cfg: cfg, c: c}, nil
 }
 
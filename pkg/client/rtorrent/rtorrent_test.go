@@ -7,7 +7,7 @@ import (
 )
 
 func TestRTorrent(t *testing.T) {
-	driver, err := Factory{}.New(client.Config{
+	driver, err := Factory{}.New(&client.Config{
 		Driver:   driverName,
 		Username: "",
 		Password: "",
@@ -0,0 +1,110 @@
+package rtorrent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// scgiTransport sends the XMLRPC requests straight to rtorrent over SCGI, as used by the scgi_local
+// and scgi_port options of rtorrent, without a web server in between
+type scgiTransport struct {
+	network string
+	address string
+}
+
+// scgiBody closes the connection once the response has been read
+type scgiBody struct {
+	io.Reader
+	conn net.Conn
+}
+
+func (b scgiBody) Close() error {
+	return b.conn.Close()
+}
+
+// scgiRequest encodes the request headers as a netstring followed by the body. CONTENT_LENGTH must
+// be the first header.
+func scgiRequest(path string, body []byte) []byte {
+	var headers bytes.Buffer
+	for _, kv := range [][2]string{
+		{"CONTENT_LENGTH", strconv.Itoa(len(body))},
+		{"SCGI", "1"},
+		{"REQUEST_METHOD", "POST"},
+		{"REQUEST_URI", path},
+	} {
+		headers.WriteString(kv[0])
+		headers.WriteByte(0)
+		headers.WriteString(kv[1])
+		headers.WriteByte(0)
+	}
+	var req bytes.Buffer
+	_, _ = fmt.Fprintf(&req, "%d:", headers.Len())
+	req.Write(headers.Bytes())
+	req.WriteByte(',')
+	req.Write(body)
+	return req.Bytes()
+}
+
+func (t scgiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(req.Context(), t.network, t.address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to connect to scgi socket")
+	}
+	if deadline, ok := req.Context().Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(scgiRequest(req.URL.Path, body)); err != nil {
+		_ = conn.Close()
+		return nil, errors.Wrapf(err, "Failed to write scgi request")
+	}
+	// The response is CGI style, headers without a status line followed by the body
+	r := bufio.NewReader(conn)
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		_ = conn.Close()
+		return nil, errors.Wrapf(err, "Failed to read scgi response")
+	}
+	resp := &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.0",
+		ProtoMajor: 1,
+		Header:     http.Header(header),
+		Body:       scgiBody{Reader: r, conn: conn},
+		Request:    req,
+	}
+	if status := header.Get("Status"); status != "" {
+		code, err := strconv.Atoi(strings.SplitN(status, " ", 2)[0])
+		if err != nil {
+			_ = conn.Close()
+			return nil, errors.Errorf("Invalid scgi response status: %s", status)
+		}
+		resp.Status, resp.StatusCode = status, code
+	}
+	resp.ContentLength = -1
+	if cl := header.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil {
+			resp.ContentLength = n
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,99 @@
+package rtorrent
+
+import (
+	"bufio"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type scgiReceived struct {
+	headers map[string]string
+	body    string
+	err     error
+}
+
+// serveSCGI answers a single request with a XMLRPC response and returns the received headers and body
+func serveSCGI(l net.Listener) (map[string]string, string, error) {
+	conn, err := l.Accept()
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() { _ = conn.Close() }()
+	r := bufio.NewReader(conn)
+	size, err := r.ReadString(':')
+	if err != nil {
+		return nil, "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(size, ":"))
+	if err != nil {
+		return nil, "", err
+	}
+	raw := make([]byte, n+1)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, "", err
+	}
+	if raw[n] != ',' || !strings.HasPrefix(string(raw), "CONTENT_LENGTH\x00") {
+		return nil, "", errors.Errorf("Invalid netstring: %q", raw)
+	}
+	fields := strings.Split(string(raw[:n-1]), "\x00")
+	headers := map[string]string{}
+	for i := 0; i+1 < len(fields); i += 2 {
+		headers[fields[i]] = fields[i+1]
+	}
+	length, err := strconv.Atoi(headers["CONTENT_LENGTH"])
+	if err != nil {
+		return nil, "", err
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, "", err
+	}
+	resp := `<?xml version="1.0"?><methodResponse><params><param><value><string>0.9.8</string></value></param></params></methodResponse>`
+	_, err = conn.Write([]byte("Status: 200 OK\r\nContent-Type: text/xml\r\nContent-Length: " +
+		strconv.Itoa(len(resp)) + "\r\n\r\n" + resp))
+	return headers, string(body), err
+}
+
+func TestSCGI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seedr-scgi")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	socket := filepath.Join(dir, "rtorrent.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	received := make(chan scgiReceived, 1)
+	go func() {
+		headers, body, err := serveSCGI(l)
+		received <- scgiReceived{headers: headers, body: body, err: err}
+	}()
+
+	d, err := Factory{}.New(&client.Config{Socket: socket, Timeout: time.Second * 5})
+	require.NoError(t, err)
+	v, err := d.(RTorrent).c.XMLPRCClient().Call("system.client_version")
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{"0.9.8"}, v)
+	r := <-received
+	require.NoError(t, r.err)
+	require.Equal(t, "1", r.headers["SCGI"])
+	require.Equal(t, "POST", r.headers["REQUEST_METHOD"])
+	require.Equal(t, "/RPC2", r.headers["REQUEST_URI"])
+	require.Contains(t, r.body, "system.client_version")
+}
+
+func TestFactoryBasicAuth(t *testing.T) {
+	_, err := Factory{}.New(&client.Config{Username: "user", Password: "pass", BasicAuthUser: "proxy"})
+	require.True(t, errors.Is(err, client.ErrInvalidConfig), "The proxy credentials would replace the rtorrent login")
+	_, err = Factory{}.New(&client.Config{BasicAuthUser: "proxy", BasicAuthPassword: "pass"})
+	require.NoError(t, err)
+}
@@ -0,0 +1,167 @@
+package transmission
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/hekmon/transmissionrpc"
+	"github.com/leighmacdonald/seedr/pkg/client"
+	"github.com/pkg/errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// sessionHeader carries the CSRF token transmission hands out with a 409 response
+const sessionHeader = "X-Transmission-Session-Id"
+
+// torrentFields are the fields read by mapTorrentStatus
+var torrentFields = []string{"hashString", "name", "downloadDir", "percentDone", "rateUpload", "status"}
+
+// rpcClient posts the RPC calls itself. The library builds its own http client which cannot be given
+// the transport, so the TLS and basic auth options would be ignored, and its calls take no context.
+// The library is still used for the request and response types.
+type rpcClient struct {
+	url       string
+	user      string
+	password  string
+	http      *http.Client
+	tag       int64
+	mu        sync.RWMutex
+	sessionID string
+}
+
+type rpcRequest struct {
+	Method    string      `json:"method"`
+	Arguments interface{} `json:"arguments,omitempty"`
+	Tag       int64       `json:"tag"`
+}
+
+type rpcResponse struct {
+	Arguments interface{} `json:"arguments"`
+	Result    string      `json:"result"`
+	Tag       int64       `json:"tag"`
+}
+
+// hashesArgs selects torrents by hash, every torrent is selected when Hashes is empty
+type hashesArgs struct {
+	Hashes []string `json:"ids,omitempty"`
+}
+
+type idsArgs struct {
+	IDs []int64 `json:"ids"`
+}
+
+type torrentGetArgs struct {
+	Fields []string `json:"fields"`
+	Hashes []string `json:"ids,omitempty"`
+}
+
+type setLocationArgs struct {
+	Hashes   []string `json:"ids"`
+	Location string   `json:"location"`
+	Move     bool     `json:"move"`
+}
+
+type freeSpaceArgs struct {
+	Path string `json:"path"`
+}
+
+type freeSpaceResult struct {
+	Path string `json:"path"`
+	Size int64  `json:"size-bytes"`
+}
+
+func newRPCClient(url string, user string, password string, httpClient *http.Client) *rpcClient {
+	return &rpcClient{url: url, user: user, password: password, http: httpClient}
+}
+
+// call performs the RPC method decoding the arguments of the response into result when not nil
+func (c *rpcClient) call(ctx context.Context, method string, args interface{}, result interface{}) error {
+	req := rpcRequest{Method: method, Arguments: args, Tag: atomic.AddInt64(&c.tag, 1)}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to encode %s request", method)
+	}
+	// A stale session id is answered with 409 and the new id, the call is sent again once
+	for attempt := 0; ; attempt++ {
+		resp, err := c.post(ctx, body)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to call %s", method)
+		}
+		if resp.StatusCode == http.StatusConflict && attempt == 0 {
+			_ = resp.Body.Close()
+			c.mu.Lock()
+			c.sessionID = resp.Header.Get(sessionHeader)
+			c.mu.Unlock()
+			continue
+		}
+		return c.decode(resp, method, req.Tag, result)
+	}
+}
+
+func (c *rpcClient) post(ctx context.Context, body []byte) (*http.Response, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	c.mu.RLock()
+	r.Header.Set(sessionHeader, c.sessionID)
+	c.mu.RUnlock()
+	r.SetBasicAuth(c.user, c.password)
+	return c.http.Do(r)
+}
+
+func (c *rpcClient) decode(resp *http.Response, method string, tag int64, result interface{}) error {
+	defer func() { _ = resp.Body.Close() }()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return errors.Wrapf(client.ErrAuthFailed, "Invalid username or password")
+	default:
+		return errors.Errorf("Unexpected response calling %s: %s", method, resp.Status)
+	}
+	answer := rpcResponse{Arguments: result}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return errors.Wrapf(err, "Failed to decode %s response", method)
+	}
+	if answer.Tag != tag {
+		return errors.Errorf("Response tag %d of %s does not match the request tag %d", answer.Tag, method, tag)
+	}
+	if answer.Result != "success" {
+		return errors.Errorf("%s failed: %s", method, answer.Result)
+	}
+	return nil
+}
+
+// torrentGet returns the fields of the torrents with the hashes, or every torrent when hashes is empty
+func (c *rpcClient) torrentGet(ctx context.Context, fields []string, hashes []string) ([]*transmissionrpc.Torrent, error) {
+	var result struct {
+		Torrents []*transmissionrpc.Torrent `json:"torrents"`
+	}
+	if err := c.call(ctx, "torrent-get", torrentGetArgs{Fields: fields, Hashes: hashes}, &result); err != nil {
+		return nil, err
+	}
+	return result.Torrents, nil
+}
+
+func (c *rpcClient) sessionGet(ctx context.Context) (*transmissionrpc.SessionArguments, error) {
+	var args transmissionrpc.SessionArguments
+	if err := c.call(ctx, "session-get", nil, &args); err != nil {
+		return nil, err
+	}
+	return &args, nil
+}
+
+// rpcVersion returns the version of the server and true when the library types are compatible with it
+func (c *rpcClient) rpcVersion(ctx context.Context) (bool, int64, int64, error) {
+	args, err := c.sessionGet(ctx)
+	if err != nil {
+		return false, 0, 0, err
+	}
+	if args.RPCVersion == nil || args.RPCVersionMinimum == nil {
+		return false, 0, 0, errors.New("Session is missing the rpc version")
+	}
+	return transmissionrpc.RPCVersion >= *args.RPCVersionMinimum, *args.RPCVersion, *args.RPCVersionMinimum, nil
+}
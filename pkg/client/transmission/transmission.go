@@ -1,6 +1,7 @@
 package transmission
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"github.com/hekmon/transmissionrpc"
@@ -9,6 +10,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"io"
 	"io/ioutil"
+	"net/http"
 )
 
 const driverName = "transmission"
@@ -28,19 +30,29 @@ var (
 
 type Transmission struct {
 	cfg    *client.Config
-	client *transmissionrpc.Client
+	client *rpcClient
 }
 
-func (d Transmission) FreeSpace(path string) (int64, error) {
-	panic("implement me")
+func (d Transmission) FreeSpace(ctx context.Context, path string) (int64, error) {
+	var free freeSpaceResult
+	if err := d.client.call(ctx, "free-space", freeSpaceArgs{Path: path}, &free); err != nil {
+		return 0, errors.Wrapf(client.ErrDriverError, "Failed to get free space: %v", err)
+	}
+	return free.Size, nil
+}
+
+// Capabilities does not include CapLabels, labels were only added to the RPC protocol with 3.0
+func (d Transmission) Capabilities() client.Capabilities {
+	return client.NewCapabilities(client.CapQueue, client.CapVerify, client.CapMoveData, client.CapFreeSpace,
+		client.CapFilePriorities, client.CapAnnounce, client.CapSetLocation, client.CapSessionLimits)
 }
 
-func (d Transmission) Announce(hash string) error {
-	return d.client.TorrentReannounceHashes([]string{hash})
+func (d Transmission) Announce(ctx context.Context, hash string) error {
+	return d.client.call(ctx, "torrent-reannounce", hashesArgs{Hashes: []string{hash}}, nil)
 }
 
-func (d Transmission) ClientVersion() (string, error) {
-	ok, verA, verB, err := d.client.RPCVersion()
+func (d Transmission) ClientVersion(ctx context.Context) (string, error) {
+	ok, verA, verB, err := d.client.rpcVersion(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -50,16 +62,190 @@ func (d Transmission) ClientVersion() (string, error) {
 	return fmt.Sprintf("Transmission %d/%d", verA, verB), nil
 }
 
+// Export reads the .torrent file transmission keeps for the torrent. The path reported by the
+// server is only readable when seedr runs on the same host, otherwise state_dir is used.
+func (d Transmission) Export(ctx context.Context, hash string) ([]byte, error) {
+	torrents, err := d.client.torrentGet(ctx, []string{"torrentFile"}, []string{hash})
+	if err != nil {
+		return nil, errors.Wrapf(client.ErrDriverError, "Failed to get torrent file path: %v", err)
+	}
+	if len(torrents) != 1 {
+		return nil, client.ErrUnknownTorrent
+	}
+	if torrents[0].TorrentFile != nil {
+		b, err := ioutil.ReadFile(*torrents[0].TorrentFile)
+		if err == nil {
+			return b, nil
+		}
+		log.Debugf("Could not read torrent file directly, trying state_dir: %v", err)
+	}
+	return client.ReadStateFile(d.cfg.StateDir, hash)
+}
+
+func (d Transmission) Files(ctx context.Context, hash string) ([]client.File, error) {
+	torrents, err := d.client.torrentGet(ctx, []string{"files", "fileStats"}, []string{hash})
+	if err != nil {
+		return nil, errors.Wrapf(client.ErrDriverError, "Failed to get torrent files: %v", err)
+	}
+	if len(torrents) != 1 {
+		return nil, client.ErrUnknownTorrent
+	}
+	t := torrents[0]
+	files := make([]client.File, len(t.Files))
+	for i, f := range t.Files {
+		files[i] = client.File{Index: i, Path: f.Name, Size: f.Length, Priority: client.PriorityNormal}
+		if f.Length > 0 {
+			files[i].Progress = float64(f.BytesCompleted) / float64(f.Length)
+		}
+		if i < len(t.FileStats) {
+			files[i].Priority = mapFilePriority(t.FileStats[i])
+		}
+	}
+	return files, nil
+}
+
+// mapFilePriority combines the wanted flag and the -1/0/1 bandwidth priority of a file
+func mapFilePriority(stat *transmissionrpc.TorrentFileStat) client.FilePriority {
+	switch {
+	case !stat.Wanted:
+		return client.PrioritySkip
+	case stat.Priority < 0:
+		return client.PriorityLow
+	case stat.Priority > 0:
+		return client.PriorityHigh
+	default:
+		return client.PriorityNormal
+	}
+}
+
+func (d Transmission) SetFilePriority(ctx context.Context, hash string, index int, priority client.FilePriority) error {
+	ids, err := d.getIDs(ctx, []string{hash})
+	if err != nil {
+		return err
+	}
+	if len(ids) != 1 {
+		return client.ErrUnknownTorrent
+	}
+	files := []int64{int64(index)}
+	payload := &transmissionrpc.TorrentSetPayload{IDs: ids}
+	switch priority {
+	case client.PrioritySkip:
+		payload.FilesUnwanted = files
+	case client.PriorityLow:
+		payload.FilesWanted = files
+		payload.PriorityLow = files
+	case client.PriorityHigh:
+		payload.FilesWanted = files
+		payload.PriorityHigh = files
+	default:
+		payload.FilesWanted = files
+		payload.PriorityNormal = files
+	}
+	return d.client.call(ctx, "torrent-set", payload, nil)
+}
+
+// speedUnit is the size of transmissions KBps unit
+const speedUnit = 1000
+
+// limitValue converts an enabled flag and limit pair into our zero is unlimited form
+func limitValue(enabled *bool, limit *int64, scale int64) *int64 {
+	var v int64
+	if enabled != nil && *enabled && limit != nil {
+		v = *limit * scale
+	}
+	return &v
+}
+
+func intPtr(v *int64) *int {
+	if v == nil {
+		return nil
+	}
+	i := int(*v)
+	return &i
+}
+
+func (d Transmission) SessionSettings(ctx context.Context) (*client.SessionSettings, error) {
+	args, err := d.client.sessionGet(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(client.ErrDriverError, "Failed to get session settings: %v", err)
+	}
+	return &client.SessionSettings{
+		UploadLimit:              limitValue(args.SpeedLimitUpEnabled, args.SpeedLimitUp, speedUnit),
+		DownloadLimit:            limitValue(args.SpeedLimitDownEnabled, args.SpeedLimitDown, speedUnit),
+		MaxActiveDownloads:       intPtr(limitValue(args.DownloadQueueEnabled, args.DownloadQueueSize, 1)),
+		MaxActiveSeeding:         intPtr(limitValue(args.SeedQueueEnabled, args.SeedQueueSize, 1)),
+		MaxConnections:           intPtr(args.PeerLimitGlobal),
+		MaxConnectionsPerTorrent: intPtr(args.PeerLimitPerTorrent),
+	}, nil
+}
+
+// setLimit fills an enabled flag and limit pair, a zero value disables the limit
+func setLimit(value int64, scale int64) (*bool, *int64) {
+	enabled := value > 0
+	if !enabled {
+		return &enabled, nil
+	}
+	v := value / scale
+	if v == 0 {
+		v = 1
+	}
+	return &enabled, &v
+}
+
+func (d Transmission) SetSessionSettings(ctx context.Context, settings *client.SessionSettings) error {
+	var args transmissionrpc.SessionArguments
+	if settings.UploadLimit != nil {
+		args.SpeedLimitUpEnabled, args.SpeedLimitUp = setLimit(*settings.UploadLimit, speedUnit)
+	}
+	if settings.DownloadLimit != nil {
+		args.SpeedLimitDownEnabled, args.SpeedLimitDown = setLimit(*settings.DownloadLimit, speedUnit)
+	}
+	if settings.MaxActiveDownloads != nil {
+		args.DownloadQueueEnabled, args.DownloadQueueSize = setLimit(int64(*settings.MaxActiveDownloads), 1)
+	}
+	if settings.MaxActiveSeeding != nil {
+		args.SeedQueueEnabled, args.SeedQueueSize = setLimit(int64(*settings.MaxActiveSeeding), 1)
+	}
+	if settings.MaxConnections != nil {
+		v := int64(*settings.MaxConnections)
+		args.PeerLimitGlobal = &v
+	}
+	if settings.MaxConnectionsPerTorrent != nil {
+		v := int64(*settings.MaxConnectionsPerTorrent)
+		args.PeerLimitPerTorrent = &v
+	}
+	return d.client.call(ctx, "session-set", &args, nil)
+}
+
+func (d Transmission) SetLimits(ctx context.Context, hash string, upload int64, download int64) error {
+	ids, err := d.getIDs(ctx, []string{hash})
+	if err != nil {
+		return err
+	}
+	if len(ids) != 1 {
+		return client.ErrUnknownTorrent
+	}
+	payload := &transmissionrpc.TorrentSetPayload{IDs: ids}
+	payload.UploadLimited, payload.UploadLimit = setLimit(upload, speedUnit)
+	payload.DownloadLimited, payload.DownloadLimit = setLimit(download, speedUnit)
+	return d.client.call(ctx, "torrent-set", payload, nil)
+}
+
+// Close does nothing, the RPC is stateless HTTP. session-close would shut down the daemon itself.
 func (d Transmission) Close() error {
-	return d.client.SessionClose()
+	return nil
 }
 
-func (d Transmission) Pause(hash string) error {
-	return d.client.TorrentStopHashes([]string{hash})
+func (d Transmission) Stateless() bool {
+	return true
 }
 
-func (d Transmission) PauseAll() error {
-	torrents, err := d.Torrents()
+func (d Transmission) Pause(ctx context.Context, hash string) error {
+	return d.client.call(ctx, "torrent-stop", hashesArgs{Hashes: []string{hash}}, nil)
+}
+
+func (d Transmission) PauseAll(ctx context.Context) error {
+	torrents, err := d.Torrents(ctx)
 	if err != nil {
 		return err
 	}
@@ -67,56 +253,80 @@ func (d Transmission) PauseAll() error {
 	for _, torrent := range torrents {
 		hashes = append(hashes, torrent.Hash)
 	}
-	return d.client.TorrentStopHashes(hashes)
+	return d.client.call(ctx, "torrent-stop", hashesArgs{Hashes: hashes}, nil)
+}
+
+func (d Transmission) PauseMany(ctx context.Context, hashes []string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	return d.client.call(ctx, "torrent-stop", hashesArgs{Hashes: hashes}, nil)
 }
 
-func (d Transmission) getIDs(hashes []string) ([]int64, error) {
-	var ids []int64
-	all, err := d.client.TorrentGetAll()
+// getIDs resolves the hashes to the ids required by some methods, unknown hashes are left out
+func (d Transmission) getIDs(ctx context.Context, hashes []string) ([]int64, error) {
+	torrents, err := d.client.torrentGet(ctx, []string{"id"}, hashes)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrapf(client.ErrDriverError, "Failed to get torrent ids: %v", err)
 	}
-	for _, torrent := range all {
-		for _, hash := range hashes {
-			if *torrent.HashString == hash {
-				ids = append(ids, *torrent.ID)
-				break
-			}
-		}
+	ids := make([]int64, 0, len(torrents))
+	for _, torrent := range torrents {
+		ids = append(ids, *torrent.ID)
 	}
 	return ids, nil
 }
 
-func (d Transmission) Queue(hash string, position client.QueuePos) error {
-	ids, err := d.getIDs([]string{hash})
+func (d Transmission) Peers(ctx context.Context, hash string) ([]client.Peer, error) {
+	torrents, err := d.client.torrentGet(ctx, []string{"peers"}, []string{hash})
+	if err != nil {
+		return nil, errors.Wrapf(client.ErrDriverError, "Failed to get torrent peers: %v", err)
+	}
+	if len(torrents) != 1 {
+		return nil, client.ErrUnknownTorrent
+	}
+	peers := make([]client.Peer, len(torrents[0].Peers))
+	for i, p := range torrents[0].Peers {
+		peers[i] = client.Peer{
+			Address:  fmt.Sprintf("%s:%d", p.Address, p.Port),
+			Client:   p.ClientName,
+			Progress: p.Progress,
+			SpeedUP:  p.RateToPeer,
+			SpeedDN:  p.RateToClient,
+		}
+	}
+	return peers, nil
+}
+
+func (d Transmission) Queue(ctx context.Context, hash string, position client.QueuePos) error {
+	ids, err := d.getIDs(ctx, []string{hash})
 	if err != nil {
 		return err
 	}
+	method := "queue-move-bottom"
 	switch position {
 	case client.Top:
-		return d.client.QueueMoveTop(ids)
+		method = "queue-move-top"
 	case client.Up:
-		return d.client.QueueMoveUp(ids)
+		method = "queue-move-up"
 	case client.Down:
-		return d.client.QueueMoveDown(ids)
-	default:
-		return d.client.QueueMoveBottom(ids)
+		method = "queue-move-down"
 	}
+	return d.client.call(ctx, method, idsArgs{IDs: ids}, nil)
 }
 
-func (d Transmission) Start(hash string) error {
-	return d.client.TorrentStartHashes([]string{hash})
+func (d Transmission) Start(ctx context.Context, hash string) error {
+	return d.client.call(ctx, "torrent-start", hashesArgs{Hashes: []string{hash}}, nil)
 }
 
-func (d Transmission) StartAll() error {
-	return d.client.TorrentStartHashes(nil)
+func (d Transmission) StartAll(ctx context.Context) error {
+	return d.client.call(ctx, "torrent-start", hashesArgs{}, nil)
 }
 
-func (d Transmission) Stop(hash string) error {
-	return d.client.TorrentStopHashes([]string{hash})
+func (d Transmission) Stop(ctx context.Context, hash string) error {
+	return d.client.call(ctx, "torrent-stop", hashesArgs{Hashes: []string{hash}}, nil)
 }
 
-func (d Transmission) TorrentsWithState(statuses ...client.State) ([]client.Torrent, error) {
+func (d Transmission) TorrentsWithState(ctx context.Context, statuses ...client.State) ([]*client.Torrent, error) {
 	var validStatuses []transmissionrpc.TorrentStatus
 	for k, v := range stateMap {
 		for _, status := range statuses {
@@ -125,17 +335,17 @@ func (d Transmission) TorrentsWithState(statuses ...client.State) ([]client.Torr
 			}
 		}
 	}
-	torrents, err := d.client.TorrentGetAll()
+	torrents, err := d.client.torrentGet(ctx, torrentFields, nil)
 	if err != nil {
 		return nil, err
 	}
-	var validTorrents []client.Torrent
+	var validTorrents []*client.Torrent
 	for _, torrent := range torrents {
 		for _, validState := range validStatuses {
 			if *torrent.Status == validState {
 				var t client.Torrent
 				mapTorrentStatus(torrent, &t)
-				validTorrents = append(validTorrents, t)
+				validTorrents = append(validTorrents, &t)
 				break
 			}
 		}
@@ -143,12 +353,50 @@ func (d Transmission) TorrentsWithState(statuses ...client.State) ([]client.Torr
 	return validTorrents, nil
 }
 
-func (d Transmission) Verify(hash string) error {
-	return d.client.TorrentVerifyHashes([]string{hash})
+func (d Transmission) Trackers(ctx context.Context, hash string) ([]client.Tracker, error) {
+	torrents, err := d.client.torrentGet(ctx, []string{"trackerStats"}, []string{hash})
+	if err != nil {
+		return nil, errors.Wrapf(client.ErrDriverError, "Failed to get torrent trackers: %v", err)
+	}
+	if len(torrents) != 1 {
+		return nil, client.ErrUnknownTorrent
+	}
+	trackers := make([]client.Tracker, len(torrents[0].TrackerStats))
+	for i, ts := range torrents[0].TrackerStats {
+		trackers[i] = client.Tracker{
+			URL:          ts.Announce,
+			Tier:         int(ts.Tier),
+			Status:       mapTrackerStatus(ts),
+			Message:      ts.LastAnnounceResult,
+			Seeders:      int(ts.SeederCount),
+			Leechers:     int(ts.LeecherCount),
+			NextAnnounce: ts.NextAnnounceTime,
+		}
+	}
+	return trackers, nil
+}
+
+// mapTrackerStatus uses the announce state, 0 inactive, 1 waiting, 2 queued and 3 active, along with
+// the result of the last announce
+func mapTrackerStatus(ts *transmissionrpc.TrackerStats) client.TrackerStatus {
+	switch {
+	case ts.AnnounceState == 3:
+		return client.TrackerUpdating
+	case !ts.HasAnnounced:
+		return client.TrackerNotContacted
+	case !ts.LastAnnounceSucceeded:
+		return client.TrackerError
+	default:
+		return client.TrackerWorking
+	}
+}
+
+func (d Transmission) Verify(ctx context.Context, hash string) error {
+	return d.client.call(ctx, "torrent-verify", hashesArgs{Hashes: []string{hash}}, nil)
 }
 
-func (d Transmission) Login() error {
-	ok, serverVersion, serverMinimumVersion, err := d.client.RPCVersion()
+func (d Transmission) Login(ctx context.Context) error {
+	ok, serverVersion, serverMinimumVersion, err := d.client.rpcVersion(ctx)
 	if err != nil {
 		return errors.Wrapf(client.ErrDriverError, "Failed client checks: %v", err)
 	}
@@ -165,25 +413,52 @@ func mapTorrentStatus(status *transmissionrpc.Torrent, torrent *client.Torrent)
 	torrent.Hash = *status.HashString
 	torrent.Name = *status.Name
 	torrent.Path = *status.DownloadDir
-
+	if status.PercentDone != nil {
+		torrent.Progress = *status.PercentDone
+	}
+	if status.RateUpload != nil {
+		torrent.SpeedUP = *status.RateUpload
+	}
+	if status.Status != nil {
+		if state, ok := stateMap[*status.Status]; ok {
+			torrent.State = state
+		}
+	}
 }
 
-func (d Transmission) Torrents() ([]client.Torrent, error) {
-	all, err := d.client.TorrentGetAll()
+func (d Transmission) Torrents(ctx context.Context) ([]*client.Torrent, error) {
+	all, err := d.client.torrentGet(ctx, torrentFields, nil)
 	if err != nil {
 		return nil, err
 	}
-	var torrents []client.Torrent
+	var torrents []*client.Torrent
+	for _, t := range all {
+		var torrent client.Torrent
+		mapTorrentStatus(t, &torrent)
+		torrents = append(torrents, &torrent)
+	}
+	return torrents, nil
+}
+
+func (d Transmission) TorrentsByHash(ctx context.Context, hashes []string) (map[string]*client.Torrent, error) {
+	torrents := make(map[string]*client.Torrent, len(hashes))
+	if len(hashes) == 0 {
+		return torrents, nil
+	}
+	all, err := d.client.torrentGet(ctx, torrentFields, hashes)
+	if err != nil {
+		return nil, errors.Wrapf(client.ErrDriverError, "Failed to get torrents: %v", err)
+	}
 	for _, t := range all {
 		var torrent client.Torrent
 		mapTorrentStatus(t, &torrent)
-		torrents = append(torrents, torrent)
+		torrents[torrent.Hash] = &torrent
 	}
 	return torrents, nil
 }
 
-func (d Transmission) Torrent(hash string, torrent *client.Torrent) error {
-	torrents, err := d.client.TorrentGetAllForHashes([]string{hash})
+func (d Transmission) Torrent(ctx context.Context, hash string, torrent *client.Torrent) error {
+	torrents, err := d.client.torrentGet(ctx, torrentFields, []string{hash})
 	if err != nil {
 		return err
 	}
@@ -194,37 +469,68 @@ func (d Transmission) Torrent(hash string, torrent *client.Torrent) error {
 	return nil
 }
 
-func (d Transmission) Move(hash string, dest string) error {
-	return d.client.TorrentSetLocationHash(hash, dest, true)
+func (d Transmission) Move(ctx context.Context, hash string, dest string) error {
+	return d.client.call(ctx, "torrent-set-location", setLocationArgs{Hashes: []string{hash}, Location: dest, Move: true}, nil)
+}
+
+func (d Transmission) MoveMany(ctx context.Context, hashes []string, dest string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	if err := d.client.call(ctx, "torrent-set-location", setLocationArgs{Hashes: hashes, Location: dest, Move: true}, nil); err != nil {
+		return errors.Wrapf(client.ErrDriverError, "Failed to move torrents: %v", err)
+	}
+	return nil
+}
+
+func (d Transmission) SetLocation(ctx context.Context, hash string, dest string) error {
+	return d.client.call(ctx, "torrent-set-location", setLocationArgs{Hashes: []string{hash}, Location: dest}, nil)
 }
 
-func (d Transmission) Remove(hash string, deleteData bool) error {
-	torrents, err := d.client.TorrentGetAllForHashes([]string{hash})
+func (d Transmission) Remove(ctx context.Context, hash string, deleteData bool) error {
+	ids, err := d.getIDs(ctx, []string{hash})
 	if err != nil {
-		return errors.Wrapf(client.ErrDriverError, "Failed to get torrent to delete: %v", err)
+		return err
 	}
-	if len(torrents) != 1 {
+	if len(ids) != 1 {
 		return client.ErrUnknownTorrent
 	}
-	return d.client.TorrentRemove(&transmissionrpc.TorrentRemovePayload{
-		IDs:             []int64{*torrents[0].ID},
+	return d.client.call(ctx, "torrent-remove", &transmissionrpc.TorrentRemovePayload{
+		IDs:             ids,
+		DeleteLocalData: deleteData,
+	}, nil)
+}
+
+func (d Transmission) RemoveMany(ctx context.Context, hashes []string, deleteData bool) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	ids, err := d.getIDs(ctx, hashes)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return d.client.call(ctx, "torrent-remove", &transmissionrpc.TorrentRemovePayload{
+		IDs:             ids,
 		DeleteLocalData: deleteData,
-	})
+	}, nil)
 }
 
-func (d Transmission) Add(filename string, torrent io.Reader, path string, _ string) error {
+func (d Transmission) Add(ctx context.Context, filename string, torrent io.Reader, path string, _ string, opts client.AddOptions) error {
 	b, err := ioutil.ReadAll(torrent)
 	if err != nil {
 		return err
 	}
 	b64 := base64.StdEncoding.EncodeToString(b)
-	paused := false
-	if _, err := d.client.TorrentAdd(&transmissionrpc.TorrentAddPayload{
+	paused := opts.Paused
+	if err := d.client.call(ctx, "torrent-add", &transmissionrpc.TorrentAddPayload{
 		Paused:      &paused,
 		DownloadDir: &path,
 		//Filename:    &filename,
 		MetaInfo: &b64,
-	}); err != nil {
+	}, nil); err != nil {
 		return errors.Wrapf(err, "Failed to upload new torrent")
 	}
 	return nil
@@ -233,14 +539,15 @@ func (d Transmission) Add(filename string, torrent io.Reader, path string, _ str
 type Factory struct{}
 
 func (f Factory) New(cfg *client.Config) (client.Driver, error) {
-	c, err := transmissionrpc.New(cfg.Host, cfg.Username, cfg.Password,
-		&transmissionrpc.AdvancedConfig{
-			HTTPS: cfg.TLS,
-			Port:  cfg.Port,
-		})
+	if cfg.BasicAuthUser != "" {
+		return nil, errors.Wrapf(client.ErrInvalidConfig, "transmission uses basic auth for its own login, set user and password instead")
+	}
+	transport, err := cfg.Transport()
 	if err != nil {
-		return nil, errors.Wrapf(client.ErrDriverError, "Failed to create driver instance: %v", err)
+		return nil, err
 	}
+	c := newRPCClient(cfg.URL("/transmission/rpc"), cfg.Username, cfg.Password,
+		&http.Client{Transport: transport, Timeout: cfg.Timeout})
 	return Transmission{cfg: cfg, client: c}, nil
 }
 
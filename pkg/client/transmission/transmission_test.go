@@ -1,14 +1,24 @@
 package transmission
 
 import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"github.com/leighmacdonald/seedr/pkg/client"
 	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
 func TestTransmission(t *testing.T) {
 	f := Factory{}
-	c, err := f.New(client.Config{
+	c, err := f.New(&client.Config{
 		Driver:   "transmission",
 		Username: "test_user",
 		Password: "test_pass",
@@ -19,3 +29,49 @@ func TestTransmission(t *testing.T) {
 	require.NoErrorf(t, err, "failed to create qbittorrent client")
 	client.DriverTestSuite(t, c)
 }
+
+func TestTransmissionTLS(t *testing.T) {
+	var path string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		if r.Header.Get("X-Transmission-Session-Id") != "session" {
+			w.Header().Set("X-Transmission-Session-Id", "session")
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		var req struct {
+			Method string `json:"method"`
+			Tag    int    `json:"tag"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		args := `{"rpc-version":15,"rpc-version-minimum":1}`
+		if req.Method == "torrent-get" {
+			args = `{"torrents":[{"hashString":"abc","name":"test","downloadDir":"/data","percentDone":1,"status":6}]}`
+		}
+		_, _ = fmt.Fprintf(w, `{"result":"success","tag":%d,"arguments":%s}`, req.Tag, args)
+	}))
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "seedr-transmission")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	require.NoError(t, ioutil.WriteFile(caFile, ca, 0600))
+	c, err := Factory{}.New(&client.Config{
+		Host:     "127.0.0.1",
+		Port:     uint16(srv.Listener.Addr().(*net.TCPAddr).Port),
+		TLS:      true,
+		CAFile:   caFile,
+		BasePath: "/proxy",
+	})
+	require.NoError(t, err)
+	_, err = c.ClientVersion(context.Background())
+	require.NoError(t, err, "The ca_file should be used to verify the certificate")
+	require.Equal(t, "/proxy/transmission/rpc", path)
+	torrents, err := c.Torrents(context.Background())
+	require.NoError(t, err)
+	require.Len(t, torrents, 1)
+	require.Equal(t, "test", torrents[0].Name)
+	require.Equal(t, "/data", torrents[0].Path)
+	require.Equal(t, client.Seeding, torrents[0].State)
+}
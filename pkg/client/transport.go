@@ -0,0 +1,126 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// TLSConfig builds the TLS configuration used to connect to the client. The system roots are used to
+// verify the clients certificate unless a CA bundle is set.
+func (cfg *Config) TLSConfig() (*tls.Config, error) {
+	tlsCfg := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CAFile != "" {
+		b, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidConfig, "Failed to read ca_file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.Wrapf(ErrInvalidConfig, "No certificates found in ca_file %s", cfg.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidConfig, "Failed to load client certificate: %v", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+// Transport returns the round tripper used by HTTP based clients. It uses the TLSConfig and sends the
+// basic auth credentials, when set, with every request.
+func (cfg *Config) Transport() (http.RoundTripper, error) {
+	tlsCfg, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+	return BasicAuth(transport, cfg.BasicAuthUser, cfg.BasicAuthPassword), nil
+}
+
+// URL returns the address of HTTP based clients with the base path and then path appended
+func (cfg *Config) URL(path string) string {
+	scheme := "http"
+	if cfg.TLS {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s:%d%s%s", scheme, cfg.Host, cfg.Port, strings.TrimRight(cfg.BasePath, "/"), path)
+}
+
+// LoadCredentials reads the passwords from their file or environment variable options when set, so
+// they do not have to be stored in the configuration file
+func (cfg *Config) LoadCredentials() error {
+	password, err := loadSecret("password", cfg.Password, cfg.PasswordFile, cfg.PasswordEnv)
+	if err != nil {
+		return err
+	}
+	cfg.Password = password
+	password, err = loadSecret("basic_auth_password", cfg.BasicAuthPassword, cfg.BasicAuthPasswordFile,
+		cfg.BasicAuthPasswordEnv)
+	if err != nil {
+		return err
+	}
+	cfg.BasicAuthPassword = password
+	return nil
+}
+
+// loadSecret returns whichever one of value, the contents of file or the environment variable env is
+// set. Trailing newlines are trimmed from the file.
+func loadSecret(key string, value string, file string, env string) (string, error) {
+	set := 0
+	for _, v := range []string{value, file, env} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return "", errors.Wrapf(ErrInvalidConfig, "Only one of %s, %s_file and %s_env can be set", key, key, key)
+	}
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", errors.Wrapf(ErrInvalidConfig, "Failed to read %s_file: %v", key, err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	if env != "" {
+		v, found := os.LookupEnv(env)
+		if !found {
+			return "", errors.Wrapf(ErrInvalidConfig, "Environment variable %s for %s_env is not set", env, key)
+		}
+		return v, nil
+	}
+	return value, nil
+}
+
+type basicAuthTransport struct {
+	next     http.RoundTripper
+	user     string
+	password string
+}
+
+func (t basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request it was given
+	r := req.Clone(req.Context())
+	r.SetBasicAuth(t.user, t.password)
+	return t.next.RoundTrip(r)
+}
+
+// BasicAuth wraps next to send the credentials with every request, next is returned as is when user
+// is empty
+func BasicAuth(next http.RoundTripper, user string, password string) http.RoundTripper {
+	if user == "" {
+		return next
+	}
+	return basicAuthTransport{next: next, user: user, password: password}
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"encoding/pem"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTransport(t *testing.T) {
+	var user, password, path string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ = r.BasicAuth()
+		path = r.URL.Path
+	}))
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "seedr-transport")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	require.NoError(t, ioutil.WriteFile(caFile, ca, 0600))
+
+	cfg := &Config{Host: "127.0.0.1", Port: uint16(srv.Listener.Addr().(*net.TCPAddr).Port), TLS: true,
+		BasePath: "/qbittorrent/"}
+	transport, err := cfg.Transport()
+	require.NoError(t, err)
+	_, err = (&http.Client{Transport: transport}).Get(cfg.URL("/api"))
+	require.Error(t, err, "The test certificate should not be trusted by default")
+
+	cfg.CAFile = caFile
+	cfg.BasicAuthUser, cfg.BasicAuthPassword = "proxy", "secret"
+	transport, err = cfg.Transport()
+	require.NoError(t, err)
+	resp, err := (&http.Client{Transport: transport}).Get(cfg.URL("/api"))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, "/qbittorrent/api", path)
+	require.Equal(t, "proxy", user)
+	require.Equal(t, "secret", password)
+
+	cfg.CAFile = filepath.Join(dir, "missing.pem")
+	_, err = cfg.Transport()
+	require.True(t, errors.Is(err, ErrInvalidConfig))
+}
+
+func TestLoadCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seedr-credentials")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	passwordFile := filepath.Join(dir, "password")
+	require.NoError(t, ioutil.WriteFile(passwordFile, []byte("from file\n"), 0600))
+	require.NoError(t, os.Setenv("SEEDR_TEST_PASSWORD", "from env"))
+	defer func() { _ = os.Unsetenv("SEEDR_TEST_PASSWORD") }()
+
+	cfg := &Config{PasswordFile: passwordFile, BasicAuthPasswordEnv: "SEEDR_TEST_PASSWORD"}
+	require.NoError(t, cfg.LoadCredentials())
+	require.Equal(t, "from file", cfg.Password)
+	require.Equal(t, "from env", cfg.BasicAuthPassword)
+
+	cfg = &Config{Password: "inline", PasswordEnv: "SEEDR_TEST_PASSWORD"}
+	require.True(t, errors.Is(cfg.LoadCredentials(), ErrInvalidConfig), "Only one source can be set")
+	cfg = &Config{PasswordEnv: "SEEDR_TEST_UNSET"}
+	require.True(t, errors.Is(cfg.LoadCredentials(), ErrInvalidConfig))
+	cfg = &Config{Password: "inline"}
+	require.NoError(t, cfg.LoadCredentials())
+	require.Equal(t, "inline", cfg.Password)
+}